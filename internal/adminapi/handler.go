@@ -1,7 +1,9 @@
 package adminapi
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"strconv"
@@ -278,17 +280,45 @@ func (h *Handler) AddJWTSecret(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Name      string `json:"name"`
 		Secret    string `json:"secret"`
-		Algorithm string `json:"algorithm"`
+		Algorithm string `json:"algorithm"` // HS*, RS*, PS*, ES* or EdDSA; ignored with jwks_url
+		JWKSURL   string `json:"jwks_url"`
+
+		// Token requirements overriding the auth config for this secret.
+		Issuer          string   `json:"issuer"`
+		Audience        []string `json:"audience"`
+		LeewaySeconds   int      `json:"leeway_seconds"`
+		RequiredClaims  []string `json:"required_claims"`
+		ClaimsNamespace string   `json:"claims_namespace"` // key or JSON path, e.g. $["https://kastql.io/claims"]
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 		return
 	}
-	if body.Name == "" || body.Secret == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name and secret required"})
+	if body.Name == "" || (body.Secret == "" && body.JWKSURL == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name and secret (or jwks_url) required"})
+		return
+	}
+	if _, err := auth.NewKey(body.Name, body.Algorithm, body.Secret, body.JWKSURL); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-	s, err := h.store.AddJWTSecret(body.Name, body.Secret, body.Algorithm)
+	sec := &metadata.JWTSecret{
+		Name:      body.Name,
+		Algorithm: body.Algorithm,
+		JWKSURL:   body.JWKSURL,
+		JWTValidation: metadata.JWTValidation{
+			Issuer:          body.Issuer,
+			Audience:        metadata.JSONList(body.Audience),
+			LeewaySeconds:   body.LeewaySeconds,
+			RequiredClaims:  metadata.JSONList(body.RequiredClaims),
+			ClaimsNamespace: body.ClaimsNamespace,
+		},
+	}
+	if _, err := auth.ValidationFromRow(sec.JWTValidation); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s, err := h.store.AddJWTSecret(sec, body.Secret)
 	if err != nil {
 		if err == metadata.ErrNameTaken {
 			writeJSON(w, http.StatusConflict, map[string]string{"error": "name already taken"})
@@ -534,10 +564,15 @@ func (h *Handler) AddPersistedQuery(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 		return
 	}
-	if body.ID == "" || body.Query == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id and query required"})
+	if body.Query == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "query required"})
 		return
 	}
+	if body.ID == "" {
+		// Default to the query's SHA-256 so APQ clients can send it by hash.
+		sum := sha256.Sum256([]byte(body.Query))
+		body.ID = hex.EncodeToString(sum[:])
+	}
 	if body.Name == "" {
 		body.Name = body.ID
 	}
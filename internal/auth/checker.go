@@ -2,14 +2,23 @@ package auth
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/deformal/kastql/internal/metadata"
 )
 
-// Checker implements planner.PermissionChecker against the metadata SQLite DB.
+// Checker implements planner.PermissionChecker against the permissions in the
+// metadata DB. Rules are compiled into an in-memory index on first use; call
+// Reload after permissions change.
 type Checker struct {
-	store *metadata.Store
+	store  *metadata.Store
+	index  atomic.Pointer[permissionIndex]
+	loadMu sync.Mutex
 }
 
 // NewChecker creates a Checker backed by the given metadata store.
@@ -17,40 +26,329 @@ func NewChecker(store *metadata.Store) *Checker {
 	return &Checker{store: store}
 }
 
-// CanAccess returns true if the given role may access typeName.fieldName.
+// permissionIndex holds every role's rules and settings.
+type permissionIndex struct {
+	roles map[string]*roleRules
+}
+
+// roleRules are the rules of one role. Rules naming a type and field
+// outright are found by key; those with a glob pattern such as "User*" are
+// matched in turn. An empty or "*" service, type or field name matches any.
+type roleRules struct {
+	name        string
+	exact       map[ruleKey]*compiledRule
+	patterns    []*compiledRule
+	parents     []string
+	chain       []*roleRules // this role, then its ancestors depth-first
+	policy      string       // "allow" | "deny" | "" = unset
+	partialDeny bool         // forbidden fields are nulled
+}
+
+type ruleKey struct{ service, typeName, fieldName string }
+
+// compiledRule is a permission row with its JSON already decoded. Session
+// variables are resolved per request.
+type compiledRule struct {
+	perm      *metadata.Permission // the row, for explaining decisions
+	key       ruleKey              // wildcards normalised to ""
+	allow     bool
+	condition map[string]any // nil = none
+	preset    any            // nil = none
+}
+
+// Reload rebuilds the permission index from the store. The previous index
+// keeps serving until the new one is ready.
+func (c *Checker) Reload() error {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	return c.reloadLocked()
+}
+
+func (c *Checker) reloadLocked() error {
+	perms, err := c.store.ListPermissions()
+	if err != nil {
+		return fmt.Errorf("load permissions: %w", err)
+	}
+	roles, err := c.store.ListRoles()
+	if err != nil {
+		return fmt.Errorf("load roles: %w", err)
+	}
+	idx := &permissionIndex{roles: map[string]*roleRules{}}
+	for _, r := range roles {
+		rr := idx.role(r.Name)
+		rr.partialDeny = r.PartialDeny
+		rr.policy = r.DefaultPolicy
+		if r.Inherits != "" {
+			if err := json.Unmarshal([]byte(r.Inherits), &rr.parents); err != nil {
+				return fmt.Errorf("decode parents of role %s: %w", r.Name, err)
+			}
+		}
+	}
+	for _, p := range perms {
+		rule := &compiledRule{
+			perm:  p,
+			key:   ruleKey{wildcard(p.Service), wildcard(p.TypeName), wildcard(p.FieldName)},
+			allow: p.Allow,
+		}
+		if p.Condition != "" && p.Condition != "{}" {
+			if err := json.Unmarshal([]byte(p.Condition), &rule.condition); err != nil {
+				return fmt.Errorf("decode condition for %s %s.%s: %w", p.Role, p.TypeName, p.FieldName, err)
+			}
+		}
+		if p.Preset != "" {
+			if err := json.Unmarshal([]byte(p.Preset), &rule.preset); err != nil {
+				return fmt.Errorf("decode preset for %s %s.%s: %w", p.Role, p.TypeName, p.FieldName, err)
+			}
+		}
+		rr := idx.role(p.Role)
+		if isPattern(rule.key.typeName) || isPattern(rule.key.fieldName) {
+			rr.patterns = append(rr.patterns, rule)
+		} else if rr.exact[rule.key] == nil {
+			// "" and "*" rows may share a key; the first one wins.
+			rr.exact[rule.key] = rule
+		}
+	}
+	for _, rr := range idx.roles {
+		rr.chain = idx.ancestry(rr, nil, map[string]bool{})
+	}
+	c.index.Store(idx)
+	return nil
+}
+
+func (idx *permissionIndex) role(name string) *roleRules {
+	rr := idx.roles[name]
+	if rr == nil {
+		rr = &roleRules{name: name, exact: map[ruleKey]*compiledRule{}}
+		idx.roles[name] = rr
+	}
+	return rr
+}
+
+// ancestry appends rr and its ancestors, depth-first in the order parents
+// are listed. Each role appears once, so cycles end.
+func (idx *permissionIndex) ancestry(rr *roleRules, out []*roleRules, seen map[string]bool) []*roleRules {
+	if seen[rr.name] {
+		return out
+	}
+	seen[rr.name] = true
+	out = append(out, rr)
+	for _, name := range rr.parents {
+		if parent := idx.roles[name]; parent != nil {
+			out = idx.ancestry(parent, out, seen)
+		}
+	}
+	return out
+}
+
+func wildcard(name string) string {
+	if name == "*" {
+		return ""
+	}
+	return name
+}
+
+func isPattern(name string) bool {
+	return strings.Contains(name, "*")
+}
+
+// rules returns the index, loading it on first use.
+func (c *Checker) rules() (*permissionIndex, error) {
+	if idx := c.index.Load(); idx != nil {
+		return idx, nil
+	}
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	if idx := c.index.Load(); idx != nil {
+		return idx, nil
+	}
+	if err := c.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return c.index.Load(), nil
+}
+
+// CanAccess returns true if the given role may access typeName.fieldName as
+// resolved by service.
 //
-// Rule precedence (most specific wins):
-//  1. role + type + field  → exact rule
-//  2. role + type          → applies to all fields of the type
-//  3. No rule found        → public role is allowed; all others are denied
-func (c *Checker) CanAccess(ctx context.Context, role, typeName, fieldName string) (bool, error) {
+// The role's own rules are consulted first, then those of each role it
+// inherits from. Within a role the most specific rule wins, except that an
+// allow only overrides a deny it is at least as specific as in every part
+// (see best):
+//  1. role + service       → rules for the resolving service, including a
+//     service-wide rule with no type or field
+//  2. role + type + field  → exact rule, then a pattern such as "User.*" or
+//     "*.internalNotes"
+//  3. role + type          → applies to all fields of the type
+//  4. No rule found        → the default policy of the role or its nearest
+//     ancestor that sets one; failing that, public is allowed and all
+//     others are denied
+func (c *Checker) CanAccess(_ context.Context, role, service, typeName, fieldName string) (bool, error) {
+	d, err := c.decide(role, service, typeName, fieldName)
+	if err != nil {
+		return false, err
+	}
+	return d.allow, nil
+}
+
+// PartialDeny reports whether role's queries drop the fields it may not
+// access, returning them as null, rather than failing outright.
+func (c *Checker) PartialDeny(role string) (bool, error) {
+	if role == "" {
+		role = "public"
+	}
+	idx, err := c.rules()
+	if err != nil {
+		return false, err
+	}
+	rr := idx.roles[role]
+	return rr != nil && rr.partialDeny, nil
+}
+
+// decision is how access to one field was settled: by rule, by a role's
+// default policy (policyRole), or by the built-in default.
+type decision struct {
+	allow      bool
+	rule       *compiledRule
+	policyRole string
+	meta       bool // introspection field
+}
+
+func (c *Checker) decide(role, service, typeName, fieldName string) (decision, error) {
 	if role == "" {
 		role = "public"
 	}
 
 	// Skip permission checks for introspection fields — always allowed.
 	if fieldName == "__schema" || fieldName == "__type" || fieldName == "__typename" {
-		return true, nil
+		return decision{allow: true, meta: true}, nil
+	}
+
+	idx, err := c.rules()
+	if err != nil {
+		return decision{}, err
+	}
+	rr := idx.roles[role]
+	if rr == nil {
+		return decision{allow: role == "public"}, nil
+	}
+	for _, r := range rr.chain {
+		if rule := r.best(service, typeName, fieldName); rule != nil {
+			return decision{allow: rule.allow, rule: rule}, nil
+		}
+	}
+	for _, r := range rr.chain {
+		if r.policy != "" {
+			return decision{allow: r.policy == "allow", policyRole: r.name}, nil
+		}
 	}
+	return decision{allow: role == "public"}, nil
+}
 
-	var allow int
-	err := c.store.DB().QueryRowContext(ctx, `
-		SELECT allow FROM permissions
-		WHERE role = ?
-		  AND (type_name = ? OR type_name = '')
-		  AND (field_name = ? OR field_name = '')
-		ORDER BY
-		  CASE WHEN type_name  = ? THEN 0 ELSE 1 END,
-		  CASE WHEN field_name = ? THEN 0 ELSE 1 END
-		LIMIT 1
-	`, role, typeName, fieldName, typeName, fieldName).Scan(&allow)
+// rule returns the rule deciding role's access to typeName.fieldName in
+// service, from the role or an ancestor, or nil when no rule applies.
+func (c *Checker) rule(role, service, typeName, fieldName string) (*compiledRule, error) {
+	d, err := c.decide(role, service, typeName, fieldName)
+	return d.rule, err
+}
 
-	if err == sql.ErrNoRows {
-		// No rule found: public role has default access; others are denied.
-		return role == "public", nil
+// best returns the role's deciding rule for typeName.fieldName in service,
+// or nil when none matches. The most specific rule wins: a rule naming the
+// service beats one for every service, so denying a service outright
+// overrides grants that are not scoped to it. Within each, the type name
+// counts before the field name, and a name beats a pattern, which beats a
+// wildcard. An allow only overrides a matching deny it is at least as
+// specific as in service, type and field alike, so a "User.*" grant doesn't
+// reopen a "*.internalNotes" deny but a "User.internalNotes" one does.
+func (rr *roleRules) best(service, typeName, fieldName string) *compiledRule {
+	var matched []*compiledRule
+	consider := func(r *compiledRule) {
+		if r != nil && r.score(service, typeName, fieldName) >= 0 {
+			matched = append(matched, r)
+		}
 	}
-	if err != nil {
-		return false, err
+	for _, svc := range [...]string{service, ""} {
+		for _, t := range [...]string{typeName, ""} {
+			consider(rr.exact[ruleKey{svc, t, fieldName}])
+			consider(rr.exact[ruleKey{svc, t, ""}])
+		}
+	}
+	for _, r := range rr.patterns {
+		consider(r)
+	}
+
+	best := mostSpecific(matched, service, typeName, fieldName, func(*compiledRule) bool { return true })
+	if best == nil || !best.allow {
+		return best
+	}
+	bs := best.specificity(service, typeName, fieldName)
+	deny := mostSpecific(matched, service, typeName, fieldName, func(r *compiledRule) bool {
+		return !r.allow && !bs.covers(r.specificity(service, typeName, fieldName))
+	})
+	if deny != nil {
+		return deny
+	}
+	return best
+}
+
+// mostSpecific returns the highest scoring rule of rules that keep accepts.
+func mostSpecific(rules []*compiledRule, service, typeName, fieldName string, keep func(*compiledRule) bool) *compiledRule {
+	var best *compiledRule
+	bestScore := -1
+	for _, r := range rules {
+		if !keep(r) {
+			continue
+		}
+		if s := r.score(service, typeName, fieldName); s > bestScore {
+			best, bestScore = r, s
+		}
+	}
+	return best
+}
+
+// specificity is how precisely a rule names each part of a field.
+type specificity struct{ service, typeName, fieldName int }
+
+// covers reports whether s is at least as specific as o in every part.
+func (s specificity) covers(o specificity) bool {
+	return s.service >= o.service && s.typeName >= o.typeName && s.fieldName >= o.fieldName
+}
+
+func (r *compiledRule) specificity(service, typeName, fieldName string) specificity {
+	sp := specificity{
+		typeName:  nameScore(r.key.typeName, typeName),
+		fieldName: nameScore(r.key.fieldName, fieldName),
+	}
+	if r.key.service != "" && r.key.service == service {
+		sp.service = 1
+	}
+	return sp
+}
+
+// score ranks how specifically the rule matches, or returns -1 when it
+// does not.
+func (r *compiledRule) score(service, typeName, fieldName string) int {
+	if r.key.service != "" && r.key.service != service {
+		return -1
+	}
+	sp := r.specificity(service, typeName, fieldName)
+	if sp.typeName < 0 || sp.fieldName < 0 {
+		return -1
+	}
+	return sp.service*9 + sp.typeName*3 + sp.fieldName
+}
+
+// nameScore is 2 for an exact name, 1 for a matching pattern, 0 for the
+// wildcard and -1 for no match.
+func nameScore(pattern, name string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case pattern == name:
+		return 2
+	case isPattern(pattern):
+		if ok, _ := path.Match(pattern, name); ok {
+			return 1
+		}
 	}
-	return allow == 1, nil
+	return -1
 }
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/deformal/kastql/internal/metadata"
@@ -17,7 +18,7 @@ func TestCheckerNoRules(t *testing.T) {
 	c := NewChecker(store)
 
 	// public role → allow by default (no rules)
-	ok, err := c.CanAccess(context.Background(), "public", "User", "name")
+	ok, err := c.CanAccess(context.Background(), "public", "", "User", "name")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -26,7 +27,7 @@ func TestCheckerNoRules(t *testing.T) {
 	}
 
 	// non-public role → deny by default (no rules)
-	ok, err = c.CanAccess(context.Background(), "admin", "User", "name")
+	ok, err = c.CanAccess(context.Background(), "admin", "", "User", "name")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +54,7 @@ func TestCheckerExplicitAllow(t *testing.T) {
 
 	c := NewChecker(store)
 
-	ok, err := c.CanAccess(context.Background(), "admin", "User", "name")
+	ok, err := c.CanAccess(context.Background(), "admin", "", "User", "name")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +81,7 @@ func TestCheckerExplicitDenyPublic(t *testing.T) {
 
 	c := NewChecker(store)
 
-	ok, err := c.CanAccess(context.Background(), "public", "User", "password")
+	ok, err := c.CanAccess(context.Background(), "public", "", "User", "password")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,7 +100,7 @@ func TestCheckerIntrospectionAlwaysAllowed(t *testing.T) {
 	c := NewChecker(store)
 
 	for _, field := range []string{"__schema", "__type", "__typename"} {
-		ok, err := c.CanAccess(context.Background(), "restricted", "Query", field)
+		ok, err := c.CanAccess(context.Background(), "restricted", "", "Query", field)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -108,3 +109,195 @@ func TestCheckerIntrospectionAlwaysAllowed(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckerInputRulePresetFromClaims(t *testing.T) {
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, err = store.DB().Exec(`
+		INSERT INTO permissions (role, service, type_name, field_name, allow, preset)
+		VALUES ('user', '', 'Query', 'orders(userId)', 1, '"X-Kastql-User-Id"'),
+		       ('user', '', 'Query', '', 0, '')
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewChecker(store)
+	ctx := SetClaims(context.Background(), map[string]any{"sub": "u-42"})
+
+	_, _, preset, found, err := c.InputRule(ctx, "user", "", "Query", "orders(userId)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || preset != "u-42" {
+		t.Errorf("expected preset u-42 from the sub claim, got %v (found=%v)", preset, found)
+	}
+
+	// Type-wide rules govern fields, not their arguments.
+	_, _, _, found, err = c.InputRule(ctx, "user", "", "Query", "orders(status)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected no rule for an argument without its own rule")
+	}
+
+	if _, _, _, _, err = c.InputRule(context.Background(), "user", "", "Query", "orders(userId)"); err == nil {
+		t.Error("expected an error when the preset's claim is missing")
+	}
+}
+
+func TestCheckerReload(t *testing.T) {
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	c := NewChecker(store)
+	if ok, _ := c.CanAccess(context.Background(), "public", "", "User", "email"); !ok {
+		t.Fatal("expected public to be allowed with no rules")
+	}
+
+	if err := store.UpsertPermission(&metadata.Permission{
+		Role: "public", TypeName: "User", FieldName: "email", Allow: false, Condition: "{}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.CanAccess(context.Background(), "public", "", "User", "email"); !ok {
+		t.Error("expected the cached index to be used until Reload")
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.CanAccess(context.Background(), "public", "", "User", "email"); ok {
+		t.Error("expected the new deny rule after Reload")
+	}
+}
+
+func TestCheckerServiceScope(t *testing.T) {
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, err = store.DB().Exec(`
+		INSERT INTO permissions (role, service, type_name, field_name, allow) VALUES
+			('user', '',          'User', '',      1),
+			('user', 'users-svc', 'User', 'email', 0),
+			('user', 'legacy',    '',     '',      0)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChecker(store)
+
+	for _, tc := range []struct {
+		service, field string
+		want           bool
+	}{
+		{"users-svc", "name", true},
+		{"users-svc", "email", false},
+		{"orders-svc", "email", true}, // the deny is scoped to users-svc
+		{"legacy", "name", false},     // the whole service is denied
+	} {
+		ok, err := c.CanAccess(context.Background(), "user", tc.service, "User", tc.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.want {
+			t.Errorf("%s User.%s: got %v, want %v", tc.service, tc.field, ok, tc.want)
+		}
+	}
+}
+
+func TestCheckerPartialDeny(t *testing.T) {
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.UpsertRole(&metadata.Role{Name: "partner", PartialDeny: true}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewChecker(store)
+	if on, err := c.PartialDeny("partner"); err != nil || !on {
+		t.Errorf("partner: got %v, %v; want partial denial", on, err)
+	}
+	if on, _ := c.PartialDeny("public"); on {
+		t.Error("expected roles without settings to fail on denied fields")
+	}
+}
+
+func TestCheckerInheritanceAndPatterns(t *testing.T) {
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, err = store.DB().Exec(`
+		INSERT INTO permissions (role, service, type_name, field_name, allow) VALUES
+			('viewer', '', 'User',  '*',             1),
+			('viewer', '', '*',     'internalNotes', 0),
+			('viewer', '', 'Order', 'internal*',     0),
+			('viewer', '', 'Note',  'internalNotes', 1),
+			('editor', '', 'User',  'internalNotes', 1),
+			('guest',  '', '*',     'internalNotes', 0)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*metadata.Role{
+		{Name: "viewer", Inherits: "[]", DefaultPolicy: "deny"},
+		{Name: "editor", Inherits: `["viewer"]`},
+		{Name: "guest", Inherits: "[]", DefaultPolicy: "allow"},
+	} {
+		if err := store.UpsertRole(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewChecker(store)
+
+	for _, tc := range []struct {
+		role, typeName, field string
+		want                  bool
+	}{
+		{"viewer", "User", "name", true},
+		{"viewer", "User", "internalNotes", false}, // User.* doesn't reopen the field deny
+		{"viewer", "Tag", "internalNotes", false},  // field-only rule
+		{"viewer", "Note", "internalNotes", true},  // an exact grant does
+		{"viewer", "Order", "internalRef", false},  // pattern
+		{"viewer", "Order", "total", false},        // default policy
+		{"editor", "User", "internalNotes", true},  // own rule beats inherited
+		{"editor", "User", "name", true},           // inherited
+		{"editor", "Order", "total", false},        // inherited default policy
+		{"guest", "Order", "total", true},
+		{"guest", "Order", "internalNotes", false},
+	} {
+		ok, err := c.CanAccess(context.Background(), tc.role, "", tc.typeName, tc.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.want {
+			t.Errorf("%s %s.%s: got %v, want %v", tc.role, tc.typeName, tc.field, ok, tc.want)
+		}
+	}
+
+	d, err := c.Explain(context.Background(), "editor", "", "User", "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || d.Rule == nil || d.Rule.Role != "viewer" || d.Rule.FieldName != "*" {
+		t.Errorf("expected the inherited User.* rule to decide, got %+v", d)
+	}
+	if d, _ := c.Explain(context.Background(), "editor", "", "Order", "total"); d.Rule != nil || !strings.Contains(d.Reason, `default policy of role "viewer"`) {
+		t.Errorf("expected viewer's default policy to decide, got %+v", d)
+	}
+}
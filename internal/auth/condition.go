@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// sessionVarPrefix marks condition values that are read from the caller's
+// JWT claims, e.g. "X-Kastql-User-Id".
+const sessionVarPrefix = "x-kastql-"
+
+// Condition returns the row-level condition attached to the rule that grants
+// role access to typeName.fieldName in service, with session variables replaced by the
+// caller's claims. It returns nil when the rule has no condition or access is
+// not granted by a rule at all.
+//
+// A session variable is a string value starting with "X-Kastql-". It is
+// looked up in the claims by its lower-cased name, then by the rest of the
+// name in snake case ("X-Kastql-User-Id" → "user_id"); "X-Kastql-User-Id"
+// finally falls back to "sub" and "X-Kastql-Role" resolves to the role. A
+// variable that cannot be resolved is an error, so the request is refused
+// rather than run unfiltered.
+func (c *Checker) Condition(ctx context.Context, role, service, typeName, fieldName string) (map[string]any, error) {
+	if role == "" {
+		role = "public"
+	}
+	rule, err := c.rule(role, service, typeName, fieldName)
+	if err != nil || rule == nil || !rule.allow || len(rule.condition) == 0 {
+		return nil, err
+	}
+	resolved, err := resolveSessionVars(rule.condition, role, GetClaims(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("condition for %s.%s: %w", typeName, fieldName, err)
+	}
+	return resolved.(map[string]any), nil
+}
+
+func resolveSessionVars(v any, role string, claims map[string]any) (any, error) {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, child := range t {
+			r, err := resolveSessionVars(child, role, claims)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(t))
+		for i, child := range t {
+			r, err := resolveSessionVars(child, role, claims)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case string:
+		if !strings.HasPrefix(strings.ToLower(t), sessionVarPrefix) {
+			return t, nil
+		}
+		val, ok := sessionVar(t, role, claims)
+		if !ok {
+			return nil, fmt.Errorf("session variable %q is not set", t)
+		}
+		return val, nil
+	}
+	return v, nil
+}
+
+func sessionVar(name, role string, claims map[string]any) (any, bool) {
+	lower := strings.ToLower(name)
+	if lower == sessionVarPrefix+"role" {
+		return role, true
+	}
+	if v, ok := claims[lower]; ok && v != nil {
+		return v, true
+	}
+	short := strings.ReplaceAll(strings.TrimPrefix(lower, sessionVarPrefix), "-", "_")
+	if v, ok := claims[short]; ok && v != nil {
+		return v, true
+	}
+	if short == "user_id" {
+		if v, ok := claims["sub"]; ok && v != nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// InputRule returns the rule restricting an argument or input object field.
+// Arguments are named "field(arg)" on the type declaring the field; input
+// fields are plain field names on their input type, where a type-wide rule
+// also applies. A rule scoped to service beats one for every service, and
+// the role's own rules beat inherited ones.
+// Unlike CanAccess there is no default: found is false when no rule exists,
+// and the input is then governed by access to the field alone.
+//
+// condition tests the value the client passes (e.g. {"_neq": true}) and
+// preset is a value forced in place of the client's; session variables in
+// both are resolved from the claims. preset is nil when the rule has none.
+func (c *Checker) InputRule(ctx context.Context, role, service, typeName, fieldName string) (allow bool, condition map[string]any, preset any, found bool, err error) {
+	if role == "" {
+		role = "public"
+	}
+	idx, err := c.rules()
+	if err != nil {
+		return false, nil, nil, false, err
+	}
+	var rule *compiledRule
+	if rr := idx.roles[role]; rr != nil {
+	chain:
+		for _, r := range rr.chain {
+			for _, svc := range [...]string{service, ""} {
+				if rule = r.exact[ruleKey{svc, typeName, fieldName}]; rule != nil {
+					break chain
+				}
+				if !strings.Contains(fieldName, "(") {
+					if rule = r.exact[ruleKey{svc, typeName, ""}]; rule != nil {
+						break chain
+					}
+				}
+			}
+		}
+	}
+	if rule == nil {
+		return false, nil, nil, false, nil
+	}
+
+	claims := GetClaims(ctx)
+	if len(rule.condition) > 0 {
+		resolved, err := resolveSessionVars(rule.condition, role, claims)
+		if err != nil {
+			return false, nil, nil, false, fmt.Errorf("condition for %s.%s: %w", typeName, fieldName, err)
+		}
+		condition = resolved.(map[string]any)
+	}
+	if rule.preset != nil {
+		if preset, err = resolveSessionVars(rule.preset, role, claims); err != nil {
+			return false, nil, nil, false, fmt.Errorf("preset for %s.%s: %w", typeName, fieldName, err)
+		}
+	}
+	return rule.allow, condition, preset, true, nil
+}
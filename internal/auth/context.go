@@ -5,8 +5,9 @@ import "context"
 type contextKey string
 
 const (
-	roleKey   contextKey = "kastql_role"
-	claimsKey contextKey = "kastql_claims"
+	roleKey     contextKey = "kastql_role"
+	claimsKey   contextKey = "kastql_claims"
+	contractKey contextKey = "kastql_contract"
 )
 
 // SetRole stores the resolved role in the context.
@@ -30,3 +31,14 @@ func GetClaims(ctx context.Context) map[string]any {
 	v, _ := ctx.Value(claimsKey).(map[string]any)
 	return v
 }
+
+// SetContract stores the schema contract bound to the caller's router key.
+func SetContract(ctx context.Context, contract string) context.Context {
+	return context.WithValue(ctx, contractKey, contract)
+}
+
+// GetContract returns the contract stored by SetContract, or "" if none.
+func GetContract(ctx context.Context) string {
+	v, _ := ctx.Value(contractKey).(string)
+	return v
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/deformal/kastql/internal/metadata"
+)
+
+// Decision explains how a role's access to a field was settled.
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the permission row that decided, which may belong to a role
+	// the caller's role inherits from. It is nil when no rule matched.
+	Rule *metadata.Permission `json:"rule,omitempty"`
+	// Reason describes the decision in words.
+	Reason string `json:"reason"`
+}
+
+// Explain reports whether role may access typeName.fieldName in service, as
+// CanAccess does, along with what decided it.
+func (c *Checker) Explain(_ context.Context, role, service, typeName, fieldName string) (*Decision, error) {
+	if role == "" {
+		role = "public"
+	}
+	d, err := c.decide(role, service, typeName, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	out := &Decision{Allowed: d.allow}
+	verb := "denied"
+	if d.allow {
+		verb = "allowed"
+	}
+	switch {
+	case d.meta:
+		out.Reason = "introspection fields are always allowed"
+	case d.rule != nil:
+		out.Rule = d.rule.perm
+		p := d.rule.perm
+		out.Reason = fmt.Sprintf("%s by rule %s.%s", verb, orAny(p.TypeName), orAny(p.FieldName))
+		if p.Service != "" {
+			out.Reason += fmt.Sprintf(" on service %q", p.Service)
+		}
+		if p.Role != role {
+			out.Reason += fmt.Sprintf(" inherited from role %q", p.Role)
+		}
+	case d.policyRole != "":
+		out.Reason = fmt.Sprintf("%s by the default policy of role %q", verb, d.policyRole)
+	default:
+		out.Reason = fmt.Sprintf("%s by default: no rule matched and only public is allowed without one", verb)
+	}
+	return out, nil
+}
+
+func orAny(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return name
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Errors from JWKS.Key, told apart so rejected tokens are counted by cause.
+var (
+	errUnknownKey      = errors.New("unknown signing key")
+	errKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+// DefaultJWKSRefresh is how long a fetched key set is used before it is
+// fetched again.
+const DefaultJWKSRefresh = 10 * time.Minute
+
+// JWKS is the key set published at a JWKS URL. Keys are fetched on first
+// use, again once the set is older than the refresh interval, and early when
+// a token names a kid the set lacks — which is how a rotated key is picked
+// up. Fetches start at most every minInterval, whatever their reason, so
+// neither unknown kids nor a failing identity provider turn every request
+// into a fetch. A stale set keeps serving the keys it has while it is
+// refreshed in the background, and a failed fetch keeps them too; only a
+// token whose kid is unknown waits for the fetch. No lock is held during
+// the HTTP call.
+type JWKS struct {
+	url         string
+	refresh     time.Duration
+	minInterval time.Duration
+	client      *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]jwk
+	fetched   time.Time     // last successful fetch
+	attempted time.Time     // last fetch, successful or not
+	lastErr   error         // error of the last fetch; nil after a success
+	inflight  chan struct{} // closed when the running fetch ends; nil when none
+}
+
+type jwk struct {
+	alg string // "" when the set does not say
+	key any
+}
+
+// NewJWKS returns the key set at url, refreshed every refresh
+// (DefaultJWKSRefresh when zero).
+func NewJWKS(url string, refresh time.Duration) *JWKS {
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	return &JWKS{
+		url:         url,
+		refresh:     refresh,
+		minInterval: 10 * time.Second,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key with the given kid and its algorithm. An empty
+// kid matches the set's only key.
+func (j *JWKS) Key(kid string) (any, string, error) {
+	j.mu.Lock()
+	now := time.Now()
+	due := now.Sub(j.attempted) >= j.minInterval
+	if k, ok := j.lookup(kid); ok {
+		if due && now.Sub(j.fetched) >= j.refresh {
+			j.startFetchLocked(now)
+		}
+		j.mu.Unlock()
+		return k.key, k.alg, nil
+	}
+	wait := j.inflight
+	if wait == nil && due {
+		wait = j.startFetchLocked(now)
+	}
+	j.mu.Unlock()
+
+	if wait != nil {
+		<-wait
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if k, ok := j.lookup(kid); ok {
+		return k.key, k.alg, nil
+	}
+	if j.keys == nil && j.lastErr != nil {
+		return nil, "", fmt.Errorf("%w: %w", errKeysUnavailable, j.lastErr)
+	}
+	return nil, "", fmt.Errorf("%w: no key %q in JWKS %s", errUnknownKey, kid, j.url)
+}
+
+// startFetchLocked fetches the key set in the background and returns a
+// channel closed once the new keys, or the error, are recorded.
+func (j *JWKS) startFetchLocked(now time.Time) chan struct{} {
+	if j.inflight != nil {
+		return j.inflight
+	}
+	j.attempted = now
+	done := make(chan struct{})
+	j.inflight = done
+	go func() {
+		keys, err := j.fetch()
+		j.mu.Lock()
+		if err == nil {
+			j.keys, j.fetched = keys, time.Now()
+		}
+		j.lastErr = err
+		j.inflight = nil
+		j.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func (j *JWKS) lookup(kid string) (jwk, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k, true
+		}
+	}
+	k, ok := j.keys[kid]
+	return k, ok
+}
+
+func (j *JWKS) fetch() (map[string]jwk, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS: %s returned %d", j.url, resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := make(map[string]jwk, len(doc.Keys))
+	for _, raw := range doc.Keys {
+		if use := jwkField(raw, "use"); use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(raw)
+		if err != nil {
+			// Skip keys of types we cannot use rather than the whole set.
+			continue
+		}
+		keys[jwkField(raw, "kid")] = jwk{alg: jwkField(raw, "alg"), key: key}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func jwkField(raw map[string]any, name string) string {
+	s, _ := raw[name].(string)
+	return s
+}
+
+// parseJWK decodes an RSA, EC (P-256/384/521) or OKP (Ed25519) public key.
+func parseJWK(raw map[string]any) (any, error) {
+	kty, kid, crv := jwkField(raw, "kty"), jwkField(raw, "kid"), jwkField(raw, "crv")
+	b64 := func(name string) ([]byte, error) {
+		v, err := base64.RawURLEncoding.DecodeString(jwkField(raw, name))
+		if err != nil || len(v) == 0 {
+			return nil, fmt.Errorf("JWK %s: invalid %q", kid, name)
+		}
+		return v, nil
+	}
+	switch kty {
+	case "RSA":
+		n, err := b64("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("JWK %s: unsupported curve %q", kid, crv)
+		}
+		x, err := b64("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64("y")
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if crv != "Ed25519" {
+			return nil, fmt.Errorf("JWK %s: unsupported curve %q", kid, crv)
+		}
+		x, err := b64("x")
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("JWK %s: invalid Ed25519 key", kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("JWK %s: unsupported key type %q", kid, kty)
+}
@@ -9,28 +9,26 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// ParseBearer validates the "Authorization: Bearer <token>" header value and
-// returns the role extracted from the configured claim.
+var errBearerFormat = errors.New("authorization header must be 'Bearer <token>'")
+
+// ParseBearer validates the "Authorization: Bearer <token>" header value
+// against key and v and returns the role extracted from the configured
+// claim. Requirements set on key override those in v. The claims returned
+// have v's claims namespace applied.
 // Returns ("", nil) when the header is empty (unauthenticated is OK — caller
 // falls back to the default role).
-func ParseBearer(authHeader, secret, roleClaim string) (role string, claims map[string]any, err error) {
+func ParseBearer(authHeader string, key *Key, v Validation, roleClaim string) (role string, claims map[string]any, err error) {
 	if authHeader == "" {
 		return "", nil, nil
 	}
 
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
-		return "", nil, errors.New("authorization header must be 'Bearer <token>'")
+		return "", nil, errBearerFormat
 	}
 
-	token, parseErr := jwt.Parse(parts[1], func(t *jwt.Token) (any, error) {
-		switch t.Method.(type) {
-		case *jwt.SigningMethodHMAC:
-			return []byte(secret), nil
-		default:
-			return nil, fmt.Errorf("unsupported signing method: %v", t.Header["alg"])
-		}
-	})
+	v = v.Override(key.Validation)
+	token, parseErr := jwt.Parse(parts[1], key.keyfunc, v.parserOptions()...)
 	if parseErr != nil {
 		return "", nil, fmt.Errorf("invalid JWT: %w", parseErr)
 	}
@@ -43,9 +41,12 @@ func ParseBearer(authHeader, secret, roleClaim string) (role string, claims map[
 	// Convert to plain map for context storage.
 	raw := make(map[string]any, len(mapClaims))
 	maps.Copy(raw, map[string]any(mapClaims))
+	if raw, err = v.claims(raw); err != nil {
+		return "", nil, fmt.Errorf("invalid JWT: %w", err)
+	}
 
 	if roleClaim != "" {
-		if r, ok := mapClaims[roleClaim].(string); ok {
+		if r, ok := raw[roleClaim].(string); ok {
 			return r, raw, nil
 		}
 	}
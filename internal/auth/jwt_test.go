@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + s
+}
+
+func publicPEM(t *testing.T, pub any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestParseBearerPEMKeys(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for _, tc := range []struct {
+		alg    string
+		method jwt.SigningMethod
+		priv   any
+		pub    any
+	}{
+		{"ES256", jwt.SigningMethodES256, ecKey, &ecKey.PublicKey},
+		{"EdDSA", jwt.SigningMethodEdDSA, edPriv, edPub},
+		{"RS384", jwt.SigningMethodRS384, rsaKey, &rsaKey.PublicKey},
+	} {
+		pemKey := publicPEM(t, tc.pub)
+		key, err := NewKey("idp", tc.alg, pemKey, "")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.alg, err)
+		}
+		header := signToken(t, tc.method, tc.priv, "", jwt.MapClaims{"x-kastql-role": "user"})
+		role, _, err := ParseBearer(header, key, Validation{}, "x-kastql-role")
+		if err != nil || role != "user" {
+			t.Errorf("%s: got role %q, err %v", tc.alg, role, err)
+		}
+
+		// The public key must not double as an HMAC secret.
+		forged := signToken(t, jwt.SigningMethodHS256, []byte(pemKey), "", jwt.MapClaims{"x-kastql-role": "admin"})
+		if _, _, err := ParseBearer(forged, key, Validation{}, "x-kastql-role"); err == nil {
+			t.Errorf("%s: expected an HS256 token to be refused", tc.alg)
+		}
+	}
+}
+
+func TestParseBearerHMACFamily(t *testing.T) {
+	secret := []byte("shared-secret")
+	stored, err := NewKey("legacy", "", string(secret), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*Key{HMACKey(string(secret)), stored} {
+		for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS256, jwt.SigningMethodHS384, jwt.SigningMethodHS512} {
+			header := signToken(t, method, secret, "", jwt.MapClaims{"x-kastql-role": "user"})
+			if role, _, err := ParseBearer(header, key, Validation{}, "x-kastql-role"); err != nil || role != "user" {
+				t.Errorf("%s: got role %q, err %v", method.Alg(), role, err)
+			}
+		}
+	}
+}
+
+func TestParseBearerJWKSRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var mu sync.Mutex
+	published := map[string]*rsa.PrivateKey{"k1": oldKey}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		var keys []map[string]string
+		for kid, k := range published {
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer srv.Close()
+
+	key, err := NewKey("idp", "", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.jwks.minInterval = 0
+
+	claims := jwt.MapClaims{"x-kastql-role": "user"}
+	if _, _, err := ParseBearer(signToken(t, jwt.SigningMethodRS256, oldKey, "k1", claims), key, Validation{}, "x-kastql-role"); err != nil {
+		t.Fatalf("k1: %v", err)
+	}
+	if _, _, err := ParseBearer(signToken(t, jwt.SigningMethodRS256, oldKey, "k1", claims), key, Validation{}, "x-kastql-role"); err != nil {
+		t.Fatalf("k1 again: %v", err)
+	}
+	mu.Lock()
+	if fetches != 1 {
+		t.Errorf("expected the key set to be fetched once, got %d", fetches)
+	}
+
+	// The provider rotates to k2; the first token naming it triggers a refetch.
+	published = map[string]*rsa.PrivateKey{"k2": newKey}
+	mu.Unlock()
+	if _, _, err := ParseBearer(signToken(t, jwt.SigningMethodRS256, newKey, "k2", claims), key, Validation{}, "x-kastql-role"); err != nil {
+		t.Fatalf("k2 after rotation: %v", err)
+	}
+	if _, _, err := ParseBearer(signToken(t, jwt.SigningMethodRS256, oldKey, "k1", claims), key, Validation{}, "x-kastql-role"); FailureReason(err) != ReasonUnknownKey {
+		t.Errorf("expected the retired k1 to be refused as an unknown key, got %v", err)
+	}
+	if _, _, err := ParseBearer(signToken(t, jwt.SigningMethodRS256, oldKey, "k2", claims), key, Validation{}, "x-kastql-role"); err == nil {
+		t.Error("expected a token signed by the wrong key to be refused")
+	}
+}
+
+func TestParseBearerJWKSUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	key, err := NewKey("idp", "", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, _, err = ParseBearer(signToken(t, jwt.SigningMethodRS256, rsaKey, "k1", jwt.MapClaims{}), key, Validation{}, "x-kastql-role")
+	if FailureReason(err) != ReasonKeyUnavailable {
+		t.Errorf("expected %s, got %v", ReasonKeyUnavailable, err)
+	}
+}
+
+func TestJWKSStaleRefresh(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mu sync.Mutex
+	fetches, failing := 0, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if failing {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+
+	j := NewJWKS(srv.URL, time.Nanosecond) // always stale
+	j.minInterval = 0
+	if _, _, err := j.Key("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider goes down: the stale set keeps serving while one
+	// background refresh fails, and no request waits for it.
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if _, _, err := j.Key("k1"); err != nil {
+		t.Fatalf("stale key: %v", err)
+	}
+	j.mu.Lock()
+	wait := j.inflight
+	j.minInterval = time.Hour
+	j.mu.Unlock()
+	if wait != nil {
+		<-wait
+	}
+	for range 5 {
+		if _, _, err := j.Key("k1"); err != nil {
+			t.Fatalf("after failed refresh: %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+}
+
+func TestParseBearerValidation(t *testing.T) {
+	secret := []byte("s3cret")
+	sign := func(claims jwt.MapClaims) string {
+		return signToken(t, jwt.SigningMethodHS256, secret, "", claims)
+	}
+	key := HMACKey(string(secret))
+	v := Validation{
+		Issuer:          "https://idp.example.com/",
+		Audience:        []string{"kastql", "api"},
+		Leeway:          30 * time.Second,
+		RequiredClaims:  []string{"sub"},
+		ClaimsNamespace: `$["https://kastql.io/claims"]`,
+	}
+	good := jwt.MapClaims{
+		"iss": "https://idp.example.com/",
+		"aud": []string{"api"},
+		"exp": time.Now().Add(-10 * time.Second).Unix(), // expired, within leeway
+		"https://kastql.io/claims": map[string]any{
+			"x-kastql-role": "editor",
+			"sub":           "u1",
+		},
+	}
+	role, claims, err := ParseBearer(sign(good), key, v, "x-kastql-role")
+	if err != nil || role != "editor" {
+		t.Fatalf("got role %q, err %v", role, err)
+	}
+	if claims["iss"] != "https://idp.example.com/" {
+		t.Errorf("expected top-level claims to be kept, got %v", claims)
+	}
+
+	with := func(name string, val any) jwt.MapClaims {
+		c := jwt.MapClaims{}
+		for k, x := range good {
+			c[k] = x
+		}
+		if val == nil {
+			delete(c, name)
+		} else {
+			c[name] = val
+		}
+		return c
+	}
+	for name, c := range map[string]jwt.MapClaims{
+		"wrong issuer":      with("iss", "https://evil.example.com/"),
+		"wrong audience":    with("aud", "other"),
+		"expired":           with("exp", time.Now().Add(-time.Minute).Unix()),
+		"missing namespace": with("https://kastql.io/claims", nil),
+		"missing sub":       with("https://kastql.io/claims", map[string]any{"x-kastql-role": "editor"}),
+		"issued later":      with("iat", time.Now().Add(2*time.Minute).Unix()),
+	} {
+		if _, _, err := ParseBearer(sign(c), key, v, "x-kastql-role"); err == nil {
+			t.Errorf("%s: expected the token to be refused", name)
+		}
+	}
+
+	if _, _, err := ParseBearer(sign(with("iat", time.Now().Add(10*time.Second).Unix())), key, v, "x-kastql-role"); err != nil {
+		t.Errorf("iat within leeway: %v", err)
+	}
+
+	// The namespace can't replace registered claims set at the top level.
+	_, claims, err = ParseBearer(sign(with("https://kastql.io/claims", map[string]any{
+		"x-kastql-role": "editor", "sub": "u1", "iss": "https://evil.example.com/",
+	})), key, v, "x-kastql-role")
+	if err != nil || claims["iss"] != "https://idp.example.com/" || claims["sub"] != "u1" {
+		t.Errorf("expected top-level iss kept and namespaced sub added, got %v, %v", claims, err)
+	}
+
+	// A key's own requirements override the configured ones.
+	key.Validation = Validation{Issuer: "https://evil.example.com/"}
+	if _, _, err := ParseBearer(sign(with("iss", "https://evil.example.com/")), key, v, "x-kastql-role"); err != nil {
+		t.Errorf("key issuer override: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/deformal/kastql/internal/metadata"
+)
+
+// Key verifies JWT signatures for one configured secret: an HMAC secret, a
+// PEM public key for the asymmetric algorithms, or the keys published at a
+// JWKS URL.
+type Key struct {
+	Name       string
+	Algorithm  string     // "" for JWKS keys, which carry their own
+	Validation Validation // requirements specific to this key
+
+	material any   // []byte or a public key
+	jwks     *JWKS // set for JWKS keys
+}
+
+// NewKey builds a Key from a jwt_secrets row. secret is ignored when
+// jwksURL is set.
+func NewKey(name, algorithm, secret, jwksURL string) (*Key, error) {
+	if jwksURL != "" {
+		return &Key{Name: name, jwks: NewJWKS(jwksURL, 0)}, nil
+	}
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+	if jwt.GetSigningMethod(algorithm) == nil {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	k := &Key{Name: name, Algorithm: algorithm}
+	var err error
+	switch {
+	case strings.HasPrefix(algorithm, "HS"):
+		k.material = []byte(secret)
+	case strings.HasPrefix(algorithm, "RS"), strings.HasPrefix(algorithm, "PS"):
+		k.material, err = jwt.ParseRSAPublicKeyFromPEM([]byte(secret))
+	case strings.HasPrefix(algorithm, "ES"):
+		k.material, err = jwt.ParseECPublicKeyFromPEM([]byte(secret))
+	case algorithm == "EdDSA":
+		k.material, err = jwt.ParseEdPublicKeyFromPEM([]byte(secret))
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %s: %w", name, err)
+	}
+	return k, nil
+}
+
+// HMACKey returns a Key for a plain HMAC secret. Like every HMAC key it
+// accepts HS256, HS384 and HS512 tokens.
+func HMACKey(secret string) *Key {
+	return &Key{Algorithm: "HS256", material: []byte(secret)}
+}
+
+// keyfunc returns the verification key for a parsed token, refusing tokens
+// signed with any algorithm other than the key's. HMAC keys accept the whole
+// HMAC family, as secrets always have: the secret is the same whichever hash
+// signs with it, and no other family can verify against it.
+func (k *Key) keyfunc(t *jwt.Token) (any, error) {
+	if k.jwks != nil {
+		kid, _ := t.Header["kid"].(string)
+		key, alg, err := k.jwks.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		if alg != "" && alg != t.Method.Alg() {
+			return nil, fmt.Errorf("token algorithm %s does not match key %q (%s)", t.Method.Alg(), kid, alg)
+		}
+		if _, hmac := t.Method.(*jwt.SigningMethodHMAC); hmac {
+			return nil, fmt.Errorf("unsupported signing method: %v", t.Header["alg"])
+		}
+		return key, nil
+	}
+	if _, secret := k.material.([]byte); secret {
+		if _, hmac := t.Method.(*jwt.SigningMethodHMAC); !hmac {
+			return nil, fmt.Errorf("unsupported signing method: %v", t.Header["alg"])
+		}
+		return k.material, nil
+	}
+	if t.Method.Alg() != k.Algorithm {
+		return nil, fmt.Errorf("unsupported signing method: %v", t.Header["alg"])
+	}
+	return k.material, nil
+}
+
+// keyCache keeps Keys across requests so PEM keys are parsed once and JWKS
+// keys keep their fetched key sets. Entries are dropped once their row is.
+type keyCache struct {
+	mu   sync.Mutex
+	byID map[string]*Key // nil = the row's key cannot be built
+}
+
+// keys returns a Key per row, building those not seen before. Rows whose key
+// cannot be built are skipped; their errors are returned the first time.
+func (c *keyCache) keys(rows []*metadata.JWTKey) ([]*Key, []error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := make(map[string]*Key, len(rows))
+	out := make([]*Key, 0, len(rows))
+	var errs []error
+	for _, r := range rows {
+		id := strings.Join([]string{r.Name, r.Algorithm, r.Secret, r.JWKSURL,
+			r.Issuer, r.Audience, strconv.Itoa(r.LeewaySeconds), r.RequiredClaims, r.ClaimsNamespace}, "\x00")
+		k, seen := c.byID[id]
+		if !seen {
+			var err error
+			if k, err = rowKey(r); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		next[id] = k
+		if k != nil {
+			out = append(out, k)
+		}
+	}
+	c.byID = next
+	return out, errs
+}
+
+func rowKey(r *metadata.JWTKey) (*Key, error) {
+	v, err := ValidationFromRow(r.JWTValidation)
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %s: %w", r.Name, err)
+	}
+	k, err := NewKey(r.Name, r.Algorithm, r.Secret, r.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	k.Validation = v
+	return k, nil
+}
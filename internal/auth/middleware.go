@@ -2,24 +2,42 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"slices"
 
 	"go.uber.org/zap"
 
 	"github.com/deformal/kastql/internal/config"
+	"github.com/deformal/kastql/internal/metadata"
+	"github.com/deformal/kastql/internal/metrics"
+	"github.com/deformal/kastql/internal/security"
 )
 
 // Middleware validates JWT tokens and populates the role in the request context.
 type Middleware struct {
 	cfg           config.AuthConfig
 	secretsLoader func() []string // if set, DB-backed secrets take precedence over cfg.JWTSecret
+	keysLoader    func() []*metadata.JWTKey
+	keys          keyCache
+	cfgJWKS       *Key       // from cfg.JWKSURL
+	validation    Validation // from cfg; keys may override parts of it
+	metrics       *metrics.Store
+	secMgr        *security.Manager
+	webhook       *Webhook // set in webhook mode
 	log           *zap.Logger
 }
 
 // New creates an auth Middleware from the given config.
 func New(cfg config.AuthConfig, log *zap.Logger) *Middleware {
-	return &Middleware{cfg: cfg, log: log}
+	m := &Middleware{cfg: cfg, log: log, validation: ValidationFromConfig(cfg)}
+	if cfg.JWKSURL != "" {
+		m.cfgJWKS = &Key{Name: "config", jwks: NewJWKS(cfg.JWKSURL, cfg.JWKSRefresh)}
+	}
+	if cfg.Mode == "webhook" {
+		m.webhook = NewWebhook(cfg.Webhook)
+	}
+	return m
 }
 
 // SetSecretsLoader wires a function that returns active JWT secrets from the DB.
@@ -29,32 +47,79 @@ func (m *Middleware) SetSecretsLoader(fn func() []string) {
 	m.secretsLoader = fn
 }
 
-// Handler returns a chi-compatible middleware function.
+// SetKeysLoader wires a function that returns the active JWT keys from the
+// DB, such as metadata.Store.ActiveJWTKeys. Unlike SetSecretsLoader it
+// supports every algorithm and JWKS URLs, and it takes precedence over it.
+// Keys are built once per row and kept while the row stays active, so JWKS
+// key sets are not refetched per request.
+func (m *Middleware) SetKeysLoader(fn func() []*metadata.JWTKey) {
+	m.keysLoader = fn
+}
+
+// SetMetrics wires the store that counts rejected tokens per reason.
+func (m *Middleware) SetMetrics(s *metrics.Store) {
+	m.metrics = s
+}
+
+// SetSecurityManager wires the manager whose blocked-requests log records
+// the requests strict mode rejects.
+func (m *Middleware) SetSecurityManager(mgr *security.Manager) {
+	m.secMgr = mgr
+}
+
+// Handler returns a chi-compatible middleware function. In strict mode a
+// request carrying a token that fails validation is answered with 401;
+// otherwise it proceeds with the default role. In webhook mode requests the
+// webhook refuses are always answered with 401, and those it fails to answer
+// only when the webhook is configured to fail closed.
 func (m *Middleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		role, ctx := m.resolveRole(r)
+		role, ctx, failure := m.resolveRole(r)
+		if failure != "" {
+			if m.metrics != nil {
+				m.metrics.RecordAuthFailure(failure)
+			}
+			if m.rejects(failure) {
+				if m.secMgr != nil {
+					logged := failure
+					if m.webhook == nil {
+						logged = "jwt_" + failure
+					}
+					m.secMgr.LogBlocked(logged, security.ClientIP(r), r.URL.Path)
+				}
+				writeUnauthenticated(w, failure)
+				return
+			}
+		}
 		ctx = SetRole(ctx, role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // resolveRole determines the effective role and returns the (possibly enriched)
-// context alongside it. Precedence:
+// context alongside it, and the reason a present token was rejected, if it
+// was. Precedence:
 //  1. Valid JWT → role from configured claim
 //  2. X-Kastql-Role header → trusted only in dev mode (no secrets configured)
 //     or when the role is in the JWT's allowed_roles claim
 //  3. Default role from config
-func (m *Middleware) resolveRole(r *http.Request) (role string, ctx context.Context) {
+func (m *Middleware) resolveRole(r *http.Request) (role string, ctx context.Context, failure string) {
+	if m.webhook != nil {
+		return m.resolveWebhookRole(r)
+	}
 	ctx = r.Context()
 	authHeader := r.Header.Get(m.cfg.JWTHeader)
 	headerRole := r.Header.Get("X-Kastql-Role")
 
-	secrets := m.activeSecrets()
+	keys := m.activeKeys()
 
-	for _, secret := range secrets {
-		jwtRole, claims, err := ParseBearer(authHeader, secret, m.cfg.RoleClaim)
+	for _, key := range keys {
+		jwtRole, claims, err := ParseBearer(authHeader, key, m.validation, m.cfg.RoleClaim)
 		if err != nil {
 			m.log.Debug("jwt validation failed", zap.Error(err))
+			if reason := FailureReason(err); failure == "" || reasonRank(reason) > reasonRank(failure) {
+				failure = reason
+			}
 			continue
 		}
 		if claims == nil {
@@ -66,31 +131,83 @@ func (m *Middleware) resolveRole(r *http.Request) (role string, ctx context.Cont
 		ctx = SetClaims(ctx, claims)
 
 		if headerRole != "" && slices.Contains(AllowedRoles(claims), headerRole) {
-			return headerRole, ctx
+			return headerRole, ctx, ""
 		}
 		if jwtRole != "" {
-			return jwtRole, ctx
+			return jwtRole, ctx, ""
 		}
-		return m.cfg.DefaultRole, ctx
+		return m.cfg.DefaultRole, ctx, ""
 	}
 
 	// No valid JWT or no secrets configured.
-	if headerRole != "" && len(secrets) == 0 {
+	if headerRole != "" && len(keys) == 0 {
 		// Dev mode: trust X-Kastql-Role header directly.
-		return headerRole, ctx
+		return headerRole, ctx, ""
+	}
+
+	return m.cfg.DefaultRole, ctx, failure
+}
+
+// resolveWebhookRole resolves the role from the session variables the auth
+// webhook returns, which are stored as the request's claims. X-Kastql-Role
+// may pick any role in their allowed roles.
+func (m *Middleware) resolveWebhookRole(r *http.Request) (role string, ctx context.Context, failure string) {
+	ctx = r.Context()
+	vars, err := m.webhook.Resolve(r)
+	if err != nil {
+		if errors.Is(err, errWebhookDenied) {
+			return m.cfg.DefaultRole, ctx, ReasonWebhookDenied
+		}
+		m.log.Warn("auth webhook failed", zap.Error(err))
+		return m.cfg.DefaultRole, ctx, ReasonWebhookError
+	}
+	ctx = SetClaims(ctx, vars)
+	if headerRole := r.Header.Get("X-Kastql-Role"); headerRole != "" && slices.Contains(AllowedRoles(vars), headerRole) {
+		return headerRole, ctx, ""
+	}
+	if role, ok := vars[m.cfg.RoleClaim].(string); ok && role != "" {
+		return role, ctx, ""
 	}
+	return m.cfg.DefaultRole, ctx, ""
+}
 
-	return m.cfg.DefaultRole, ctx
+// rejects reports whether a request whose credentials failed for reason is
+// answered with 401.
+func (m *Middleware) rejects(reason string) bool {
+	switch reason {
+	case ReasonWebhookDenied:
+		return true
+	case ReasonWebhookError:
+		return m.cfg.Webhook.FailClosed
+	}
+	return m.cfg.StrictJWT
 }
 
-func (m *Middleware) activeSecrets() []string {
+func (m *Middleware) activeKeys() []*Key {
+	if m.keysLoader != nil {
+		keys, errs := m.keys.keys(m.keysLoader())
+		for _, err := range errs {
+			m.log.Warn("unusable jwt key", zap.Error(err))
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
 	if m.secretsLoader != nil {
 		if secrets := m.secretsLoader(); len(secrets) > 0 {
-			return secrets
+			keys := make([]*Key, len(secrets))
+			for i, s := range secrets {
+				keys[i] = HMACKey(s)
+			}
+			return keys
 		}
 	}
+	var keys []*Key
 	if m.cfg.JWTSecret != "" {
-		return []string{m.cfg.JWTSecret}
+		keys = append(keys, HMACKey(m.cfg.JWTSecret))
+	}
+	if m.cfgJWKS != nil {
+		keys = append(keys, m.cfgJWKS)
 	}
-	return nil
+	return keys
 }
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/config"
+)
+
+func TestMiddlewareStrictJWT(t *testing.T) {
+	secret := []byte("s3cret")
+	expired := signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{
+		"x-kastql-role": "user",
+		"exp":           time.Now().Add(-time.Hour).Unix(),
+	})
+	forged := signToken(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"x-kastql-role": "admin"})
+	valid := signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"x-kastql-role": "user"})
+
+	serve := func(strict bool, header string) *httptest.ResponseRecorder {
+		m := New(config.AuthConfig{
+			JWTSecret:   string(secret),
+			JWTHeader:   "Authorization",
+			RoleClaim:   "x-kastql-role",
+			DefaultRole: "public",
+			StrictJWT:   strict,
+		}, zap.NewNop())
+		h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(GetRole(r.Context())))
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(false, expired); rec.Code != http.StatusOK || rec.Body.String() != "public" {
+		t.Errorf("lenient: got %d %q, want the default role", rec.Code, rec.Body.String())
+	}
+	for header, reason := range map[string]string{
+		expired:         ReasonExpired,
+		forged:          ReasonBadSignature,
+		"Bearer abc.de": ReasonMalformed,
+		"Basic abc":     ReasonMalformed,
+	} {
+		rec := serve(true, header)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("strict %s: got %d, want 401", reason, rec.Code)
+			continue
+		}
+		var body struct {
+			Errors []struct {
+				Extensions map[string]string `json:"extensions"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(rec.Body).Decode(&body)
+		if len(body.Errors) != 1 || body.Errors[0].Extensions["reason"] != reason {
+			t.Errorf("strict %s: got body %+v", reason, body)
+		}
+	}
+	if rec := serve(true, valid); rec.Code != http.StatusOK || rec.Body.String() != "user" {
+		t.Errorf("strict valid: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := serve(true, ""); rec.Code != http.StatusOK || rec.Body.String() != "public" {
+		t.Errorf("strict anonymous: got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Reasons a request's credentials are rejected, as counted in metrics and
+// logged to the blocked-requests log, the token reasons with a "jwt_" prefix.
+const (
+	ReasonExpired        = "expired"
+	ReasonBadSignature   = "bad_signature"
+	ReasonMalformed      = "malformed"
+	ReasonInvalidClaims  = "invalid_claims"  // iss, aud, nbf, required claims or claims namespace
+	ReasonUnknownKey     = "unknown_key"     // the token's kid is not in the JWKS
+	ReasonKeyUnavailable = "key_unavailable" // the JWKS could not be fetched
+
+	ReasonWebhookDenied = "webhook_denied" // the auth webhook answered 401
+	ReasonWebhookError  = "webhook_error"  // the auth webhook failed or timed out
+)
+
+// FailureReason classifies an error returned by ParseBearer.
+func FailureReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ReasonExpired
+	case errors.Is(err, errUnknownKey):
+		return ReasonUnknownKey
+	case errors.Is(err, errKeysUnavailable):
+		return ReasonKeyUnavailable
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ReasonBadSignature
+	case errors.Is(err, errBearerFormat), errors.Is(err, jwt.ErrTokenMalformed):
+		return ReasonMalformed
+	}
+	return ReasonInvalidClaims
+}
+
+// reasonRank orders reasons by how far validation got, so that when a token
+// fails against every key the most telling failure is reported: claims are
+// only checked once a key has verified the signature, and a JWKS that lacks
+// the token's key or can't be fetched says more than another key's mismatch.
+func reasonRank(reason string) int {
+	switch reason {
+	case ReasonExpired, ReasonInvalidClaims:
+		return 3
+	case ReasonUnknownKey, ReasonKeyUnavailable:
+		return 2
+	case ReasonBadSignature:
+		return 1
+	}
+	return 0
+}
+
+var reasonMessages = map[string]string{
+	ReasonExpired:        "token has expired",
+	ReasonBadSignature:   "token signature is invalid",
+	ReasonMalformed:      "token is malformed",
+	ReasonInvalidClaims:  "token claims are invalid",
+	ReasonUnknownKey:     "token signing key is unknown",
+	ReasonKeyUnavailable: "token signing keys are unavailable",
+	ReasonWebhookDenied:  "authentication was refused",
+	ReasonWebhookError:   "authentication is unavailable",
+}
+
+func writeUnauthenticated(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]any{{
+			"message":    reasonMessages[reason],
+			"extensions": map[string]any{"code": "UNAUTHENTICATED", "reason": reason},
+		}},
+	})
+}
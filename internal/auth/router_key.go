@@ -4,12 +4,13 @@ import "net/http"
 
 // RouterKeyStore is satisfied by *metadata.Store.
 type RouterKeyStore interface {
-	ValidateRouterKey(key string) (bool, error)
+	RouterKeyContract(key string) (contract string, ok bool, err error)
 	HasActiveRouterKeys() (bool, error)
 }
 
 // RouterKeyMiddleware enforces the X-Router-Key header when the DB has active keys.
-// If no keys are configured, all requests pass through (open mode).
+// If no keys are configured, all requests pass through (open mode). The schema
+// contract bound to the key, if any, is stored in the request context.
 func RouterKeyMiddleware(store RouterKeyStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,12 +26,15 @@ func RouterKeyMiddleware(store RouterKeyStore) func(http.Handler) http.Handler {
 				return
 			}
 
-			valid, err := store.ValidateRouterKey(key)
+			contract, valid, err := store.RouterKeyContract(key)
 			if err != nil || !valid {
 				writeAPIUnauthorized(w, "invalid router key")
 				return
 			}
 
+			if contract != "" {
+				r = r.WithContext(SetContract(r.Context(), contract))
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
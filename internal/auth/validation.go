@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/deformal/kastql/internal/config"
+	"github.com/deformal/kastql/internal/metadata"
+)
+
+// Validation is what a token must satisfy beyond a valid signature and its
+// exp/nbf times.
+type Validation struct {
+	Issuer         string        // required iss; "" = any
+	Audience       []string      // aud must name one of these; empty = any
+	Leeway         time.Duration // clock skew allowed on exp, nbf and iat
+	RequiredClaims []string      // claims that must be present, after ClaimsNamespace is applied
+
+	// ClaimsNamespace locates an object of claims nested in the token, such
+	// as "https://kastql.io/claims" or the JSON path
+	// `$["https://kastql.io/claims"]`. Its members are read as if they were
+	// top-level claims, overriding any of the same name, so the role claim,
+	// allowed roles and session variables can all live inside it. Registered
+	// claims such as sub and exp are only taken from it when the token has
+	// none at the top level.
+	ClaimsNamespace string
+}
+
+// ValidationFromConfig returns the token requirements set in cfg.
+func ValidationFromConfig(cfg config.AuthConfig) Validation {
+	return Validation{
+		Issuer:          cfg.JWTIssuer,
+		Audience:        cfg.JWTAudience,
+		Leeway:          cfg.JWTLeeway,
+		RequiredClaims:  cfg.JWTRequiredClaims,
+		ClaimsNamespace: cfg.ClaimsNamespace,
+	}
+}
+
+// ValidationFromRow decodes a jwt_secrets row's token requirements.
+func ValidationFromRow(row metadata.JWTValidation) (Validation, error) {
+	v := Validation{
+		Issuer:          row.Issuer,
+		Leeway:          time.Duration(row.LeewaySeconds) * time.Second,
+		ClaimsNamespace: row.ClaimsNamespace,
+	}
+	if row.LeewaySeconds < 0 {
+		return v, errors.New("leeway_seconds must not be negative")
+	}
+	if row.Audience != "" {
+		if err := json.Unmarshal([]byte(row.Audience), &v.Audience); err != nil {
+			return v, fmt.Errorf("audience: %w", err)
+		}
+	}
+	if row.RequiredClaims != "" {
+		if err := json.Unmarshal([]byte(row.RequiredClaims), &v.RequiredClaims); err != nil {
+			return v, fmt.Errorf("required_claims: %w", err)
+		}
+	}
+	if v.ClaimsNamespace != "" {
+		if _, err := parseClaimsPath(v.ClaimsNamespace); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// Override returns v with every requirement that o sets replaced by o's.
+func (v Validation) Override(o Validation) Validation {
+	if o.Issuer != "" {
+		v.Issuer = o.Issuer
+	}
+	if len(o.Audience) > 0 {
+		v.Audience = o.Audience
+	}
+	if o.Leeway > 0 {
+		v.Leeway = o.Leeway
+	}
+	if len(o.RequiredClaims) > 0 {
+		v.RequiredClaims = o.RequiredClaims
+	}
+	if o.ClaimsNamespace != "" {
+		v.ClaimsNamespace = o.ClaimsNamespace
+	}
+	return v
+}
+
+func (v Validation) parserOptions() []jwt.ParserOption {
+	var opts []jwt.ParserOption
+	if v.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.Issuer))
+	}
+	if len(v.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(v.Audience...))
+	}
+	if v.Leeway > 0 {
+		opts = append(opts, jwt.WithLeeway(v.Leeway))
+	}
+	// iat in the future, beyond the leeway, means a bad clock or a forgery.
+	opts = append(opts, jwt.WithIssuedAt())
+	return opts
+}
+
+// registeredClaims are the RFC 7519 claims a claims namespace never
+// overrides.
+var registeredClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+}
+
+// claims applies ClaimsNamespace to the token's claims and checks that the
+// required ones are present.
+func (v Validation) claims(raw map[string]any) (map[string]any, error) {
+	out := raw
+	if v.ClaimsNamespace != "" {
+		path, err := parseClaimsPath(v.ClaimsNamespace)
+		if err != nil {
+			return nil, err
+		}
+		var ns any = raw
+		for _, key := range path {
+			obj, _ := ns.(map[string]any)
+			ns = obj[key]
+		}
+		nested, ok := ns.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("claims namespace %q not found in token", v.ClaimsNamespace)
+		}
+		out = maps.Clone(raw)
+		for k, val := range nested {
+			if _, set := raw[k]; set && registeredClaims[k] {
+				continue
+			}
+			out[k] = val
+		}
+	}
+	for _, name := range v.RequiredClaims {
+		if val, ok := out[name]; !ok || val == nil {
+			return nil, fmt.Errorf("required claim %q is missing", name)
+		}
+	}
+	return out, nil
+}
+
+// parseClaimsPath splits a claims namespace into keys. A plain string is a
+// single key, dots included; a path starting with "$" is a JSON path of
+// .name and ["name"] segments.
+func parseClaimsPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return []string{path}, nil
+	}
+	var keys []string
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("claims path %q: unterminated [\"", path)
+			}
+			keys = append(keys, rest[2:end])
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("claims path %q: empty segment", path)
+			}
+			keys = append(keys, rest[:end])
+			rest = rest[end:]
+		default:
+			return nil, fmt.Errorf("claims path %q: unexpected %q", path, rest)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("claims path selects the whole token")
+	}
+	return keys, nil
+}
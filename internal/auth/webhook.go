@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deformal/kastql/internal/config"
+)
+
+// maxWebhookEntries bounds the webhook response cache.
+const maxWebhookEntries = 10000
+
+var errWebhookDenied = errors.New("auth webhook rejected the request")
+
+// hopHeaders are never forwarded to the webhook.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Accept-Encoding",
+}
+
+// Webhook resolves session variables by calling an authentication webhook
+// with the request's headers, for deployments whose session tokens are
+// opaque. Answers — variables or a rejection — are cached per distinct value
+// of the cache key headers (by default every forwarded header), keyed by
+// their hash so tokens are not kept in memory, and concurrent requests with
+// the same key share one webhook call. Requests carrying none of the key
+// headers always call the webhook.
+type Webhook struct {
+	cfg      config.WebhookConfig
+	keyNames []string // canonical, sorted; nil = every forwarded header
+	client   *http.Client
+
+	mu       sync.Mutex
+	cache    map[string]webhookEntry
+	inflight map[string]*webhookCall
+}
+
+type webhookEntry struct {
+	vars    map[string]any // nil when denied
+	expires time.Time
+}
+
+type webhookCall struct {
+	done chan struct{}
+	vars map[string]any
+	err  error
+}
+
+// webhookJoined is called when a request joins an in-flight webhook call. It
+// is a variable so tests can wait for requests to join.
+var webhookJoined = func() {}
+
+// NewWebhook returns a Webhook for cfg.
+func NewWebhook(cfg config.WebhookConfig) *Webhook {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var keyNames []string
+	for _, name := range cfg.CacheKey {
+		keyNames = append(keyNames, http.CanonicalHeaderKey(name))
+	}
+	slices.Sort(keyNames)
+	return &Webhook{
+		cfg:      cfg,
+		keyNames: slices.Compact(keyNames),
+		client:   &http.Client{Timeout: timeout},
+		cache:    map[string]webhookEntry{},
+		inflight: map[string]*webhookCall{},
+	}
+}
+
+// Resolve returns the session variables the webhook grants r. It returns
+// errWebhookDenied when the webhook answers 401, and another error when it
+// cannot be reached or answers anything else.
+func (h *Webhook) Resolve(r *http.Request) (map[string]any, error) {
+	headers := h.forwarded(r)
+	key := h.cacheKey(headers)
+	if h.cfg.CacheTTL <= 0 || key == "" {
+		return h.call(r.Context(), headers)
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	if e, ok := h.cache[key]; ok && now.Before(e.expires) {
+		h.mu.Unlock()
+		if e.vars == nil {
+			return nil, errWebhookDenied
+		}
+		return e.vars, nil
+	}
+	c, joined := h.inflight[key]
+	if joined {
+		webhookJoined()
+	} else {
+		c = &webhookCall{done: make(chan struct{})}
+		h.inflight[key] = c
+		// The call outlives the request that started it, so the requests
+		// that joined it are not failed when that one goes away.
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			c.vars, c.err = h.call(ctx, headers)
+			h.mu.Lock()
+			delete(h.inflight, key)
+			// Errors are not cached: the next request retries.
+			if c.err == nil || errors.Is(c.err, errWebhookDenied) {
+				now := time.Now()
+				h.storeLocked(key, webhookEntry{vars: c.vars, expires: now.Add(h.cfg.CacheTTL)}, now)
+			}
+			h.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	h.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.vars, c.err
+	case <-r.Context().Done():
+		return nil, fmt.Errorf("auth webhook: %w", r.Context().Err())
+	}
+}
+
+func (h *Webhook) call(ctx context.Context, headers http.Header) (map[string]any, error) {
+	var req *http.Request
+	var err error
+	if strings.EqualFold(h.cfg.Method, http.MethodPost) {
+		flat := make(map[string]string, len(headers))
+		for name, values := range headers {
+			flat[name] = joinHeader(name, values)
+		}
+		body, _ := json.Marshal(map[string]any{"headers": flat})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, h.cfg.URL, nil)
+		if err == nil {
+			req.Header = headers
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook: %w", err)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		io.Copy(io.Discard, resp.Body)
+		return nil, errWebhookDenied
+	default:
+		return nil, fmt.Errorf("auth webhook: %s returned %d", h.cfg.URL, resp.StatusCode)
+	}
+	var vars map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		return nil, fmt.Errorf("auth webhook: decode response: %w", err)
+	}
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	return vars, nil
+}
+
+// forwarded returns the headers of r sent to the webhook.
+func (h *Webhook) forwarded(r *http.Request) http.Header {
+	out := http.Header{}
+	if len(h.cfg.ForwardHeaders) > 0 {
+		for _, name := range h.cfg.ForwardHeaders {
+			if v := r.Header.Values(name); len(v) > 0 {
+				out[http.CanonicalHeaderKey(name)] = slices.Clone(v)
+			}
+		}
+		return out
+	}
+	for name, v := range r.Header {
+		if !slices.Contains(hopHeaders, name) {
+			out[name] = slices.Clone(v)
+		}
+	}
+	return out
+}
+
+// joinHeader folds the values of a repeated header into one, as a proxy
+// would: cookies with "; " and every other header with ", ".
+func joinHeader(name string, values []string) string {
+	if name == "Cookie" {
+		return strings.Join(values, "; ")
+	}
+	return strings.Join(values, ", ")
+}
+
+// cacheKey hashes the forwarded values of the cache key headers, or of every
+// forwarded header when none are configured. Configuring cache_key leaves
+// headers that never change the webhook's answer, such as trace or request
+// IDs, out of the key so they do not defeat the cache. It returns "" when
+// none of the key headers is present: such a request must not share an
+// answer with every other request that lacks them.
+func (h *Webhook) cacheKey(headers http.Header) string {
+	names := h.keyNames
+	if names == nil {
+		for name := range headers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	sum := sha256.New()
+	found := false
+	for _, name := range names {
+		for _, v := range headers[name] {
+			fmt.Fprintf(sum, "%s\x00%s\x00", name, v)
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// storeLocked caches e under key. h.mu must be held.
+func (h *Webhook) storeLocked(key string, e webhookEntry, now time.Time) {
+	if len(h.cache) >= maxWebhookEntries {
+		for k, old := range h.cache {
+			if !now.Before(old.expires) {
+				delete(h.cache, k)
+			}
+		}
+		if len(h.cache) >= maxWebhookEntries {
+			clear(h.cache)
+		}
+	}
+	h.cache[key] = e
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/config"
+)
+
+func TestMiddlewareWebhook(t *testing.T) {
+	var calls atomic.Int32
+	var slow atomic.Bool
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if slow.Load() {
+			time.Sleep(200 * time.Millisecond)
+		}
+		token := r.Header.Get("Authorization")
+		if r.Method == http.MethodPost {
+			var body struct {
+				Headers map[string]string `json:"headers"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			token = body.Headers["Authorization"]
+		}
+		switch token {
+		case "Bearer opaque-user":
+			json.NewEncoder(w).Encode(map[string]any{
+				"x-kastql-role":    "user",
+				"x-kastql-user-id": "42",
+				"allowed_roles":    []string{"user", "editor"},
+			})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer hook.Close()
+
+	newHandler := func(wh config.WebhookConfig) http.Handler {
+		wh.URL = hook.URL
+		m := New(config.AuthConfig{
+			JWTHeader:   "Authorization",
+			RoleClaim:   "x-kastql-role",
+			DefaultRole: "public",
+			Mode:        "webhook",
+			Webhook:     wh,
+		}, zap.NewNop())
+		return m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := GetClaims(r.Context())["x-kastql-user-id"].(string)
+			w.Write([]byte(GetRole(r.Context()) + " " + id))
+		}))
+	}
+	serve := func(h http.Handler, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	user := map[string]string{"Authorization": "Bearer opaque-user"}
+
+	for _, method := range []string{"GET", "POST"} {
+		h := newHandler(config.WebhookConfig{Method: method, CacheTTL: time.Minute})
+		calls.Store(0)
+		for range 3 {
+			if rec := serve(h, user); rec.Code != http.StatusOK || rec.Body.String() != "user 42" {
+				t.Fatalf("%s: got %d %q", method, rec.Code, rec.Body.String())
+			}
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("%s: expected one webhook call with caching, got %d", method, n)
+		}
+		if rec := serve(h, map[string]string{"Authorization": "Bearer opaque-user", "X-Kastql-Role": "editor"}); rec.Body.String() != "editor 42" {
+			t.Errorf("%s: allowed role switch: got %q", method, rec.Body.String())
+		}
+		if rec := serve(h, map[string]string{"Authorization": "Bearer revoked"}); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: rejected token: got %d, want 401", method, rec.Code)
+		}
+	}
+
+	// Without caching every request calls the webhook.
+	h := newHandler(config.WebhookConfig{})
+	calls.Store(0)
+	serve(h, user)
+	serve(h, user)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected two webhook calls without caching, got %d", n)
+	}
+
+	// A webhook that times out falls back to the default role, or rejects the
+	// request when failing closed.
+	slow.Store(true)
+	defer slow.Store(false)
+	open := newHandler(config.WebhookConfig{Timeout: 50 * time.Millisecond})
+	closed := newHandler(config.WebhookConfig{Timeout: 50 * time.Millisecond, FailClosed: true})
+	if rec := serve(open, user); rec.Code != http.StatusOK || rec.Body.String() != "public " {
+		t.Errorf("fail open: got %d %q, want the default role", rec.Code, rec.Body.String())
+	}
+	if rec := serve(closed, user); rec.Code != http.StatusUnauthorized {
+		t.Errorf("fail closed: got %d, want 401", rec.Code)
+	}
+}
+
+func TestWebhookSharedLookups(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var cookie atomic.Value
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		var body struct {
+			Headers map[string]string `json:"headers"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		cookie.Store(body.Headers["Cookie"])
+		json.NewEncoder(w).Encode(map[string]any{"x-kastql-role": "user"})
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	wh := NewWebhook(config.WebhookConfig{URL: hook.URL, Method: "POST", CacheTTL: time.Minute, CacheKey: []string{"Authorization"}})
+	joined := make(chan struct{}, 4)
+	webhookJoined = func() { joined <- struct{}{} }
+	defer func() { webhookJoined = func() {} }()
+
+	request := func(requestID string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		req.Header.Set("Authorization", "Bearer opaque-user")
+		req.Header.Set("X-Request-Id", requestID)
+		req.Header.Add("Cookie", "a=1")
+		req.Header.Add("Cookie", "b=2")
+		return req
+	}
+
+	// Concurrent misses for one token share a single webhook call, whatever
+	// else their headers carry.
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vars, err := wh.Resolve(request(fmt.Sprint(i))); err != nil || vars["x-kastql-role"] != "user" {
+				t.Errorf("request %d: got %v, %v", i, vars, err)
+			}
+		}()
+	}
+	for range 2 {
+		<-joined
+	}
+	release <- struct{}{}
+	wg.Wait()
+
+	if _, err := wh.Resolve(request("later")); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected one webhook call, got %d", n)
+	}
+	if got := cookie.Load(); got != "a=1; b=2" {
+		t.Errorf("expected every cookie to reach the webhook, got %q", got)
+	}
+}
+
+func TestWebhookCookieSessions(t *testing.T) {
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		session, err := r.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"x-kastql-role": "user", "x-kastql-user-id": session.Value})
+	}))
+	defer hook.Close()
+
+	resolve := func(wh *Webhook, session string) string {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		req.Header.Set("Cookie", "session="+session)
+		vars, err := wh.Resolve(req)
+		if err != nil {
+			t.Fatalf("session %s: %v", session, err)
+		}
+		id, _ := vars["x-kastql-user-id"].(string)
+		return id
+	}
+
+	// Without an Authorization header, sessions are told apart by their
+	// cookies: by default every forwarded header is part of the key.
+	wh := NewWebhook(config.WebhookConfig{URL: hook.URL, CacheTTL: time.Minute})
+	for range 2 {
+		if a, b := resolve(wh, "alice"), resolve(wh, "bob"); a != "alice" || b != "bob" {
+			t.Fatalf("got %q and %q, want alice and bob", a, b)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected one webhook call per session, got %d", n)
+	}
+
+	// A request carrying none of the configured key headers is never
+	// answered from the cache.
+	calls.Store(0)
+	wh = NewWebhook(config.WebhookConfig{URL: hook.URL, CacheTTL: time.Minute, CacheKey: []string{"Authorization"}})
+	if a, b := resolve(wh, "alice"), resolve(wh, "bob"); a != "alice" || b != "bob" {
+		t.Fatalf("got %q and %q, want alice and bob", a, b)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected requests without key headers to skip the cache, got %d calls", n)
+	}
+}
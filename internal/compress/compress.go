@@ -0,0 +1,138 @@
+// Package compress negotiates gzip and brotli encoding for client responses
+// and upstream requests.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	Gzip   = "gzip"
+	Brotli = "br"
+
+	// AcceptEncoding is sent on upstream requests; responses are decoded
+	// by NewReader.
+	AcceptEncoding = "br, gzip"
+
+	// DefaultMinBytes is the response size below which compression is skipped.
+	DefaultMinBytes = 1024
+
+	brotliLevel = 5 // favours speed for dynamic responses
+)
+
+var (
+	gzipPool   = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	brotliPool = sync.Pool{New: func() any { return brotli.NewWriterLevel(io.Discard, brotliLevel) }}
+)
+
+// ValidEncoding reports whether enc can be used for upstream requests;
+// "" means uncompressed.
+func ValidEncoding(enc string) bool {
+	return enc == "" || enc == Gzip || enc == Brotli
+}
+
+// Negotiate picks the encoding for a response from an Accept-Encoding
+// header: brotli, then gzip, or "" when the client accepts neither.
+func Negotiate(acceptEncoding string) string {
+	var br, gz bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case Brotli:
+			br = true
+		case Gzip, "x-gzip":
+			gz = true
+		case "*":
+			br, gz = true, true
+		}
+	}
+	switch {
+	case br:
+		return Brotli
+	case gz:
+		return Gzip
+	}
+	return ""
+}
+
+// encoder is a pooled compressor writing to an underlying writer.
+type encoder struct {
+	io.WriteCloser
+	flush   func() error
+	release func()
+}
+
+func newEncoder(enc string, w io.Writer) *encoder {
+	switch enc {
+	case Gzip:
+		gw := gzipPool.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &encoder{WriteCloser: gw, flush: gw.Flush, release: func() { gzipPool.Put(gw) }}
+	case Brotli:
+		bw := brotliPool.Get().(*brotli.Writer)
+		bw.Reset(w)
+		return &encoder{WriteCloser: bw, flush: bw.Flush, release: func() { brotliPool.Put(bw) }}
+	}
+	return nil
+}
+
+// Close finishes the stream and returns the compressor to its pool.
+func (e *encoder) Close() error {
+	err := e.WriteCloser.Close()
+	e.release()
+	return err
+}
+
+// Encode compresses body with enc.
+func Encode(enc string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	e := newEncoder(enc, &buf)
+	if e == nil {
+		return nil, fmt.Errorf("unsupported encoding %q", enc)
+	}
+	if _, err := e.Write(body); err != nil {
+		e.Close()
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewReader decodes a body sent with the given Content-Encoding. Size caps
+// belong on the returned reader so they apply to the decoded bytes. An empty
+// body decodes to an empty body whatever its encoding, so that e.g. a bodiless
+// 502 still surfaces as a 502 rather than a gzip header error.
+func NewReader(enc string, r io.Reader) (io.ReadCloser, error) {
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	if enc == "" || enc == "identity" {
+		return io.NopCloser(r), nil
+	}
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return io.NopCloser(br), nil
+	}
+	r = br
+	switch enc {
+	case Gzip, "x-gzip":
+		return gzip.NewReader(r)
+	case Brotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", enc)
+}
@@ -0,0 +1,109 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/deformal/kastql/internal/security"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                     "",
+		"gzip, deflate":        Gzip,
+		"gzip, deflate, br":    Brotli,
+		"br;q=0, gzip":         Gzip,
+		"*":                    Brotli,
+		"identity":             "",
+		"GZIP;q=0.5, br;q=0.0": Gzip,
+	}
+	for header, want := range cases {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"id":"1"},`, 500)
+	handler := func(body string, maxKB int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxKB > 0 {
+				w = security.NewCappedWriter(w, maxKB)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, body)
+		})
+	}
+	serve := func(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+		mw := Middleware(func() Options { return Options{Enabled: true, MinBytes: 1024} })
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		mw(h).ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(t *testing.T, rec *httptest.ResponseRecorder) string {
+		r, err := NewReader(rec.Header().Get("Content-Encoding"), rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("below threshold", func(t *testing.T) {
+		rec := serve(handler(`{"data":{}}`, 0), "gzip")
+		if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("expected small response uncompressed, got %q", ce)
+		}
+		if rec.Body.String() != `{"data":{}}` {
+			t.Errorf("unexpected body %q", rec.Body.String())
+		}
+	})
+
+	for _, enc := range []string{Gzip, Brotli} {
+		t.Run(enc, func(t *testing.T) {
+			rec := serve(handler(large, 0), enc)
+			if ce := rec.Header().Get("Content-Encoding"); ce != enc {
+				t.Fatalf("Content-Encoding = %q, want %q", ce, enc)
+			}
+			if rec.Body.Len() >= len(large) {
+				t.Errorf("expected compressed body, got %d bytes for %d", rec.Body.Len(), len(large))
+			}
+			if got := decode(t, rec); got != large {
+				t.Error("decoded body does not match")
+			}
+		})
+	}
+
+	t.Run("cap counts uncompressed bytes", func(t *testing.T) {
+		rec := serve(handler(large, 2), Gzip)
+		if got := decode(t, rec); len(got) != 2048 {
+			t.Errorf("expected 2048 uncompressed bytes, got %d", len(got))
+		}
+	})
+}
+
+func TestNewReaderEmptyBody(t *testing.T) {
+	for _, enc := range []string{Gzip, Brotli} {
+		r, err := NewReader(enc, strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		if b, err := io.ReadAll(r); err != nil || len(b) != 0 {
+			t.Errorf("%s: got %q, %v; want an empty body", enc, b, err)
+		}
+	}
+	// A non-empty body still goes through the decoder.
+	if _, err := NewReader(Gzip, strings.NewReader("not gzip")); err == nil {
+		t.Error("expected an error for a corrupt gzip body")
+	}
+}
@@ -0,0 +1,170 @@
+package compress
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Options controls response compression. It is read on every request so
+// settings changes apply without a restart.
+type Options struct {
+	Enabled  bool
+	MinBytes int // responses smaller than this are sent uncompressed
+}
+
+// Middleware compresses responses with the encoding negotiated from
+// Accept-Encoding. Output is buffered until MinBytes have been written, so
+// small responses go out as-is. Handlers that cap their response size wrap
+// the writer they are given, which means caps count uncompressed bytes.
+// WebSocket upgrades are passed through untouched.
+func Middleware(opts func() Options) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			o := opts()
+			if !o.Enabled || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc := Negotiate(r.Header.Get("Accept-Encoding"))
+			if enc == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &responseWriter{ResponseWriter: w, encoding: enc, minBytes: o.MinBytes}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// responseWriter buffers the start of a response to decide whether it is
+// worth compressing, then streams through the encoder.
+type responseWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     *encoder
+}
+
+func (c *responseWriter) WriteHeader(status int) {
+	if c.decided || c.status != 0 {
+		return
+	}
+	c.status = status
+	// Bodiless or already-encoded responses have nothing to compress.
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		c.Header().Get("Content-Encoding") != "" || !compressible(c.Header().Get("Content-Type")) {
+		c.start(false)
+	}
+}
+
+func (c *responseWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) >= c.minBytes {
+			if err := c.start(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// start sends the headers and any buffered bytes, compressed or not.
+func (c *responseWriter) start(compress bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.Header().Get("Content-Type") == "" && len(c.buf) > 0 {
+		// Sniff now; net/http would otherwise sniff the compressed bytes.
+		c.Header().Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if compress {
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.Header().Del("Content-Length")
+		c.ResponseWriter.WriteHeader(c.status)
+		c.enc = newEncoder(c.encoding, c.ResponseWriter)
+	} else {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	buf := c.buf
+	c.buf = nil
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// FlushError sends everything written so far. A response flushed before it
+// reached MinBytes is sent uncompressed.
+func (c *responseWriter) FlushError() error {
+	if !c.decided {
+		if err := c.start(len(c.buf) >= c.minBytes); err != nil {
+			return err
+		}
+	}
+	if c.enc != nil {
+		if err := c.enc.flush(); err != nil {
+			return err
+		}
+	}
+	err := http.NewResponseController(c.ResponseWriter).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (c *responseWriter) Flush() { c.FlushError() }
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *responseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *responseWriter) close() {
+	if !c.decided {
+		if c.status == 0 {
+			// Nothing was written; let net/http send its default response.
+			return
+		}
+		c.start(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+		c.enc = nil
+	}
+}
+
+// compressible reports whether a response of this Content-Type benefits from
+// compression. Media and archive formats are already compressed.
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	for _, prefix := range []string{"image/", "video/", "audio/", "font/woff", "application/zip", "application/gzip", "application/octet-stream"} {
+		if strings.HasPrefix(ct, prefix) {
+			return ct == "image/svg+xml"
+		}
+	}
+	return true
+}
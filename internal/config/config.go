@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -24,10 +25,38 @@ type DatabaseConfig struct {
 }
 
 type AuthConfig struct {
-	JWTSecret   string `yaml:"jwt_secret"`
-	JWTHeader   string `yaml:"jwt_header"`
-	RoleClaim   string `yaml:"role_claim"`
-	DefaultRole string `yaml:"default_role"`
+	JWTSecret   string        `yaml:"jwt_secret"`
+	JWKSURL     string        `yaml:"jwks_url"`     // identity provider key set, used alongside jwt_secret
+	JWKSRefresh time.Duration `yaml:"jwks_refresh"` // 0 = 10m
+	JWTHeader   string        `yaml:"jwt_header"`
+	RoleClaim   string        `yaml:"role_claim"`
+	DefaultRole string        `yaml:"default_role"`
+	StrictJWT   bool          `yaml:"strict_jwt"` // reject invalid tokens with 401 instead of using default_role
+
+	// Token requirements; JWT secrets in the metadata DB may override them.
+	JWTIssuer         string        `yaml:"jwt_issuer"`
+	JWTAudience       []string      `yaml:"jwt_audience"`        // any one must match
+	JWTLeeway         time.Duration `yaml:"jwt_leeway"`          // clock skew on exp/nbf/iat
+	JWTRequiredClaims []string      `yaml:"jwt_required_claims"` // checked after claims_namespace
+	ClaimsNamespace   string        `yaml:"claims_namespace"`    // nested claims object, e.g. $["https://kastql.io/claims"]
+
+	// Mode is "jwt" (the default) or "webhook", which resolves the role and
+	// session variables by calling Webhook instead of validating JWTs.
+	Mode    string        `yaml:"mode"`
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+// WebhookConfig configures webhook authentication. The webhook answers 200
+// with a JSON object of session variables, the role under role_claim, or 401
+// to reject the request.
+type WebhookConfig struct {
+	URL            string        `yaml:"url"`
+	Method         string        `yaml:"method"`          // GET (default) forwards headers as headers; POST sends them as JSON
+	ForwardHeaders []string      `yaml:"forward_headers"` // empty = all but hop-by-hop headers
+	Timeout        time.Duration `yaml:"timeout"`         // 0 = 5s
+	CacheTTL       time.Duration `yaml:"cache_ttl"`       // 0 = no caching
+	CacheKey       []string      `yaml:"cache_key"`       // headers answers are cached by; empty = every forwarded header
+	FailClosed     bool          `yaml:"fail_closed"`     // reject requests when the webhook errors instead of using default_role
 }
 
 type Service struct {
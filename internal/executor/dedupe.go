@@ -0,0 +1,180 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+var defaultDedupeHeaders = []string{"Authorization"}
+
+// flightGroup collapses concurrent calls with the same key into a single
+// upstream request whose response is handed to every caller.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	resp *upstreamResponse
+	err  error
+	dups int // callers that joined after the first
+}
+
+// flightJoined is called when a caller joins an in-flight call. It is a
+// variable so tests can wait for callers to join.
+var flightJoined = func() {}
+
+// do runs fn once per key among concurrent callers. shared is true for callers
+// that joined another caller's request. fn runs on a context that keeps ctx's
+// values but not its cancellation, so the caller that started the request
+// going away does not fail the others; fn must bound the call itself. Every
+// caller, the first included, stops waiting when its own ctx ends.
+//
+// Callers may modify the data they receive: when a response went to more
+// than one caller each gets its own copy, and otherwise the original.
+func (g *flightGroup) do(
+	ctx context.Context,
+	key string,
+	fn func(ctx context.Context) (*upstreamResponse, error),
+) (resp *upstreamResponse, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, shared := g.calls[key]
+	if shared {
+		c.dups++
+		flightJoined()
+	} else {
+		c = &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.resp, c.err = fn(context.WithoutCancel(ctx))
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.dups == 0 || c.resp == nil {
+			return c.resp, c.err, shared
+		}
+		own := *c.resp
+		own.Data = cloneData(c.resp.Data)
+		return &own, c.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
+
+// dedupeKey identifies an upstream call for deduplication: the service URL,
+// the sub-query, its variables, and the outbound values of the key headers.
+// Those are the policy's key headers under the names the header rules
+// forward them as, plus every header the rules set, so a caller identity
+// injected from claims or the role always separates callers. Variables are
+// canonicalised by encoding/json, which sorts map keys.
+func dedupeKey(step *planner.Step, headers map[string]string, vars map[string]any) string {
+	varsJSON, _ := json.Marshal(vars)
+
+	canonical := make(map[string]string, len(headers))
+	for k, v := range headers {
+		canonical[http.CanonicalHeaderKey(k)] = v
+	}
+	names := dedupeKeyHeaders(step)
+
+	var b strings.Builder
+	b.WriteString(step.ServiceURL)
+	b.WriteByte(0)
+	b.WriteString(step.Query)
+	b.WriteByte(0)
+	b.Write(varsJSON)
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(canonical[name])
+	}
+
+	h := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// dedupeKeyHeaders returns the sorted, canonical outbound header names that
+// distinguish callers of step.
+func dedupeKeyHeaders(step *planner.Step) []string {
+	rules := step.HeaderRules
+	keyHeaders := step.Dedupe.KeyHeaders
+	if len(keyHeaders) == 0 {
+		keyHeaders = defaultDedupeHeaders
+	}
+
+	set := map[string]bool{}
+	for _, h := range keyHeaders {
+		set[http.CanonicalHeaderKey(h)] = true
+		for from, to := range rules.Rename {
+			if strings.EqualFold(from, h) {
+				set[http.CanonicalHeaderKey(to)] = true
+			}
+		}
+	}
+	for name := range rules.FromClaims {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	if rules.FromRole != "" {
+		set[http.CanonicalHeaderKey(rules.FromRole)] = true
+	}
+	for name := range rules.Static {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range step.StaticHeaders {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cloneData deep-copies a decoded JSON object so that callers sharing one
+// upstream response can each merge into their own copy.
+func cloneData(data map[string]any) map[string]any {
+	if data == nil {
+		return nil
+	}
+	return cloneValue(data).(map[string]any)
+}
+
+func cloneValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(t))
+		for k, val := range t {
+			m[k] = cloneValue(val)
+		}
+		return m
+	case []any:
+		s := make([]any, len(t))
+		for i, val := range t {
+			s[i] = cloneValue(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
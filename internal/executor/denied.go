@@ -0,0 +1,38 @@
+package executor
+
+import "github.com/deformal/kastql/internal/planner"
+
+// applyDenied nulls the fields stripped from a plan under partial denial, or
+// the nullable ancestors their nulls propagate to, and returns a FORBIDDEN
+// error for each one in the response, located by its path. Placeholders
+// selected in their place are removed.
+func applyDenied(data map[string]any, denied []planner.DeniedField) []GQLError {
+	if data == nil {
+		return nil
+	}
+	var errs []GQLError
+	for _, d := range denied {
+		at := d.NullPath
+		if at == nil {
+			at = d.Path
+		}
+		if len(at) == 0 || len(at) > len(d.Path) {
+			continue
+		}
+		key := at[len(at)-1]
+		for _, parent := range locateObjects(data, at[:len(at)-1]) {
+			delete(parent.obj, planner.DeniedPlaceholder)
+			parent.obj[key] = nil
+			path := parent.path[:len(parent.path):len(parent.path)]
+			for _, k := range d.Path[len(at)-1:] {
+				path = append(path, k)
+			}
+			errs = append(errs, GQLError{
+				Message:    d.Message,
+				Path:       path,
+				Extensions: map[string]any{"code": "FORBIDDEN"},
+			})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// entityCache holds entity fields resolved during one request so that an
+// entity reached through several paths (e.g. order.user and review.author)
+// is only fetched once per field. It must not outlive the request: the
+// values were resolved under that request's headers and role.
+type entityCache struct {
+	mu      sync.Mutex
+	entries map[string]map[string]any // typename+key → field selection → value
+}
+
+func newEntityCache() *entityCache {
+	return &entityCache{entries: map[string]map[string]any{}}
+}
+
+// entityCacheKey identifies an entity by its typename and key field values.
+func entityCacheKey(em *planner.EntityMeta, obj map[string]any) string {
+	keyVals := make([]any, 0, len(em.KeyFields))
+	for _, kf := range em.KeyFields {
+		keyVals = append(keyVals, obj[kf])
+	}
+	b, _ := json.Marshal(keyVals)
+	return em.TypeName + ":" + string(b)
+}
+
+// missing returns the fields not yet cached for key.
+func (c *entityCache) missing(key string, fields []planner.EntityField) []planner.EntityField {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entries[key]
+	var out []planner.EntityField
+	for _, f := range fields {
+		if _, ok := cached[f.Selection]; !ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// store records the requested fields from an _entities result.
+func (c *entityCache) store(key string, fields []planner.EntityField, data map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entries[key]
+	if cached == nil {
+		cached = map[string]any{}
+		c.entries[key] = cached
+	}
+	for _, f := range fields {
+		if v, ok := data[f.ResponseKey]; ok {
+			cached[f.Selection] = v
+		}
+	}
+}
+
+// fill merges every cached field of key into obj under its response key.
+// Values are deep-copied: the same entity can appear at several places in a
+// response, and later merges and row filters on one must not change the
+// others.
+func (c *entityCache) fill(key string, fields []planner.EntityField, obj map[string]any) {
+	c.mu.Lock()
+	cached := c.entries[key]
+	found := make(map[string]any, len(fields))
+	for _, f := range fields {
+		if v, ok := cached[f.Selection]; ok {
+			found[f.ResponseKey] = cloneValue(v)
+		}
+	}
+	c.mu.Unlock()
+	mergeInto(obj, found)
+}
@@ -2,7 +2,6 @@ package executor
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"maps"
 	"sync"
@@ -28,6 +27,8 @@ type CircuitBreaker interface {
 type Executor struct {
 	log     *zap.Logger
 	circuit CircuitBreaker // optional; nil = disabled
+	budgets sync.Map       // service name → *retryBudget
+	flights flightGroup    // in-flight deduplication of identical calls
 }
 
 // New creates an Executor.
@@ -40,57 +41,166 @@ func (e *Executor) SetCircuitBreaker(cb CircuitBreaker) {
 	e.circuit = cb
 }
 
+// retryBudget returns the shared retry budget for a service.
+func (e *Executor) retryBudget(serviceName string) *retryBudget {
+	if b, ok := e.budgets.Load(serviceName); ok {
+		return b.(*retryBudget)
+	}
+	b, _ := e.budgets.LoadOrStore(serviceName, &retryBudget{})
+	return b.(*retryBudget)
+}
+
 // Execute runs every step in the plan and merges the results.
-// headers are forwarded as-is to every upstream call.
+// headers are the client's forwarded headers, shaped per service by each
+// step's header rules before every upstream call; response headers the rules
+// pass back are merged into Result.Headers.
 func (e *Executor) Execute(ctx context.Context, plan *planner.QueryPlan, headers map[string]string) (*Result, error) {
+	return e.execute(ctx, plan, headers, nil)
+}
+
+// ExecuteIncremental runs the plan like Execute but delivers it in parts:
+// emit first receives everything outside @defer fragments, with @stream
+// lists cut to their initial count, then the streamed items, then each
+// deferred step's data as it completes. The last payload has HasNext unset.
+// Response headers can only come from the steps in the initial payload.
+func (e *Executor) ExecuteIncremental(
+	ctx context.Context,
+	plan *planner.QueryPlan,
+	headers map[string]string,
+	emit func(*Payload) error,
+) error {
+	_, err := e.execute(ctx, plan, headers, emit)
+	return err
+}
+
+func (e *Executor) execute(
+	ctx context.Context,
+	plan *planner.QueryPlan,
+	headers map[string]string,
+	emit func(*Payload) error,
+) (*Result, error) {
 	if len(plan.Steps) == 0 {
-		return &Result{Data: map[string]any{}}, nil
+		result := &Result{Data: maps.Clone(plan.Introspection)}
+		if result.Data == nil {
+			result.Data = map[string]any{}
+		}
+		result.Errors = applyDenied(result.Data, plan.Denied)
+		if emit != nil {
+			return result, emit(&Payload{Result: result})
+		}
+		return result, nil
 	}
+	ctx, respHeaders := withResponseHeaders(ctx, plan)
 
-	// Partition into root steps (no deps) and dependent steps.
-	var roots, deps []*planner.Step
+	// Partition into root steps (no deps) and dependent steps. Deferred
+	// steps are held back when delivering incrementally.
+	var roots, deps, deferred []*planner.Step
 	for _, s := range plan.Steps {
-		if len(s.DependsOn) == 0 {
+		switch {
+		case emit != nil && s.Meta.Defer != nil:
+			deferred = append(deferred, s)
+		case len(s.DependsOn) == 0:
 			roots = append(roots, s)
-		} else {
+		default:
 			deps = append(deps, s)
 		}
 	}
 
-	// Execute root steps in parallel.
-	type stepOut struct {
-		id   string
-		data map[string]any
-		errs []GQLError
-		err  error
+	stepData := map[string]map[string]any{}
+	var allErrors []GQLError
+	entities := newEntityCache()
+
+	if plan.OperationType == "mutation" {
+		// Mutation fields execute serially: each root step and everything
+		// that depends on it completes before the next root step starts.
+		// Entities are cached per step so a later write is never hidden by
+		// a value read before it.
+		for _, root := range roots {
+			data, errs, err := e.callStep(ctx, root, headers, nil)
+			if err != nil {
+				allErrors = append(allErrors, GQLError{Message: err.Error()})
+				continue
+			}
+			stepData[root.ID] = data
+			allErrors = append(allErrors, errs...)
+
+			var rootDeps []*planner.Step
+			for _, s := range deps {
+				if s.DependsOn[0] == root.ID {
+					rootDeps = append(rootDeps, s)
+				}
+			}
+			allErrors = append(allErrors, e.runDependents(ctx, rootDeps, stepData, headers, newEntityCache())...)
+		}
+	} else {
+		// Execute root steps in parallel.
+		type stepOut struct {
+			id   string
+			data map[string]any
+			errs []GQLError
+			err  error
+		}
+		out := make(chan stepOut, len(roots))
+
+		var wg sync.WaitGroup
+		for _, s := range roots {
+			wg.Add(1)
+			go func(step *planner.Step) {
+				defer wg.Done()
+				data, errs, err := e.callStep(ctx, step, headers, nil)
+				out <- stepOut{id: step.ID, data: data, errs: errs, err: err}
+			}(s)
+		}
+		wg.Wait()
+		close(out)
+
+		for o := range out {
+			if o.err != nil {
+				allErrors = append(allErrors, GQLError{Message: o.err.Error()})
+				continue
+			}
+			stepData[o.id] = o.data
+			allErrors = append(allErrors, o.errs...)
+		}
+
+		allErrors = append(allErrors, e.runDependents(ctx, deps, stepData, headers, entities)...)
 	}
-	out := make(chan stepOut, len(roots))
 
-	var wg sync.WaitGroup
+	// Merge all root step data into the final response.
+	merged := map[string]any{}
+	maps.Copy(merged, plan.Introspection)
 	for _, s := range roots {
-		wg.Add(1)
-		go func(step *planner.Step) {
-			defer wg.Done()
-			data, errs, err := e.callStep(ctx, step, headers, nil)
-			out <- stepOut{id: step.ID, data: data, errs: errs, err: err}
-		}(s)
+		if data, ok := stepData[s.ID]; ok {
+			mergeInto(merged, data)
+		}
 	}
-	wg.Wait()
-	close(out)
 
-	stepData := map[string]map[string]any{}
-	var allErrors []GQLError
-	for o := range out {
-		if o.err != nil {
-			allErrors = append(allErrors, GQLError{Message: o.err.Error()})
-			continue
+	allErrors = append(allErrors, applyDenied(merged, plan.Denied)...)
+
+	var finalErrors []GQLError
+	for _, e := range allErrors {
+		if e.Message != "" {
+			finalErrors = append(finalErrors, e)
 		}
-		stepData[o.id] = o.data
-		allErrors = append(allErrors, o.errs...)
 	}
 
-	// Execute dependent steps sequentially in dependency order.
-	// Current plans are at most one level deep (root → entity/join).
+	result := &Result{Data: merged, Errors: finalErrors, Headers: respHeaders.merged()}
+	if emit == nil {
+		return result, nil
+	}
+	return result, e.deliverIncremental(ctx, plan, result, deferred, stepData, headers, entities, emit)
+}
+
+// runDependents executes dependent steps sequentially in dependency order.
+// Current plans are at most one level deep (root → entity/join).
+func (e *Executor) runDependents(
+	ctx context.Context,
+	deps []*planner.Step,
+	stepData map[string]map[string]any,
+	headers map[string]string,
+	entities *entityCache,
+) []GQLError {
+	var allErrors []GQLError
 	for _, step := range deps {
 		parentID := step.DependsOn[0]
 		parentData, ok := stepData[parentID]
@@ -102,7 +212,7 @@ func (e *Executor) Execute(ctx context.Context, plan *planner.QueryPlan, headers
 		var errs []GQLError
 		switch step.Meta.Kind {
 		case planner.StepKindEntity:
-			errs = e.executeEntityStep(ctx, step, parentData, headers)
+			errs = e.executeEntityStep(ctx, step, parentData, headers, entities)
 		case planner.StepKindJoin:
 			errs = e.executeJoinStep(ctx, step, parentData, headers)
 		default:
@@ -116,32 +226,19 @@ func (e *Executor) Execute(ctx context.Context, plan *planner.QueryPlan, headers
 		}
 		allErrors = append(allErrors, errs...)
 	}
-
-	// Merge all root step data into the final response.
-	merged := map[string]any{}
-	for _, s := range roots {
-		if data, ok := stepData[s.ID]; ok {
-			mergeInto(merged, data)
-		}
-	}
-
-	var finalErrors []GQLError
-	for _, e := range allErrors {
-		if e.Message != "" {
-			finalErrors = append(finalErrors, e)
-		}
-	}
-
-	return &Result{Data: merged, Errors: finalErrors}, nil
+	return allErrors
 }
 
 // executeEntityStep resolves federation entity fields by calling _entities on
 // the owning service and merging results back into parentData in-place.
+// Fields already resolved for the same entity earlier in the request are
+// served from cache, and each distinct entity is requested at most once.
 func (e *Executor) executeEntityStep(
 	ctx context.Context,
 	step *planner.Step,
 	parentData map[string]any,
 	headers map[string]string,
+	cache *entityCache,
 ) []GQLError {
 	em := step.Meta.Entity
 
@@ -149,33 +246,73 @@ func (e *Executor) executeEntityStep(
 	if len(refs) == 0 {
 		return nil
 	}
+	if em.Fields == nil {
+		return e.fetchEntities(ctx, step, refs, headers)
+	}
 
-	// Build the representations list, preserving order.
-	representations := make([]map[string]any, 0, len(refs))
-	for _, ref := range refs {
-		rep := map[string]any{"__typename": em.TypeName}
-		for _, kf := range em.KeyFields {
-			rep[kf] = ref.obj[kf]
+	// Work out which distinct entities still need which fields.
+	keys := make([]string, len(refs))
+	seen := map[string]bool{}
+	needed := map[string]bool{} // field selection → missing for some entity
+	var fetch []entityRef
+	var fetchKeys []string
+	for i, ref := range refs {
+		keys[i] = entityCacheKey(em, ref.obj)
+		if seen[keys[i]] {
+			continue
 		}
-		representations = append(representations, rep)
+		seen[keys[i]] = true
+		missing := cache.missing(keys[i], em.Fields)
+		if len(missing) == 0 {
+			continue
+		}
+		for _, f := range missing {
+			needed[f.Selection] = true
+		}
+		fetch = append(fetch, ref)
+		fetchKeys = append(fetchKeys, keys[i])
 	}
 
-	vars := map[string]any{"representations": representations}
-	raw, errs, err := e.callStep(ctx, step, headers, vars)
-	if err != nil {
-		return []GQLError{{Message: fmt.Sprintf("entity step %s: %s", step.ServiceName, err)}}
-	}
+	var errs []GQLError
+	if len(fetch) > 0 {
+		var fields []planner.EntityField
+		for _, f := range em.Fields {
+			if needed[f.Selection] {
+				fields = append(fields, f)
+			}
+		}
+		sub := *step
+		if len(fields) < len(em.Fields) {
+			sub.Query = em.QueryFor(fields)
+		}
 
-	entitiesVal, ok := raw["_entities"]
-	if !ok {
-		return errs
+		var entities []any
+		entities, errs = e.callEntities(ctx, &sub, fetch, headers)
+		for i, key := range fetchKeys {
+			if i >= len(entities) {
+				break
+			}
+			if entityData, ok := entities[i].(map[string]any); ok {
+				cache.store(key, fields, entityData)
+			}
+		}
 	}
-	entities, ok := entitiesVal.([]any)
-	if !ok {
-		return errs
+
+	for i, ref := range refs {
+		cache.fill(keys[i], em.Fields, ref.obj)
 	}
+	return errs
+}
 
-	// Merge entity data into each ref in order.
+// fetchEntities resolves every ref with the step's full query and merges the
+// results positionally, bypassing the entity cache.
+func (e *Executor) fetchEntities(
+	ctx context.Context,
+	step *planner.Step,
+	refs []entityRef,
+	headers map[string]string,
+) []GQLError {
+	entities, errs := e.callEntities(ctx, step, refs, headers)
 	for i, ref := range refs {
 		if i >= len(entities) {
 			break
@@ -187,6 +324,35 @@ func (e *Executor) executeEntityStep(
 	return errs
 }
 
+// callEntities sends one _entities request for refs, preserving order, and
+// returns the raw entity list.
+func (e *Executor) callEntities(
+	ctx context.Context,
+	step *planner.Step,
+	refs []entityRef,
+	headers map[string]string,
+) ([]any, []GQLError) {
+	em := step.Meta.Entity
+
+	representations := make([]map[string]any, 0, len(refs))
+	for _, ref := range refs {
+		rep := map[string]any{"__typename": em.TypeName}
+		for _, kf := range em.KeyFields {
+			rep[kf] = ref.obj[kf]
+		}
+		representations = append(representations, rep)
+	}
+
+	vars := map[string]any{"representations": representations}
+	raw, errs, err := e.callStep(ctx, step, headers, vars)
+	if err != nil {
+		return nil, []GQLError{{Message: fmt.Sprintf("entity step %s: %s", step.ServiceName, err)}}
+	}
+
+	entities, _ := raw["_entities"].([]any)
+	return entities, errs
+}
+
 // executeJoinStep performs a stitching in-memory join by calling the target
 // service once per parent object and inserting the result in-place.
 func (e *Executor) executeJoinStep(
@@ -226,13 +392,16 @@ func (e *Executor) executeJoinStep(
 }
 
 // callStep makes the upstream HTTP call for one plan step.
-// extraVars are merged on top of step.Variables.
+// headers are the client's forwarded headers; the step's header rules are
+// applied here. extraVars are merged on top of step.Variables.
 func (e *Executor) callStep(
 	ctx context.Context,
 	step *planner.Step,
 	headers map[string]string,
 	extraVars map[string]any,
 ) (map[string]any, []GQLError, error) {
+	headers = upstreamHeaders(ctx, step, headers)
+
 	vars := step.Variables
 	if len(extraVars) > 0 {
 		merged := make(map[string]any, len(vars)+len(extraVars))
@@ -252,27 +421,59 @@ func (e *Executor) callStep(
 		zap.String("kind", string(step.Meta.Kind)),
 	)
 
-	start := timeNow()
-	resp, err := callUpstream(ctx, e.log, step.ServiceURL, headers, step.Query, vars,
-		step.RetryCount, step.TimeoutMs)
-	elapsed := timeNow().Sub(start).Milliseconds()
-
-	if err != nil {
+	// call makes the request and reports it to the breaker, once per request
+	// however many callers share it.
+	call := func(ctx context.Context) (*upstreamResponse, error) {
+		start := timeNow()
+		resp, err := callUpstream(ctx, e.log, step.ServiceURL, headers, step.Query, vars, callOptions{
+			retryCount:    step.RetryCount,
+			timeoutMs:     step.TimeoutMs,
+			maxResponseKB: step.MaxResponseKB,
+			policy:        step.RetryPolicy,
+			budget:        e.retryBudget(step.ServiceName),
+			uploads:       step.Uploads,
+			encoding:      step.Encoding,
+		})
 		if e.circuit != nil {
-			e.circuit.RecordFailure(step.ServiceName, err.Error())
+			if err != nil {
+				e.circuit.RecordFailure(step.ServiceName, err.Error())
+			} else {
+				e.circuit.RecordSuccess(step.ServiceName, timeNow().Sub(start).Milliseconds())
+			}
 		}
+		return resp, err
+	}
+
+	var (
+		resp   *upstreamResponse
+		err    error
+		shared bool
+	)
+	if step.Dedupe != nil {
+		resp, err, shared = e.flights.do(ctx, dedupeKey(step, headers, vars), call)
+	} else {
+		resp, err = call(ctx)
+	}
+	if shared {
+		e.log.Debug("shared in-flight upstream call", zap.String("service", step.ServiceName))
+	}
+	if err != nil {
 		return nil, nil, err
 	}
-	if e.circuit != nil {
-		e.circuit.RecordSuccess(step.ServiceName, elapsed)
+	header := resp.header
+	if shared && header.Get("Set-Cookie") != "" {
+		// Cookies were set for the caller that made the request; they are
+		// never handed to the callers that joined it.
+		header = header.Clone()
+		header.Del("Set-Cookie")
 	}
+	recordResponseHeaders(ctx, step, header)
 
-	var data map[string]any
-	if len(resp.Data) > 0 && string(resp.Data) != "null" {
-		if err := json.Unmarshal(resp.Data, &data); err != nil {
-			return nil, resp.Errors, fmt.Errorf("unmarshal data from %s: %w", step.ServiceName, err)
-		}
+	data := resp.Data
+	applyRowFilters(data, step.RowFilters)
+	errs := resp.Errors
+	if len(step.Denied) > 0 {
+		errs = append(errs[:len(errs):len(errs)], applyDenied(data, step.Denied)...)
 	}
-
-	return data, resp.Errors, nil
+	return data, errs, nil
 }
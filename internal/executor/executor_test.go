@@ -0,0 +1,888 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/auth"
+	"github.com/deformal/kastql/internal/compress"
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// waitForFollowers makes flightJoined count callers joining an in-flight
+// call and returns a function that blocks until n have joined.
+func waitForFollowers(t *testing.T, n int) func() {
+	t.Helper()
+	var joined sync.WaitGroup
+	joined.Add(n)
+	flightJoined = joined.Done
+	t.Cleanup(func() { flightJoined = func() {} })
+	return joined.Wait
+}
+
+func TestDedupeSharesConcurrentCalls(t *testing.T) {
+	var calls atomic.Int32
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(`{"data":{"users":[{"id":"1"}]}}`))
+	}))
+	defer srv.Close()
+	followersJoined := waitForFollowers(t, 4)
+
+	e := New(zap.NewNop())
+	step := &planner.Step{
+		ID:          "step_1",
+		ServiceName: "users-svc",
+		ServiceURL:  srv.URL,
+		Query:       "query { users { id } }",
+		Dedupe:      &planner.DedupePolicy{Enabled: true},
+		Meta:        planner.StepMeta{Kind: planner.StepKindRoot},
+	}
+	headers := map[string]string{"Authorization": "Bearer a"}
+
+	var wg sync.WaitGroup
+	results := make([]map[string]any, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _, err := e.callStep(context.Background(), step, headers, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = data
+		}(i)
+	}
+	// Let every caller join the in-flight request before it completes.
+	<-arrived
+	followersJoined()
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 upstream call, got %d", n)
+	}
+	for i, data := range results {
+		if _, ok := data["users"]; !ok {
+			t.Errorf("caller %d: expected users in data, got %v", i, data)
+		}
+	}
+	results[0]["users"] = nil
+	if results[1]["users"] == nil {
+		t.Error("expected every caller to get its own copy of a shared response")
+	}
+}
+
+func TestDedupeSurvivesLeaderCancel(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(`{"data":{"users":[{"id":"1"}]}}`))
+	}))
+	defer srv.Close()
+	followerJoined := waitForFollowers(t, 1)
+
+	e := New(zap.NewNop())
+	step := &planner.Step{
+		ID:          "step_1",
+		ServiceName: "users-svc",
+		ServiceURL:  srv.URL,
+		Query:       "query { users { id } }",
+		Dedupe:      &planner.DedupePolicy{Enabled: true},
+		Meta:        planner.StepMeta{Kind: planner.StepKindRoot},
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, _, err := e.callStep(leaderCtx, step, nil, nil)
+		leaderErr <- err
+	}()
+	<-arrived
+
+	followerData := make(chan map[string]any, 1)
+	go func() {
+		data, _, err := e.callStep(context.Background(), step, nil, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		followerData <- data
+	}()
+	followerJoined()
+
+	// The leader's client disconnects before the upstream answers.
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the leader to stop with context.Canceled, got %v", err)
+	}
+	close(release)
+	if data := <-followerData; data["users"] == nil {
+		t.Errorf("expected the follower to get the shared response, got %v", data)
+	}
+}
+
+func TestDedupeKeyHeaders(t *testing.T) {
+	step := &planner.Step{
+		ServiceURL: "http://users/graphql",
+		Query:      "query { me { id } }",
+		Dedupe:     &planner.DedupePolicy{Enabled: true},
+	}
+	a := dedupeKey(step, map[string]string{"Authorization": "Bearer a", "X-Request-Id": "1"}, nil)
+	b := dedupeKey(step, map[string]string{"authorization": "Bearer a", "X-Request-Id": "2"}, nil)
+	c := dedupeKey(step, map[string]string{"Authorization": "Bearer b"}, nil)
+
+	if a != b {
+		t.Error("expected non-key headers to be ignored")
+	}
+	if a == c {
+		t.Error("expected different Authorization values to produce different keys")
+	}
+}
+
+func TestDedupeSeparatesInjectedIdentities(t *testing.T) {
+	var calls atomic.Int32
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		arrived <- struct{}{}
+		<-release
+		id := r.Header.Get("X-User-Id")
+		w.Header().Set("Set-Cookie", "session="+id)
+		fmt.Fprintf(w, `{"data":{"me":{"id":%q}}}`, id)
+	}))
+	defer srv.Close()
+	followerJoined := waitForFollowers(t, 1)
+
+	// The service never sees Authorization; callers are told apart only by
+	// the user ID injected from their claims.
+	e := New(zap.NewNop())
+	step := &planner.Step{
+		ID:          "step_1",
+		ServiceName: "users-svc",
+		ServiceURL:  srv.URL,
+		Query:       "query { me { id } }",
+		Dedupe:      &planner.DedupePolicy{Enabled: true},
+		Meta:        planner.StepMeta{Kind: planner.StepKindRoot},
+		HeaderRules: planner.HeaderRules{
+			Deny:       []string{"Authorization"},
+			FromClaims: map[string]string{"X-User-Id": "sub"},
+			Response:   []string{"Set-Cookie"},
+		},
+	}
+	plan := &planner.QueryPlan{Steps: []*planner.Step{step}}
+
+	type result struct {
+		id     any
+		cookie string
+	}
+	call := func(sub string, out chan<- result) {
+		ctx := auth.SetClaims(context.Background(), map[string]any{"sub": sub})
+		ctx, rh := withResponseHeaders(ctx, plan)
+		data, _, err := e.callStep(ctx, step, map[string]string{"Authorization": "Bearer shared"}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		me, _ := data["me"].(map[string]any)
+		out <- result{id: me["id"], cookie: rh.merged().Get("Set-Cookie")}
+	}
+
+	alice, bob, aliceAgain := make(chan result, 1), make(chan result, 1), make(chan result, 1)
+	go call("alice", alice)
+	go call("bob", bob)
+	<-arrived
+	<-arrived
+	go call("alice", aliceAgain)
+	followerJoined()
+	close(release)
+
+	if r := <-alice; r.id != "alice" || r.cookie != "session=alice" {
+		t.Errorf("alice: got %+v", r)
+	}
+	if r := <-bob; r.id != "bob" || r.cookie != "session=bob" {
+		t.Errorf("bob: got %+v", r)
+	}
+	if r := <-aliceAgain; r.id != "alice" || r.cookie != "" {
+		t.Errorf("joined caller: expected alice's data without her cookie, got %+v", r)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected one upstream call per user, got %d", n)
+	}
+}
+
+func TestEntityCacheAcrossSteps(t *testing.T) {
+	var reps atomic.Int32
+	var calls atomic.Int32
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req upstreamRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		list, _ := req.Variables["representations"].([]any)
+		reps.Add(int32(len(list)))
+		out := make([]any, len(list))
+		for i := range list {
+			out[i] = map[string]any{"name": "Ada"}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"_entities": out}})
+	}))
+	defer users.Close()
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{
+			"orders":[{"user":{"id":"1"}},{"user":{"id":"1"}}],
+			"reviews":[{"author":{"id":"1"}}]
+		}}`))
+	}))
+	defer orders.Close()
+
+	entityStep := func(id string, path []string) *planner.Step {
+		em := &planner.EntityMeta{
+			TypeName:  "User",
+			KeyFields: []string{"id"},
+			Fields:    []planner.EntityField{{ResponseKey: "name", Selection: "    name\n"}},
+		}
+		return &planner.Step{
+			ID:          id,
+			ServiceName: "users-svc",
+			ServiceURL:  users.URL,
+			Query:       em.QueryFor(em.Fields),
+			DependsOn:   []string{"root"},
+			MergePath:   path,
+			Meta:        planner.StepMeta{Kind: planner.StepKindEntity, Entity: em},
+		}
+	}
+	plan := &planner.QueryPlan{Steps: []*planner.Step{
+		{ID: "root", ServiceName: "orders-svc", ServiceURL: orders.URL, Meta: planner.StepMeta{Kind: planner.StepKindRoot}},
+		entityStep("e1", []string{"orders", "user"}),
+		entityStep("e2", []string{"reviews", "author"}),
+	}}
+
+	res, err := New(zap.NewNop()).Execute(context.Background(), plan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 _entities call, got %d", n)
+	}
+	if n := reps.Load(); n != 1 {
+		t.Errorf("expected 1 representation, got %d", n)
+	}
+	author := res.Data["reviews"].([]any)[0].(map[string]any)["author"].(map[string]any)
+	if author["name"] != "Ada" {
+		t.Errorf("expected cached name on review author, got %v", author)
+	}
+	user := res.Data["orders"].([]any)[1].(map[string]any)["user"].(map[string]any)
+	if user["name"] != "Ada" {
+		t.Errorf("expected name on every order user, got %v", user)
+	}
+}
+
+func TestEntityCacheFillCopies(t *testing.T) {
+	em := &planner.EntityMeta{TypeName: "User", KeyFields: []string{"id"}}
+	fields := []planner.EntityField{{ResponseKey: "profile", Selection: "profile { bio }"}}
+	c := newEntityCache()
+	key := entityCacheKey(em, map[string]any{"id": "1"})
+	c.store(key, fields, map[string]any{"profile": map[string]any{"bio": "hi"}})
+
+	a := map[string]any{"id": "1"}
+	b := map[string]any{"id": "1"}
+	c.fill(key, fields, a)
+	c.fill(key, fields, b)
+	a["profile"].(map[string]any)["bio"] = nil // e.g. a row filter on one position
+
+	if b["profile"].(map[string]any)["bio"] != "hi" {
+		t.Errorf("expected positions filled from the cache not to share values, got %v", b)
+	}
+	if a["id"] != "1" {
+		t.Errorf("expected fill to keep existing fields, got %v", a)
+	}
+}
+
+func TestUpstreamHeaderRules(t *testing.T) {
+	step := &planner.Step{
+		StaticHeaders: map[string]string{"X-Service-Key": "k"},
+		HeaderRules: planner.HeaderRules{
+			Deny:       []string{"cookie"},
+			Rename:     map[string]string{"x-tenant": "X-Org-Id"},
+			FromClaims: map[string]string{"X-User-Id": "sub", "X-Account": "account"},
+			FromRole:   "X-Role",
+		},
+	}
+	ctx := auth.SetClaims(context.Background(), map[string]any{"sub": float64(1234567)})
+	ctx = auth.SetRole(ctx, "user")
+
+	got := upstreamHeaders(ctx, step, map[string]string{
+		"Cookie":    "session=1",
+		"X-Tenant":  "acme",
+		"X-User-Id": "spoofed",
+		"X-Account": "spoofed",
+		"X-Role":    "admin",
+	})
+	want := map[string]string{
+		"X-Org-Id":      "acme",
+		"X-Service-Key": "k",
+		"X-User-Id":     "1234567",
+		"X-Role":        "user",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestResponseHeaderMerge(t *testing.T) {
+	upstream := func(h http.Header) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, vs := range h {
+				w.Header()[k] = vs
+			}
+			w.Write([]byte(`{"data":{}}`))
+		}))
+	}
+	a := upstream(http.Header{
+		"Set-Cookie":    {"a=1"},
+		"Cache-Control": {"public, max-age=600"},
+		"X-Version":     {"a"},
+		"X-Internal":    {"secret"},
+	})
+	defer a.Close()
+	b := upstream(http.Header{
+		"Set-Cookie":    {"b=2"},
+		"Cache-Control": {"private, max-age=60"},
+		"X-Version":     {"b"},
+	})
+	defer b.Close()
+
+	rules := planner.HeaderRules{Response: []string{"Set-Cookie", "Cache-Control", "X-Version"}}
+	plan := &planner.QueryPlan{Steps: []*planner.Step{
+		{ID: "a", ServiceName: "a", ServiceURL: a.URL, HeaderRules: rules},
+		{ID: "b", ServiceName: "b", ServiceURL: b.URL, HeaderRules: rules},
+	}}
+
+	res, err := New(zap.NewNop()).Execute(context.Background(), plan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Headers.Values("Set-Cookie"); len(got) != 2 {
+		t.Errorf("expected both cookies appended, got %v", got)
+	}
+	if got := res.Headers.Get("Cache-Control"); got != "private, max-age=60" {
+		t.Errorf("expected most restrictive Cache-Control, got %q", got)
+	}
+	if got := res.Headers.Get("X-Version"); got != "a" {
+		t.Errorf("expected first X-Version in plan order, got %q", got)
+	}
+	if got := res.Headers.Get("X-Internal"); got != "" {
+		t.Errorf("expected unlisted header to be dropped, got %q", got)
+	}
+}
+
+func TestCacheControlMerge(t *testing.T) {
+	cases := []struct {
+		name     string
+		services []string // each service's Cache-Control; "" = not sent
+		want     string
+	}{
+		{"smallest max-age", []string{"public, max-age=600", "public, max-age=60"}, "public, max-age=60"},
+		{"private beats public", []string{"public, s-maxage=600", "private, max-age=60"}, "private, max-age=60"},
+		{"no-store wins", []string{"public, max-age=60", "no-store"}, "no-store"},
+		{"one service silent", []string{"public, max-age=60", ""}, ""},
+		{"only service silent", []string{""}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := &planner.QueryPlan{}
+			rules := planner.HeaderRules{Response: []string{"Cache-Control"}}
+			for i := range tc.services {
+				plan.Steps = append(plan.Steps, &planner.Step{ID: fmt.Sprint(i), HeaderRules: rules})
+			}
+			ctx, rh := withResponseHeaders(context.Background(), plan)
+			for i, cc := range tc.services {
+				header := http.Header{}
+				if cc != "" {
+					header.Set("Cache-Control", cc)
+				}
+				recordResponseHeaders(ctx, plan.Steps[i], header)
+			}
+			if got := rh.merged().Get("Cache-Control"); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamResponseTooLarge(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"data":{"users":[`))
+		for i := 0; i < 200; i++ {
+			w.Write([]byte(`{"id":"0123456789"},`))
+			w.(http.Flusher).Flush() // chunked: no Content-Length to reject up front
+		}
+		w.Write([]byte(`{"id":"last"}]}}`))
+	}))
+	defer srv.Close()
+
+	step := &planner.Step{
+		ServiceName:   "users-svc",
+		ServiceURL:    srv.URL,
+		RetryCount:    2,
+		MaxResponseKB: 1,
+		RetryPolicy:   planner.RetryPolicy{RetryOn: []string{"network"}},
+	}
+	_, _, err := New(zap.NewNop()).callStep(context.Background(), step, nil, nil)
+	var tooLarge *upstreamTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected upstreamTooLargeError, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected oversized response not to be retried, got %d calls", n)
+	}
+}
+
+func TestDecodeUpstreamBody(t *testing.T) {
+	body := `{"data":{"orders":[{"id":"1","tags":["a"]},{"id":"2","tags":[]}],"count":2,"me":null},` +
+		`"extensions":{"cost":1},"errors":[{"message":"partial","path":["orders",1]}]}` + "\n"
+	resp, n, err := decodeUpstreamBody(strings.NewReader(body), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(body)) {
+		t.Errorf("expected %d bytes read, got %d", len(body), n)
+	}
+	got, _ := json.Marshal(resp.Data)
+	if want := `{"count":2,"me":null,"orders":[{"id":"1","tags":["a"]},{"id":"2","tags":[]}]}`; string(got) != want {
+		t.Errorf("data: got %s, want %s", got, want)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != "partial" {
+		t.Errorf("errors: got %+v", resp.Errors)
+	}
+
+	for _, bad := range []string{`[]`, `{"data":[1]}`, `{"data":{}} {}`, `{"data":{"a":[1,}}`} {
+		if _, _, err := decodeUpstreamBody(strings.NewReader(bad), 1024); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+	if _, _, err := decodeUpstreamBody(strings.NewReader(body), 64); !errors.Is(err, errBodyTooLarge) {
+		t.Errorf("expected errBodyTooLarge, got %v", err)
+	}
+}
+
+// largeListResponse is an upstream body with n list items.
+func largeListResponse(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"data":{"orders":[`)
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":"%d","total":%d.5,"status":"SHIPPED","user":{"id":"u%d"}}`, i, i, i%100)
+	}
+	b.WriteString(`]}}`)
+	return b.Bytes()
+}
+
+// BenchmarkDecodeUpstreamBuffered measures the previous decode path: read the
+// whole body, decode into json.RawMessage, then decode data again. Compare
+// its B/op with BenchmarkDecodeUpstreamStreaming, which never holds the body.
+func BenchmarkDecodeUpstreamBuffered(b *testing.B) {
+	body := largeListResponse(10_000)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for b.Loop() {
+		raw, err := io.ReadAll(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var resp struct {
+			Data   json.RawMessage `json:"data"`
+			Errors []GQLError      `json:"errors"`
+		}
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			b.Fatal(err)
+		}
+		var data map[string]any
+		if err := json.Unmarshal(resp.Data, &data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeUpstreamStreaming(b *testing.B) {
+	body := largeListResponse(10_000)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := decodeUpstreamBody(bytes.NewReader(body), defaultMaxResponseKB*1024); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMutationStepsRunSerially(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	var inFlight atomic.Int32
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if inFlight.Add(1) > 1 {
+				t.Errorf("%s: mutation steps overlapped", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			inFlight.Add(-1)
+			w.Write([]byte(`{"data":{}}`))
+		}))
+	}
+	users, orders := upstream("users"), upstream("orders")
+	defer users.Close()
+	defer orders.Close()
+
+	plan := &planner.QueryPlan{OperationType: "mutation", Steps: []*planner.Step{
+		{ID: "1", ServiceName: "users-svc", ServiceURL: users.URL},
+		{ID: "2", ServiceName: "orders-svc", ServiceURL: orders.URL},
+		{ID: "3", ServiceName: "users-svc", ServiceURL: users.URL},
+	}}
+	if _, err := New(zap.NewNop()).Execute(context.Background(), plan, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"users", "orders", "users"}
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("expected call order %v, got %v", want, order)
+		}
+	}
+}
+
+func TestExecuteIncremental(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"_entities":[{"name":"Ada"},{"name":"Bob"}]}}`))
+	}))
+	defer users.Close()
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"orders":[{"id":"o1","user":{"id":"1"}},{"id":"o2","user":{"id":"2"}}]}}`))
+	}))
+	defer orders.Close()
+
+	em := &planner.EntityMeta{
+		TypeName:  "User",
+		KeyFields: []string{"id"},
+		Fields:    []planner.EntityField{{ResponseKey: "name", Selection: "    name\n"}},
+	}
+	plan := &planner.QueryPlan{
+		Steps: []*planner.Step{
+			{ID: "root", ServiceName: "orders-svc", ServiceURL: orders.URL, Meta: planner.StepMeta{Kind: planner.StepKindRoot}},
+			{
+				ID:          "users",
+				ServiceName: "users-svc",
+				ServiceURL:  users.URL,
+				Query:       em.QueryFor(em.Fields),
+				DependsOn:   []string{"root"},
+				MergePath:   []string{"orders", "user"},
+				Meta: planner.StepMeta{
+					Kind:   planner.StepKindEntity,
+					Entity: em,
+					Defer:  &planner.DeferMeta{Label: "buyer"},
+				},
+			},
+		},
+		Streams: []planner.StreamMeta{{Path: []string{"orders"}, InitialCount: 1}},
+	}
+
+	var payloads []string
+	err := New(zap.NewNop()).ExecuteIncremental(context.Background(), plan, nil, func(p *Payload) error {
+		b, _ := json.Marshal(p)
+		payloads = append(payloads, string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`{"data":{"orders":[{"id":"o1","user":{"id":"1"}}]},"hasNext":true}`,
+		`{"incremental":[{"items":[{"id":"o2","user":{"id":"2"}}],"path":["orders",1]}],"hasNext":true}`,
+		`{"incremental":[{"data":{"name":"Ada"},"path":["orders",0,"user"],"label":"buyer"},` +
+			`{"data":{"name":"Bob"},"path":["orders",1,"user"],"label":"buyer"}],"hasNext":false}`,
+	}
+	if len(payloads) != len(want) {
+		t.Fatalf("expected %d payloads, got %d: %v", len(want), len(payloads), payloads)
+	}
+	for i := range want {
+		if payloads[i] != want[i] {
+			t.Errorf("payload %d:\n got  %s\n want %s", i, payloads[i], want[i])
+		}
+	}
+}
+
+func TestUploadsSentAsMultipart(t *testing.T) {
+	// Build a file header the way the router receives one from a client.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("0", "a.txt")
+	fw.Write([]byte("hello upload"))
+	mw.Close()
+	form, err := multipart.NewReader(&body, mw.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer form.RemoveAll()
+	upload := &planner.Upload{File: form.File["0"][0]}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse multipart: %v", err)
+			return
+		}
+		if got := r.FormValue("operations"); got != `{"query":"mutation($file: Upload!) { upload(file: $file) }","variables":{"file":null}}` {
+			t.Errorf("operations = %s", got)
+		}
+		if got := r.FormValue("map"); got != `{"0":["variables.file"]}` {
+			t.Errorf("map = %s", got)
+		}
+		f, _, err := r.FormFile("0")
+		if err != nil {
+			t.Errorf("file: %v", err)
+			return
+		}
+		content, _ := io.ReadAll(f)
+		if string(content) != "hello upload" {
+			t.Errorf("file content = %q", content)
+		}
+		w.Write([]byte(`{"data":{"upload":"ok"}}`))
+	}))
+	defer srv.Close()
+
+	step := &planner.Step{
+		ServiceName: "files-svc",
+		ServiceURL:  srv.URL,
+		Query:       "mutation($file: Upload!) { upload(file: $file) }",
+		Variables:   map[string]any{"file": upload},
+		Uploads:     []planner.StepUpload{{Path: "variables.file", Upload: upload}},
+	}
+	data, _, err := New(zap.NewNop()).callStep(context.Background(), step, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["upload"] != "ok" {
+		t.Errorf("unexpected data: %v", data)
+	}
+}
+
+func TestUpstreamCompression(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ce := r.Header.Get("Content-Encoding"); ce != compress.Gzip {
+			t.Errorf("request Content-Encoding = %q", ce)
+		}
+		body, err := compress.NewReader(r.Header.Get("Content-Encoding"), r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req upstreamRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil || req.Query != "{ users { id } }" {
+			t.Errorf("unexpected request %+v: %v", req, err)
+		}
+
+		out, _ := compress.Encode(compress.Brotli, []byte(`{"data":{"users":[{"id":"1"}]}}`))
+		w.Header().Set("Content-Encoding", compress.Brotli)
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	step := &planner.Step{
+		ServiceName: "users-svc",
+		ServiceURL:  srv.URL,
+		Query:       "{ users { id } }",
+		Encoding:    compress.Gzip,
+	}
+	data, _, err := New(zap.NewNop()).callStep(context.Background(), step, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := data["users"].([]any); len(users) != 1 {
+		t.Errorf("unexpected data: %v", data)
+	}
+}
+
+func TestRowFiltersApplied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{
+			"orders":[{"id":"1","kastql_cond_userId":"7"},{"id":"2","kastql_cond_userId":"8"}],
+			"latest":{"id":"2","kastql_cond_userId":"8"}
+		}}`))
+	}))
+	defer upstream.Close()
+
+	cond := map[string]any{"userId": map[string]any{"_eq": "7"}}
+	fields := []string{"kastql_cond_userId"}
+	plan := &planner.QueryPlan{OperationType: "query", Steps: []*planner.Step{{
+		ID: "1", ServiceName: "orders-svc", ServiceURL: upstream.URL,
+		RowFilters: []planner.RowFilter{
+			{Path: []string{"orders"}, Condition: cond, Fields: fields},
+			{Path: []string{"latest"}, Condition: cond, Fields: fields},
+		},
+	}}}
+	result, err := New(zap.NewNop()).Execute(context.Background(), plan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(result.Data)
+	if want := `{"latest":null,"orders":[{"id":"1"}]}`; string(got) != want {
+		t.Errorf("data = %s, want %s", got, want)
+	}
+}
+
+func TestDeniedFieldsNulled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"users":[{"id":"1"},{"id":"2"}],"me":{"kastql_denied":"User"}}}`))
+	}))
+	defer upstream.Close()
+
+	msg := "permission denied"
+	plan := &planner.QueryPlan{
+		OperationType: "query",
+		Steps: []*planner.Step{{
+			ID: "1", ServiceName: "users-svc", ServiceURL: upstream.URL,
+			Denied: []planner.DeniedField{
+				{Path: []string{"users", "email"}, Message: msg},
+				{Path: []string{"me", "email"}, NullPath: []string{"me"}, Message: msg}, // non-null email
+			},
+		}},
+		Denied: []planner.DeniedField{{Path: []string{"secrets"}, Message: msg}},
+	}
+	result, err := New(zap.NewNop()).Execute(context.Background(), plan, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(result.Data)
+	if want := `{"me":null,"secrets":null,"users":[{"email":null,"id":"1"},{"email":null,"id":"2"}]}`; string(got) != want {
+		t.Errorf("data = %s, want %s", got, want)
+	}
+	var paths []string
+	for _, e := range result.Errors {
+		if e.Extensions["code"] != "FORBIDDEN" {
+			t.Errorf("error %q: extensions = %v, want code FORBIDDEN", e.Message, e.Extensions)
+		}
+		p, _ := json.Marshal(e.Path)
+		paths = append(paths, string(p))
+	}
+	if want := []string{`["users",0,"email"]`, `["users",1,"email"]`, `["me","email"]`, `["secrets"]`}; !slices.Equal(paths, want) {
+		t.Errorf("error paths = %v, want %v", paths, want)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := planner.RetryPolicy{BaseBackoffMs: 100, MaxBackoffMs: 1000, NoJitter: true}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second, // capped
+		9: time.Second,
+	} {
+		if got := retryBackoff(policy, attempt); got != want {
+			t.Errorf("attempt %d: got %v, want %v", attempt, got, want)
+		}
+	}
+
+	policy.NoJitter = false
+	for range 100 {
+		if got := retryBackoff(policy, 3); got < 0 || got > 400*time.Millisecond {
+			t.Fatalf("jittered backoff %v outside [0, 400ms]", got)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	policy := planner.RetryPolicy{BudgetRatio: 0.2, BudgetMinRetries: 1}
+	b := &retryBudget{}
+	for range 10 {
+		b.recordRequest()
+	}
+	allowed := 0
+	for range 10 {
+		if b.allowRetry(policy) {
+			allowed++
+		}
+	}
+	if allowed != 3 { // 1 + 0.2·10
+		t.Errorf("expected 3 retries allowed, got %d", allowed)
+	}
+
+	// A new window starts with a fresh budget.
+	now = now.Add(retryBudgetWindow)
+	if !b.allowRetry(policy) {
+		t.Error("expected a retry to be allowed in the next window")
+	}
+	if !(&retryBudget{}).allowRetry(planner.RetryPolicy{}) {
+		t.Error("expected an unlimited budget without budget_ratio")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	ctx := context.Background()
+	refused := &url.Error{Op: "Post", URL: "http://x", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	timeout := &url.Error{Op: "Post", URL: "http://x", Err: context.DeadlineExceeded}
+	badJSON := fmt.Errorf("decode response from http://x: %w", &json.SyntaxError{})
+
+	for _, tc := range []struct {
+		name    string
+		retryOn []string
+		err     error
+		want    bool
+	}{
+		{"5xx", nil, &upstreamHTTPError{status: 503}, true},
+		{"4xx not by default", nil, &upstreamClientError{status: 404}, false},
+		{"429 listed", []string{"429"}, &upstreamClientError{status: 429}, true},
+		{"network", nil, refused, true},
+		{"decode failure", nil, badJSON, false},
+		{"timeout not by default", nil, timeout, false},
+		{"timeout listed", []string{"timeout"}, timeout, true},
+		{"too large", []string{"5xx", "network", "timeout"}, &upstreamTooLargeError{}, false},
+	} {
+		policy := planner.RetryPolicy{RetryOn: tc.retryOn}
+		if got := isRetryable(ctx, policy, tc.err); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if isRetryable(cancelled, planner.RetryPolicy{}, refused) {
+		t.Error("expected nothing to be retried once the caller has gone")
+	}
+}
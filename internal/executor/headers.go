@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/deformal/kastql/internal/auth"
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// upstreamHeaders builds the headers for one step from the client's forwarded
+// headers, the service's static headers and its propagation rules. The role
+// and JWT claims come from the request context populated by auth.Middleware.
+func upstreamHeaders(ctx context.Context, step *planner.Step, client map[string]string) map[string]string {
+	rules := step.HeaderRules
+	allow := headerSet(rules.Allow)
+	deny := headerSet(rules.Deny)
+	rename := make(map[string]string, len(rules.Rename))
+	for from, to := range rules.Rename {
+		rename[http.CanonicalHeaderKey(from)] = to
+	}
+
+	out := make(map[string]string, len(client)+len(step.StaticHeaders))
+	for name, v := range client {
+		name = http.CanonicalHeaderKey(name)
+		if deny[name] || (len(allow) > 0 && !allow[name]) {
+			continue
+		}
+		if to, ok := rename[name]; ok {
+			name = http.CanonicalHeaderKey(to)
+		}
+		out[name] = v
+	}
+
+	for name, v := range step.StaticHeaders {
+		out[http.CanonicalHeaderKey(name)] = v
+	}
+	for name, v := range rules.Static {
+		out[http.CanonicalHeaderKey(name)] = v
+	}
+
+	// Injected identity headers always replace client-supplied values so a
+	// client cannot spoof them; a missing claim removes the header entirely.
+	if len(rules.FromClaims) > 0 {
+		claims := auth.GetClaims(ctx)
+		for name, claim := range rules.FromClaims {
+			name = http.CanonicalHeaderKey(name)
+			if v, ok := claimString(claims[claim]); ok {
+				out[name] = v
+			} else {
+				delete(out, name)
+			}
+		}
+	}
+	if rules.FromRole != "" {
+		name := http.CanonicalHeaderKey(rules.FromRole)
+		if role := auth.GetRole(ctx); role != "" {
+			out[name] = role
+		} else {
+			delete(out, name)
+		}
+	}
+	return out
+}
+
+// claimString renders a scalar claim as a header value. JSON numbers arrive
+// as float64 and are printed without exponent notation.
+func claimString(v any) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(t), true
+	}
+}
+
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[http.CanonicalHeaderKey(n)] = true
+	}
+	return set
+}
@@ -0,0 +1,132 @@
+package executor
+
+import (
+	"context"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// deliverIncremental emits the initial payload, then the @stream items that
+// were cut from it, then one payload per deferred step in plan order.
+func (e *Executor) deliverIncremental(
+	ctx context.Context,
+	plan *planner.QueryPlan,
+	initial *Result,
+	deferred []*planner.Step,
+	stepData map[string]map[string]any,
+	headers map[string]string,
+	entities *entityCache,
+	emit func(*Payload) error,
+) error {
+	first := *initial
+	var streamed []Incremental
+	if len(plan.Streams) > 0 {
+		// Cut lists on a copy: deferred steps still write into the original
+		// tree, including into items that are only delivered by a stream.
+		first.Data = cloneData(initial.Data)
+		streamed = splitStreams(first.Data, plan.Streams)
+	}
+
+	if err := emit(&Payload{Result: &first, HasNext: len(streamed) > 0 || len(deferred) > 0}); err != nil {
+		return err
+	}
+	if len(streamed) > 0 {
+		if err := emit(&Payload{Incremental: streamed, HasNext: len(deferred) > 0}); err != nil {
+			return err
+		}
+	}
+	for i, step := range deferred {
+		inc := e.runDeferred(ctx, step, stepData, headers, entities)
+		if err := emit(&Payload{Incremental: inc, HasNext: i < len(deferred)-1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDeferred executes one deferred step. A deferred root step delivers its
+// whole result at the root; a dependent step delivers the fields it added to
+// existing objects — entity fields on the objects at MergePath, or the joined
+// field on their containers — at each object's path.
+func (e *Executor) runDeferred(
+	ctx context.Context,
+	step *planner.Step,
+	stepData map[string]map[string]any,
+	headers map[string]string,
+	entities *entityCache,
+) []Incremental {
+	label := step.Meta.Defer.Label
+
+	if len(step.DependsOn) == 0 {
+		data, errs, err := e.callStep(ctx, step, headers, nil)
+		if err != nil {
+			return []Incremental{{Path: []any{}, Label: label, Errors: []GQLError{{Message: err.Error()}}}}
+		}
+		stepData[step.ID] = data
+		return []Incremental{{Data: data, Path: []any{}, Label: label, Errors: errs}}
+	}
+
+	parentData, ok := stepData[step.DependsOn[0]]
+	if !ok {
+		// Parent failed — its error was already reported.
+		return nil
+	}
+
+	targetPath := step.MergePath
+	if step.Meta.Kind == planner.StepKindJoin && len(targetPath) > 0 {
+		targetPath = targetPath[:len(targetPath)-1]
+	}
+	targets := locateObjects(parentData, targetPath)
+	before := make([]map[string]bool, len(targets))
+	for i, t := range targets {
+		before[i] = make(map[string]bool, len(t.obj))
+		for k := range t.obj {
+			before[i][k] = true
+		}
+	}
+
+	errs := e.runDependents(ctx, []*planner.Step{step}, stepData, headers, entities)
+
+	var out []Incremental
+	for i, t := range targets {
+		added := map[string]any{}
+		for k, v := range t.obj {
+			if !before[i][k] {
+				added[k] = v
+			}
+		}
+		if len(added) > 0 {
+			out = append(out, Incremental{Data: added, Path: t.path, Label: label})
+		}
+	}
+	if len(errs) > 0 {
+		if len(out) == 0 {
+			out = append(out, Incremental{Path: []any{}, Label: label})
+		}
+		out[0].Errors = errs
+	}
+	return out
+}
+
+// splitStreams cuts every @stream list in data to its initial count and
+// returns the remaining items as incremental payloads. Streams are processed
+// outermost first, so items of an outer stream keep their nested lists whole.
+func splitStreams(data map[string]any, streams []planner.StreamMeta) []Incremental {
+	var out []Incremental
+	for _, sm := range streams {
+		if len(sm.Path) == 0 {
+			continue
+		}
+		field := sm.Path[len(sm.Path)-1]
+		for _, c := range locateObjects(data, sm.Path[:len(sm.Path)-1]) {
+			list, ok := c.obj[field].([]any)
+			if !ok || len(list) <= sm.InitialCount {
+				continue
+			}
+			path := append(append([]any{}, c.path...), field, sm.InitialCount)
+			out = append(out, Incremental{Items: list[sm.InitialCount:], Path: path, Label: sm.Label})
+			c.obj[field] = list[:sm.InitialCount]
+		}
+	}
+	return out
+}
@@ -74,3 +74,36 @@ func mergeInto(dst, src map[string]any) {
 		dst[k] = v
 	}
 }
+
+// locatedObject is an object in a result tree together with its response
+// path, list indices included, as used by incremental payloads.
+type locatedObject struct {
+	obj  map[string]any
+	path []any
+}
+
+// locateObjects is gatherObjects that also records where each object is.
+func locateObjects(data map[string]any, path []string) []locatedObject {
+	return locateFrom(data, path, []any{})
+}
+
+func locateFrom(obj map[string]any, path []string, at []any) []locatedObject {
+	if len(path) == 0 {
+		return []locatedObject{{obj: obj, path: at}}
+	}
+	// Full slice expressions keep sibling paths from sharing a backing array.
+	next := append(at[:len(at):len(at)], path[0])
+	switch t := obj[path[0]].(type) {
+	case map[string]any:
+		return locateFrom(t, path[1:], next)
+	case []any:
+		var result []locatedObject
+		for i, elem := range t {
+			if m, ok := elem.(map[string]any); ok {
+				result = append(result, locateFrom(m, path[1:], append(next[:len(next):len(next)], i))...)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package executor
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+type responseHeadersKey struct{}
+
+// responseHeaders collects the upstream response headers selected by each
+// step's header rules during one Execute call. Entries are merged in plan
+// order, not completion order, so "first" and "last" are deterministic.
+type responseHeaders struct {
+	mu      sync.Mutex
+	order   map[string]int // step ID → position in the plan
+	entries []headerEntry
+}
+
+type headerEntry struct {
+	pos    int
+	name   string
+	values []string // nil when the service omitted a most_restrictive header
+	policy string
+}
+
+func withResponseHeaders(ctx context.Context, plan *planner.QueryPlan) (context.Context, *responseHeaders) {
+	rh := &responseHeaders{order: make(map[string]int, len(plan.Steps))}
+	for i, s := range plan.Steps {
+		rh.order[s.ID] = i
+	}
+	return context.WithValue(ctx, responseHeadersKey{}, rh), rh
+}
+
+// recordResponseHeaders stores the headers of one upstream response that the
+// step's rules pass back to the client. It is a no-op outside Execute.
+func recordResponseHeaders(ctx context.Context, step *planner.Step, header http.Header) {
+	rules := step.HeaderRules
+	if len(rules.Response) == 0 {
+		return
+	}
+	rh, _ := ctx.Value(responseHeadersKey{}).(*responseHeaders)
+	if rh == nil {
+		return
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	for _, name := range rules.Response {
+		name = http.CanonicalHeaderKey(name)
+		values := header.Values(name)
+		policy := rules.ResponseMergePolicy(name)
+		// A service that sends no Cache-Control has not said its data may be
+		// cached, so its omission still takes part in a restrictive merge.
+		if len(values) == 0 && policy != planner.MergeMostRestrictive {
+			continue
+		}
+		rh.entries = append(rh.entries, headerEntry{
+			pos:    rh.order[step.ID],
+			name:   name,
+			values: values,
+			policy: policy,
+		})
+	}
+}
+
+// merged combines the collected headers. The policy of the earliest service
+// in the plan that returned a header decides how it is merged. A
+// most_restrictive header is dropped when any service omitted it, leaving
+// the router's default rather than claiming the others' cacheability.
+func (rh *responseHeaders) merged() http.Header {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if len(rh.entries) == 0 {
+		return nil
+	}
+	entries := append([]headerEntry(nil), rh.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].pos < entries[j].pos })
+
+	byName := map[string][]headerEntry{}
+	omitted := map[string]bool{}
+	var names []string
+	for _, en := range entries {
+		if en.values == nil {
+			omitted[en.name] = true
+			continue
+		}
+		if _, ok := byName[en.name]; !ok {
+			names = append(names, en.name)
+		}
+		byName[en.name] = append(byName[en.name], en)
+	}
+
+	out := http.Header{}
+	for _, name := range names {
+		group := byName[name]
+		switch group[0].policy {
+		case planner.MergeLast:
+			out[name] = group[len(group)-1].values
+		case planner.MergeAppend:
+			for _, en := range group {
+				out[name] = append(out[name], en.values...)
+			}
+		case planner.MergeMostRestrictive:
+			if omitted[name] {
+				continue
+			}
+			var all []string
+			for _, en := range group {
+				all = append(all, en.values...)
+			}
+			if v := mostRestrictiveCacheControl(all); v != "" {
+				out.Set(name, v)
+			}
+		default:
+			out[name] = group[0].values
+		}
+	}
+	return out
+}
+
+// mostRestrictiveCacheControl merges Cache-Control values so the result is at
+// least as strict as each input: no-store wins outright, private beats public,
+// and max-age / s-maxage take the smallest value seen.
+func mostRestrictiveCacheControl(values []string) string {
+	var (
+		noCache, private, public, mustRevalidate bool
+		maxAge, sMaxAge                          = -1, -1
+	)
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			name, arg, _ := strings.Cut(d, "=")
+			switch name {
+			case "no-store":
+				return "no-store"
+			case "no-cache":
+				noCache = true
+			case "private":
+				private = true
+			case "public":
+				public = true
+			case "must-revalidate":
+				mustRevalidate = true
+			case "max-age":
+				maxAge = minAge(maxAge, arg)
+			case "s-maxage":
+				sMaxAge = minAge(sMaxAge, arg)
+			}
+		}
+	}
+
+	var out []string
+	if noCache {
+		out = append(out, "no-cache")
+	}
+	if private {
+		out = append(out, "private")
+	} else if public {
+		out = append(out, "public")
+	}
+	if maxAge >= 0 {
+		out = append(out, "max-age="+strconv.Itoa(maxAge))
+	}
+	if sMaxAge >= 0 && !private {
+		out = append(out, "s-maxage="+strconv.Itoa(sMaxAge))
+	}
+	if mustRevalidate {
+		out = append(out, "must-revalidate")
+	}
+	return strings.Join(out, ", ")
+}
+
+// minAge returns the smaller of cur and the parsed delta-seconds arg; cur < 0
+// means unset. An unparsable arg counts as 0, the strictest reading.
+func minAge(cur int, arg string) int {
+	n, err := strconv.Atoi(strings.Trim(arg, `"`))
+	if err != nil || n < 0 {
+		n = 0
+	}
+	if cur < 0 || n < cur {
+		return n
+	}
+	return cur
+}
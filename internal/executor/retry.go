@@ -0,0 +1,142 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+const (
+	defaultBaseBackoffMs = 100
+	defaultMaxBackoffMs  = 5_000
+
+	// retryBudgetWindow is the period over which requests and retries are
+	// counted for a service's retry budget.
+	retryBudgetWindow = 10 * time.Second
+)
+
+var defaultRetryOn = []string{"5xx", "network"}
+
+// retryBudget tracks how many calls and retries a service has seen in the
+// current window. Retries are refused once they exceed the policy's ratio of
+// calls, so a struggling upstream isn't hit with a retry storm.
+type retryBudget struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// recordRequest counts one first attempt against the budget.
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(timeNow())
+	b.requests++
+}
+
+// allowRetry reserves one retry if the budget has room for it.
+func (b *retryBudget) allowRetry(policy planner.RetryPolicy) bool {
+	if policy.BudgetRatio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(timeNow())
+	limit := policy.BudgetMinRetries + int(policy.BudgetRatio*float64(b.requests))
+	if b.retries >= limit {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// retryBackoff returns the delay before the given retry attempt (1-based).
+// With jitter enabled it is "full jitter": uniform in [0, min(max, base·2ⁿ⁻¹)].
+func retryBackoff(policy planner.RetryPolicy, attempt int) time.Duration {
+	base := policy.BaseBackoffMs
+	if base <= 0 {
+		base = defaultBaseBackoffMs
+	}
+	ceiling := policy.MaxBackoffMs
+	if ceiling <= 0 {
+		ceiling = defaultMaxBackoffMs
+	}
+
+	backoff := base
+	for i := 1; i < attempt && backoff < ceiling; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, ceiling)
+
+	if !policy.NoJitter {
+		backoff = rand.IntN(backoff + 1)
+	}
+	return time.Duration(backoff) * time.Millisecond
+}
+
+// isRetryable reports whether err matches one of the policy's retry_on
+// conditions. Cancellation of the parent context is never retryable.
+func isRetryable(ctx context.Context, policy planner.RetryPolicy, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	// An oversized response will be just as large on the next attempt.
+	var tooLarge *upstreamTooLargeError
+	if errors.As(err, &tooLarge) {
+		return false
+	}
+
+	conditions := policy.RetryOn
+	if len(conditions) == 0 {
+		conditions = defaultRetryOn
+	}
+
+	status := upstreamStatus(err)
+	timedOut := errors.Is(err, context.DeadlineExceeded)
+	// Only transport failures count as "network"; a response that fails to
+	// decode will fail the same way again.
+	var urlErr *url.Error
+	var netErr net.Error
+	network := errors.As(err, &urlErr) || errors.As(err, &netErr)
+	for _, cond := range conditions {
+		switch cond {
+		case "5xx":
+			if status >= 500 {
+				return true
+			}
+		case "4xx":
+			if status >= 400 && status < 500 {
+				return true
+			}
+		case "timeout":
+			if timedOut {
+				return true
+			}
+		case "network":
+			if network && !timedOut {
+				return true
+			}
+		default:
+			if code, _ := strconv.Atoi(cond); code != 0 && code == status {
+				return true
+			}
+		}
+	}
+	return false
+}
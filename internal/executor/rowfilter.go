@@ -0,0 +1,42 @@
+package executor
+
+import "github.com/deformal/kastql/internal/planner"
+
+// applyRowFilters enforces a step's row-level conditions on its data: list
+// elements that fail are dropped, single objects that fail become null, and
+// the fields selected only for the check are removed from what remains.
+func applyRowFilters(data map[string]any, filters []planner.RowFilter) {
+	for _, f := range filters {
+		if len(f.Path) == 0 {
+			continue
+		}
+		key := f.Path[len(f.Path)-1]
+		for _, parent := range gatherObjects(data, f.Path[:len(f.Path)-1]) {
+			switch v := parent[key].(type) {
+			case map[string]any:
+				if !planner.MatchCondition(f.Condition, v) {
+					parent[key] = nil
+					continue
+				}
+				stripFields(v, f.Fields)
+			case []any:
+				kept := make([]any, 0, len(v))
+				for _, elem := range v {
+					obj, ok := elem.(map[string]any)
+					if !ok || !planner.MatchCondition(f.Condition, obj) {
+						continue
+					}
+					stripFields(obj, f.Fields)
+					kept = append(kept, obj)
+				}
+				parent[key] = kept
+			}
+		}
+	}
+}
+
+func stripFields(obj map[string]any, fields []string) {
+	for _, k := range fields {
+		delete(obj, k)
+	}
+}
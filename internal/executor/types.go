@@ -1,9 +1,15 @@
 package executor
 
+import "net/http"
+
 // Result is the final merged GraphQL response.
 type Result struct {
 	Data   map[string]any `json:"data"`
 	Errors []GQLError     `json:"errors,omitempty"`
+
+	// Headers are the upstream response headers selected by each service's
+	// header rules, merged for the client response.
+	Headers http.Header `json:"-"`
 }
 
 // GQLError is a GraphQL-spec error object.
@@ -19,3 +25,21 @@ type ErrorLocation struct {
 	Line   int `json:"line"`
 	Column int `json:"column"`
 }
+
+// Payload is one part of an incremental (@defer / @stream) response. The
+// first payload carries the initial Result; later ones carry Incremental.
+type Payload struct {
+	*Result
+	Incremental []Incremental `json:"incremental,omitempty"`
+	HasNext     bool          `json:"hasNext"`
+}
+
+// Incremental is deferred fragment data or streamed list items delivered
+// after the initial payload, located by its response path.
+type Incremental struct {
+	Data   map[string]any `json:"data,omitempty"`
+	Items  []any          `json:"items,omitempty"`
+	Path   []any          `json:"path"`
+	Label  string         `json:"label,omitempty"`
+	Errors []GQLError     `json:"errors,omitempty"`
+}
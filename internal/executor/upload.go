@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// multipartBody streams a GraphQL multipart request to the upstream: the
+// operations JSON, the map from file field to variable path, then each file
+// copied straight from the client's upload. The returned content type
+// carries the boundary.
+func multipartBody(operations []byte, uploads []planner.StepUpload) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, operations, uploads))
+	}()
+	return pr, mw.FormDataContentType()
+}
+
+func writeMultipart(mw *multipart.Writer, operations []byte, uploads []planner.StepUpload) error {
+	if err := mw.WriteField("operations", string(operations)); err != nil {
+		return err
+	}
+	fileMap := make(map[string][]string, len(uploads))
+	for i, u := range uploads {
+		fileMap[strconv.Itoa(i)] = []string{u.Path}
+	}
+	m, err := json.Marshal(fileMap)
+	if err != nil {
+		return err
+	}
+	if err := mw.WriteField("map", string(m)); err != nil {
+		return err
+	}
+	for i, u := range uploads {
+		if err := writeUploadPart(mw, strconv.Itoa(i), u.Upload.File); err != nil {
+			return fmt.Errorf("upload %s: %w", u.Path, err)
+		}
+	}
+	return mw.Close()
+}
+
+func writeUploadPart(mw *multipart.Writer, field string, fh *multipart.FileHeader) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := fh.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, quoteEscaper.Replace(fh.Filename)))
+	h.Set("Content-Type", contentType)
+
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
@@ -8,12 +8,21 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/compress"
+	"github.com/deformal/kastql/internal/planner"
 )
 
-const defaultTimeoutMs = 30_000
+const (
+	defaultTimeoutMs     = 30_000
+	defaultMaxResponseKB = 32 * 1024 // 32 MiB
+
+	errorPreviewBytes = 200
+)
 
 var baseHTTPClient = &http.Client{} // no global timeout — per-request via context
 
@@ -23,12 +32,25 @@ type upstreamRequest struct {
 }
 
 type upstreamResponse struct {
-	Data   json.RawMessage `json:"data"`
-	Errors []GQLError      `json:"errors,omitempty"`
+	Data   map[string]any `json:"data"`
+	Errors []GQLError     `json:"errors,omitempty"`
+
+	header http.Header // upstream HTTP response headers
+}
+
+// callOptions carries the per-step settings that shape an upstream call.
+type callOptions struct {
+	retryCount    int // 0 = single attempt
+	timeoutMs     int // 0 = defaultTimeoutMs
+	maxResponseKB int // 0 = defaultMaxResponseKB
+	policy        planner.RetryPolicy
+	budget        *retryBudget         // nil = no retry budget
+	uploads       []planner.StepUpload // non-empty = send as a multipart request
+	encoding      string               // request body compression; "" = none
 }
 
-// callUpstream sends a GraphQL request to url with optional retry and per-request timeout.
-// retryCount = 0 → single attempt. timeoutMs = 0 → uses defaultTimeoutMs.
+// callUpstream sends a GraphQL request to url with per-attempt timeout and
+// retries as allowed by opts.policy and opts.budget.
 func callUpstream(
 	ctx context.Context,
 	log *zap.Logger,
@@ -36,49 +58,61 @@ func callUpstream(
 	headers map[string]string,
 	query string,
 	variables map[string]any,
-	retryCount int,
-	timeoutMs int,
+	opts callOptions,
 ) (*upstreamResponse, error) {
+	timeoutMs := opts.timeoutMs
 	if timeoutMs <= 0 {
 		timeoutMs = defaultTimeoutMs
 	}
+	maxKB := opts.maxResponseKB
+	if maxKB <= 0 {
+		maxKB = defaultMaxResponseKB
+	}
+	if opts.budget != nil {
+		opts.budget.recordRequest()
+	}
 
 	var lastErr error
-	for attempt := 0; attempt <= retryCount; attempt++ {
+	for attempt := 0; attempt <= opts.retryCount; attempt++ {
 		if attempt > 0 {
-			// Exponential backoff: 100ms, 200ms, 400ms…
-			backoff := time.Duration(100*(1<<(attempt-1))) * time.Millisecond
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
-			case <-time.After(backoff):
+			case <-time.After(retryBackoff(opts.policy, attempt)):
 			}
 		}
 
-		resp, err := doUpstreamRequest(ctx, log, url, headers, query, variables, timeoutMs)
+		resp, err := doUpstreamRequest(ctx, log, url, headers, query, variables, opts.uploads, opts.encoding, timeoutMs, int64(maxKB)*1024)
 		if err == nil {
 			return resp, nil
 		}
 		lastErr = err
 
-		// Never retry on context cancellation or 4xx client errors.
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if attempt == opts.retryCount || !isRetryable(ctx, opts.policy, err) {
 			return nil, err
 		}
-		if isClientError(err) {
+		if opts.budget != nil && !opts.budget.allowRetry(opts.policy) {
+			log.Warn("upstream retry budget exhausted",
+				zap.String("url", url),
+				zap.Error(err),
+			)
 			return nil, err
 		}
 
 		log.Warn("upstream call failed, retrying",
 			zap.String("url", url),
 			zap.Int("attempt", attempt+1),
-			zap.Int("max_retries", retryCount),
+			zap.Int("max_retries", opts.retryCount),
 			zap.Error(err),
 		)
 	}
 	return nil, lastErr
 }
 
+// doUpstreamRequest makes a single attempt. The response body read is
+// aborted as soon as it exceeds maxBytes of decoded data. With uploads the
+// request is sent as a GraphQL multipart request, reopening the files on
+// every attempt; otherwise the JSON body is compressed with encoding, if set.
 func doUpstreamRequest(
 	ctx context.Context,
 	log *zap.Logger,
@@ -86,7 +120,10 @@ func doUpstreamRequest(
 	headers map[string]string,
 	query string,
 	variables map[string]any,
+	uploads []planner.StepUpload,
+	encoding string,
 	timeoutMs int,
+	maxBytes int64,
 ) (*upstreamResponse, error) {
 	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
 	defer cancel()
@@ -96,14 +133,36 @@ func doUpstreamRequest(
 		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(body))
+	var (
+		reqBody     io.Reader = bytes.NewReader(body)
+		contentType           = "application/json"
+	)
+	if len(uploads) > 0 {
+		mp, ct := multipartBody(body, uploads)
+		defer mp.Close()
+		reqBody, contentType = mp, ct
+		encoding = ""
+	} else if encoding != "" {
+		if body, err = compress.Encode(encoding, body); err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, reqBody)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	// Asking explicitly turns off net/http's own gzip handling; responses are
+	// decoded below so brotli works too.
+	req.Header.Set("Accept-Encoding", compress.AcceptEncoding)
 
 	log.Debug("upstream request",
 		zap.String("url", url),
@@ -116,38 +175,197 @@ func doUpstreamRequest(
 	}
 	defer resp.Body.Close()
 
-	raw, err := io.ReadAll(resp.Body)
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	respBody, err := compress.NewReader(contentEncoding, resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read response from %s: %w", url, err)
+		return nil, fmt.Errorf("decode response from %s: %w", url, err)
 	}
+	defer respBody.Close()
+
+	if resp.StatusCode >= 400 {
+		raw, _ := io.ReadAll(io.LimitReader(respBody, errorPreviewBytes+1))
+		preview := string(raw)
+		if len(preview) > errorPreviewBytes {
+			preview = preview[:errorPreviewBytes] + "…"
+		}
+		log.Debug("upstream response",
+			zap.String("url", url),
+			zap.Int("status", resp.StatusCode),
+		)
+		if resp.StatusCode >= 500 {
+			return nil, &upstreamHTTPError{url: url, status: resp.StatusCode, body: preview}
+		}
+		return nil, &upstreamClientError{url: url, status: resp.StatusCode, body: preview}
+	}
+
+	// Content-Length only bounds the decoded size when nothing is encoded.
+	if contentEncoding == "" && resp.ContentLength > maxBytes {
+		return nil, &upstreamTooLargeError{url: url, limit: maxBytes}
+	}
+	result, n, err := decodeUpstreamBody(respBody, maxBytes)
 
 	log.Debug("upstream response",
 		zap.String("url", url),
 		zap.Int("status", resp.StatusCode),
-		zap.Int("body_bytes", len(raw)),
+		zap.Int64("body_bytes", n),
 	)
 
-	if resp.StatusCode >= 500 {
-		preview := string(raw)
-		if len(preview) > 200 {
-			preview = preview[:200] + "…"
+	if errors.Is(err, errBodyTooLarge) {
+		return nil, &upstreamTooLargeError{url: url, limit: maxBytes}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode response from %s: %w", url, err)
+	}
+	result.header = resp.Header
+	return result, nil
+}
+
+// decodeUpstreamBody decodes a GraphQL response streamed from r, failing
+// with errBodyTooLarge as soon as more than maxBytes have been read. It also
+// returns the number of bytes read.
+//
+// The body is never held whole. Objects are walked token by token and lists
+// are decoded one element at a time, so besides the decoded tree the decoder
+// only buffers the largest single list element. That keeps a large list
+// response from costing its raw size again on top of its decoded size; the
+// decoded tree itself takes as many allocations as json.Unmarshal would.
+func decodeUpstreamBody(r io.Reader, maxBytes int64) (*upstreamResponse, int64, error) {
+	cr := &cappedReader{r: r, remaining: maxBytes}
+	dec := json.NewDecoder(cr)
+	var result upstreamResponse
+	err := decodeResponseObject(dec, &result)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("invalid character after top-level value")
 		}
-		return nil, &upstreamHTTPError{url: url, status: resp.StatusCode, body: preview}
 	}
+	n := maxBytes - cr.remaining
+	if err != nil {
+		return nil, n, err
+	}
+	return &result, n, nil
+}
 
-	if resp.StatusCode >= 400 {
-		preview := string(raw)
-		if len(preview) > 200 {
-			preview = preview[:200] + "…"
+// decodeResponseObject decodes the top-level {"data": …, "errors": […]}
+// object. Other members are skipped.
+func decodeResponseObject(dec *json.Decoder, result *upstreamResponse) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected a JSON object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		switch {
+		case strings.EqualFold(key, "data"):
+			v, err := decodeStreamValue(dec)
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				data, ok := v.(map[string]any)
+				if !ok {
+					return fmt.Errorf("expected data to be an object, got %T", v)
+				}
+				result.Data = data
+			}
+		case strings.EqualFold(key, "errors"):
+			if err := dec.Decode(&result.Errors); err != nil {
+				return err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
 		}
-		return nil, &upstreamClientError{url: url, status: resp.StatusCode, body: preview}
 	}
+	_, err = dec.Token() // the closing '}'
+	return err
+}
 
-	var result upstreamResponse
-	if err := json.Unmarshal(raw, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal response from %s: %w", url, err)
+// decodeStreamValue decodes the next value from dec. Objects are walked
+// member by member and each list element is decoded on its own, so dec never
+// buffers more than one element of a list.
+func decodeStreamValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := map[string]any{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := tok.(string)
+			v, err := decodeStreamValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = v
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		var v any // reused: Decode replaces what an interface holds
+		for dec.More() {
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	default:
+		return tok, nil
+	}
+}
+
+var errBodyTooLarge = errors.New("response body too large")
+
+// cappedReader reads at most remaining bytes from r and reports
+// errBodyTooLarge if r has more.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		// Probe for one more byte to tell a body of exactly the limit apart
+		// from one that runs over it.
+		var probe [1]byte
+		for {
+			n, err := c.r.Read(probe[:])
+			if n > 0 {
+				return 0, errBodyTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
 	}
-	return &result, nil
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	return n, err
 }
 
 // ── Error types ───────────────────────────────────────────────────────────────
@@ -164,9 +382,24 @@ func (e *upstreamClientError) Error() string {
 	return fmt.Sprintf("upstream %s returned HTTP %d: %s", e.url, e.status, e.body)
 }
 
-func isClientError(err error) bool {
+type upstreamTooLargeError struct{ url string; limit int64 }
+
+func (e *upstreamTooLargeError) Error() string {
+	return fmt.Sprintf("upstream %s response exceeds %d KB limit", e.url, e.limit/1024)
+}
+
+// upstreamStatus returns the HTTP status carried by an upstream error, or 0
+// when the call failed before a status was received.
+func upstreamStatus(err error) int {
+	var se *upstreamHTTPError
+	if errors.As(err, &se) {
+		return se.status
+	}
 	var ce *upstreamClientError
-	return errors.As(err, &ce)
+	if errors.As(err, &ce) {
+		return ce.status
+	}
+	return 0
 }
 
 func headerKeys(h map[string]string) []string {
@@ -4,18 +4,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path"
+	"slices"
+	"strings"
 
+	"github.com/deformal/kastql/internal/auth"
+	"github.com/deformal/kastql/internal/compress"
 	"github.com/deformal/kastql/internal/metadata"
+	"github.com/deformal/kastql/internal/planner"
 )
 
 // ── add_remote_schema ─────────────────────────────────────────────────────────
 
 type addRemoteSchemaArgs struct {
-	Name    string            `json:"name"`
-	URL     string            `json:"url"`
-	Type    string            `json:"type"` // "federation" | "stitching"
-	Headers map[string]string `json:"headers"`
-	Enabled *bool             `json:"enabled"`
+	Name          string                `json:"name"`
+	URL           string                `json:"url"`
+	Type          string                `json:"type"` // "federation" | "stitching"
+	Headers       map[string]string     `json:"headers"`
+	Enabled       *bool                 `json:"enabled"`
+	TimeoutMs     int                   `json:"timeout_ms"`
+	RetryCount    int                   `json:"retry_count"`
+	RetryPolicy   *planner.RetryPolicy  `json:"retry_policy"`
+	Dedupe        *planner.DedupePolicy `json:"dedupe"`
+	MaxResponseKB int                   `json:"max_response_kb"`
+	Encoding      string                `json:"encoding"`
 }
 
 func (h *Handler) addRemoteSchema(ctx context.Context, raw json.RawMessage) (any, error) {
@@ -41,12 +53,38 @@ func (h *Handler) addRemoteSchema(ctx context.Context, raw json.RawMessage) (any
 		headersJSON = string(b)
 	}
 
+	if args.TimeoutMs < 0 || args.RetryCount < 0 || args.MaxResponseKB < 0 {
+		return nil, fmt.Errorf("timeout_ms, retry_count and max_response_kb must not be negative")
+	}
+	if !compress.ValidEncoding(args.Encoding) {
+		return nil, fmt.Errorf("encoding must be %q or %q", compress.Gzip, compress.Brotli)
+	}
+	retryJSON := "{}"
+	if args.RetryPolicy != nil {
+		if err := args.RetryPolicy.Validate(); err != nil {
+			return nil, fmt.Errorf("retry_policy: %w", err)
+		}
+		b, _ := json.Marshal(args.RetryPolicy)
+		retryJSON = string(b)
+	}
+	dedupeJSON := "{}"
+	if args.Dedupe != nil {
+		b, _ := json.Marshal(args.Dedupe)
+		dedupeJSON = string(b)
+	}
+
 	svc := &metadata.Service{
-		Name:    args.Name,
-		URL:     args.URL,
-		Type:    metadata.ServiceType(args.Type),
-		Headers: headersJSON,
-		Enabled: enabled,
+		Name:          args.Name,
+		URL:           args.URL,
+		Type:          metadata.ServiceType(args.Type),
+		Headers:       headersJSON,
+		Enabled:       enabled,
+		TimeoutMs:     args.TimeoutMs,
+		RetryCount:    args.RetryCount,
+		RetryPolicy:   retryJSON,
+		Dedupe:        dedupeJSON,
+		MaxResponseKB: args.MaxResponseKB,
+		Encoding:      args.Encoding,
 	}
 
 	if err := h.registry.Add(ctx, svc); err != nil {
@@ -94,6 +132,39 @@ func (h *Handler) reloadRemoteSchema(ctx context.Context, raw json.RawMessage) (
 	return map[string]string{"message": "remote schema reloaded", "name": args.Name}, nil
 }
 
+// ── set_header_rules ──────────────────────────────────────────────────────────
+
+type setHeaderRulesArgs struct {
+	Service string               `json:"service"`
+	Rules   *planner.HeaderRules `json:"rules"`
+}
+
+func (h *Handler) setHeaderRules(ctx context.Context, raw json.RawMessage) (any, error) {
+	var args setHeaderRulesArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Service == "" {
+		return nil, fmt.Errorf("service is required")
+	}
+	rulesJSON := "{}"
+	if args.Rules != nil {
+		if err := args.Rules.Validate(); err != nil {
+			return nil, fmt.Errorf("rules: %w", err)
+		}
+		b, _ := json.Marshal(args.Rules)
+		rulesJSON = string(b)
+	}
+	if err := h.store.SetServiceHeaderRules(args.Service, rulesJSON); err != nil {
+		return nil, err
+	}
+	if err := h.registry.Reload(ctx, args.Service); err != nil {
+		return nil, err
+	}
+	h.refreshPlanner()
+	return map[string]string{"message": "header rules set", "service": args.Service}, nil
+}
+
 // ── add_relationship ──────────────────────────────────────────────────────────
 
 type addRelationshipArgs struct {
@@ -156,11 +227,13 @@ func (h *Handler) removeRelationship(raw json.RawMessage) (any, error) {
 // ── create_permission ─────────────────────────────────────────────────────────
 
 type createPermissionArgs struct {
-	Role      string `json:"role"`
-	Service   string `json:"service"`
-	TypeName  string `json:"type_name"`
-	FieldName string `json:"field_name"`
-	Allow     *bool  `json:"allow"`
+	Role      string         `json:"role"`
+	Service   string         `json:"service"`
+	TypeName  string         `json:"type_name"`
+	FieldName string         `json:"field_name"`
+	Allow     *bool          `json:"allow"`
+	Condition map[string]any `json:"condition"` // row filter, or value test for argument/input rules
+	Preset    any            `json:"preset"`    // value forced into an argument, e.g. "X-Kastql-User-Id"
 }
 
 func (h *Handler) createPermission(raw json.RawMessage) (any, error) {
@@ -168,8 +241,18 @@ func (h *Handler) createPermission(raw json.RawMessage) (any, error) {
 	if err := json.Unmarshal(raw, &args); err != nil {
 		return nil, err
 	}
-	if args.Role == "" || args.TypeName == "" {
-		return nil, fmt.Errorf("role and type_name are required")
+	// A rule with a service and no type_name covers everything the service
+	// resolves, e.g. {"role":"partner","service":"billing","allow":false}.
+	if args.Role == "" || (args.TypeName == "" && args.Service == "") {
+		return nil, fmt.Errorf("role and type_name (or service) are required")
+	}
+	if args.TypeName == "" && args.FieldName != "" {
+		return nil, fmt.Errorf(`field_name requires type_name ("*" for any type)`)
+	}
+	for _, name := range []string{args.TypeName, args.FieldName} {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", name, err)
+		}
 	}
 
 	allow := true
@@ -177,17 +260,39 @@ func (h *Handler) createPermission(raw json.RawMessage) (any, error) {
 		allow = *args.Allow
 	}
 
+	condition := "{}"
+	if len(args.Condition) > 0 {
+		if err := planner.ValidateCondition(args.Condition); err != nil {
+			return nil, err
+		}
+		b, _ := json.Marshal(args.Condition)
+		condition = string(b)
+	}
+	preset := ""
+	if args.Preset != nil {
+		if !strings.Contains(args.FieldName, "(") {
+			return nil, fmt.Errorf(`preset requires an argument rule: field_name must be "field(arg)"`)
+		}
+		b, _ := json.Marshal(args.Preset)
+		preset = string(b)
+	}
+
 	perm := &metadata.Permission{
 		Role:      args.Role,
 		Service:   args.Service,
 		TypeName:  args.TypeName,
 		FieldName: args.FieldName,
 		Allow:     allow,
+		Condition: condition,
+		Preset:    preset,
 	}
 
 	if err := h.store.UpsertPermission(perm); err != nil {
 		return nil, err
 	}
+	if err := h.planner.ReloadPermissions(); err != nil {
+		return nil, err
+	}
 	return map[string]string{"message": "permission created"}, nil
 }
 
@@ -205,15 +310,257 @@ func (h *Handler) dropPermission(raw json.RawMessage) (any, error) {
 	if err := json.Unmarshal(raw, &args); err != nil {
 		return nil, err
 	}
-	if args.Role == "" || args.TypeName == "" {
-		return nil, fmt.Errorf("role and type_name are required")
+	if args.Role == "" || (args.TypeName == "" && args.Service == "") {
+		return nil, fmt.Errorf("role and type_name (or service) are required")
 	}
 	if err := h.store.DeletePermission(args.Role, args.Service, args.TypeName, args.FieldName); err != nil {
 		return nil, err
 	}
+	if err := h.planner.ReloadPermissions(); err != nil {
+		return nil, err
+	}
 	return map[string]string{"message": "permission dropped"}, nil
 }
 
+// ── check_permission ──────────────────────────────────────────────────────────
+
+type checkPermissionArgs struct {
+	Role      string `json:"role"`
+	Service   string `json:"service"`
+	TypeName  string `json:"type_name"`
+	FieldName string `json:"field_name"`
+}
+
+// checkPermission explains whether a role may access a field and which rule
+// or default policy decided it, using the planner's live checker. The index
+// is reloaded on every permission change, so it matches the store.
+func (h *Handler) checkPermission(ctx context.Context, raw json.RawMessage) (any, error) {
+	var args checkPermissionArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Role == "" || args.TypeName == "" || args.FieldName == "" {
+		return nil, fmt.Errorf("role, type_name and field_name are required")
+	}
+	checker, ok := h.planner.Checker().(*auth.Checker)
+	if !ok {
+		checker = auth.NewChecker(h.store)
+	}
+	return checker.Explain(ctx, args.Role, args.Service, args.TypeName, args.FieldName)
+}
+
+// ── set_role ──────────────────────────────────────────────────────────────────
+
+// setRoleArgs replaces a role's settings as a whole.
+type setRoleArgs struct {
+	Name          string   `json:"name"`
+	PartialDeny   bool     `json:"partial_deny"`   // null forbidden fields instead of failing the operation
+	Inherits      []string `json:"inherits"`       // parent roles, consulted in order after the role's own rules
+	DefaultPolicy string   `json:"default_policy"` // "allow" | "deny" when no rule matches; "" = from parents
+}
+
+func (h *Handler) setRole(raw json.RawMessage) (any, error) {
+	var args setRoleArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	switch args.DefaultPolicy {
+	case "", "allow", "deny":
+	default:
+		return nil, fmt.Errorf(`default_policy must be "allow", "deny" or empty`)
+	}
+
+	existing, err := h.store.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	parents := map[string][]string{args.Name: args.Inherits}
+	for _, r := range existing {
+		if r.Name == args.Name {
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal([]byte(r.Inherits), &list); err != nil {
+			return nil, fmt.Errorf("decode parents of role %s: %w", r.Name, err)
+		}
+		parents[r.Name] = list
+	}
+	if cycle := inheritanceCycle(parents, args.Name); cycle != nil {
+		return nil, fmt.Errorf("role inheritance cycle: %s", strings.Join(cycle, " → "))
+	}
+
+	role := &metadata.Role{
+		Name:          args.Name,
+		PartialDeny:   args.PartialDeny,
+		Inherits:      metadata.JSONList(args.Inherits),
+		DefaultPolicy: args.DefaultPolicy,
+	}
+	if err := h.store.UpsertRole(role); err != nil {
+		return nil, err
+	}
+	if err := h.planner.ReloadPermissions(); err != nil {
+		return nil, err
+	}
+	return map[string]string{"message": "role saved", "name": args.Name}, nil
+}
+
+// inheritanceCycle returns a path from start back to itself through parents,
+// or nil when there is none.
+func inheritanceCycle(parents map[string][]string, start string) []string {
+	seen := map[string]bool{}
+	var walk func(name string, trail []string) []string
+	walk = func(name string, trail []string) []string {
+		for _, p := range parents[name] {
+			if p == start {
+				return append(trail, p)
+			}
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			if c := walk(p, append(trail, p)); c != nil {
+				return c
+			}
+		}
+		return nil
+	}
+	return walk(start, []string{start})
+}
+
+// ── drop_role ─────────────────────────────────────────────────────────────────
+
+type dropRoleArgs struct {
+	Name string `json:"name"`
+}
+
+// dropRole removes a role's settings; its permissions are kept.
+func (h *Handler) dropRole(raw json.RawMessage) (any, error) {
+	var args dropRoleArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if err := h.store.DeleteRole(args.Name); err != nil {
+		return nil, err
+	}
+	if err := h.planner.ReloadPermissions(); err != nil {
+		return nil, err
+	}
+	return map[string]string{"message": "role dropped", "name": args.Name}, nil
+}
+
+// ── create_contract ───────────────────────────────────────────────────────────
+
+type createContractArgs struct {
+	Name        string   `json:"name"`
+	IncludeTags []string `json:"include_tags"`
+	ExcludeTags []string `json:"exclude_tags"`
+	Roles       []string `json:"roles"`
+}
+
+func (h *Handler) createContract(raw json.RawMessage) (any, error) {
+	var args createContractArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if len(args.IncludeTags) == 0 && len(args.ExcludeTags) == 0 {
+		return nil, fmt.Errorf("include_tags or exclude_tags is required")
+	}
+
+	existing, err := h.store.ListContracts()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range existing {
+		if row.Name == args.Name {
+			continue
+		}
+		other, err := planner.ParseContract(row)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range args.Roles {
+			if slices.Contains(other.Roles, role) {
+				return nil, fmt.Errorf("role %q is already bound to contract %q", role, other.Name)
+			}
+		}
+	}
+
+	c := &metadata.Contract{
+		Name:        args.Name,
+		IncludeTags: metadata.JSONList(args.IncludeTags),
+		ExcludeTags: metadata.JSONList(args.ExcludeTags),
+		Roles:       metadata.JSONList(args.Roles),
+	}
+	if err := h.store.UpsertContract(c); err != nil {
+		return nil, err
+	}
+	h.planner.ResetContracts()
+	return map[string]string{"message": "contract created"}, nil
+}
+
+// ── drop_contract ─────────────────────────────────────────────────────────────
+
+type dropContractArgs struct {
+	Name string `json:"name"`
+}
+
+// dropContract removes a contract. Router keys still bound to it are
+// refused until they are rebound, rather than falling back to the full
+// schema.
+func (h *Handler) dropContract(raw json.RawMessage) (any, error) {
+	var args dropContractArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if err := h.store.DeleteContract(args.Name); err != nil {
+		return nil, err
+	}
+	h.planner.ResetContracts()
+	return map[string]string{"message": "contract dropped"}, nil
+}
+
+// ── set_router_key_contract ───────────────────────────────────────────────────
+
+type setRouterKeyContractArgs struct {
+	RouterKey string `json:"router_key"` // router key name
+	Contract  string `json:"contract"`   // "" = full schema
+}
+
+func (h *Handler) setRouterKeyContract(raw json.RawMessage) (any, error) {
+	var args setRouterKeyContractArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.RouterKey == "" {
+		return nil, fmt.Errorf("router_key is required")
+	}
+	if args.Contract != "" {
+		contracts, err := h.store.ListContracts()
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(contracts, func(c *metadata.Contract) bool { return c.Name == args.Contract }) {
+			return nil, fmt.Errorf("contract %q not found", args.Contract)
+		}
+	}
+	if err := h.store.SetRouterKeyContract(args.RouterKey, args.Contract); err != nil {
+		return nil, err
+	}
+	return map[string]string{"message": "router key contract set"}, nil
+}
+
 // ── create_rest_endpoint ──────────────────────────────────────────────────────
 
 type createRESTEndpointArgs struct {
@@ -276,6 +623,10 @@ func (h *Handler) reloadMetadata(ctx context.Context) (any, error) {
 		return nil, err
 	}
 	h.refreshPlanner()
+	h.planner.ResetContracts()
+	if err := h.planner.ReloadPermissions(); err != nil {
+		return nil, err
+	}
 	return map[string]string{"message": "metadata reloaded"}, nil
 }
 
@@ -286,6 +637,8 @@ type exportedMetadata struct {
 	Relationships []*metadata.Relationship `json:"relationships"`
 	Permissions   []*metadata.Permission   `json:"permissions"`
 	RESTEndpoints []*metadata.RESTEndpoint `json:"rest_endpoints"`
+	Contracts     []*metadata.Contract     `json:"contracts"`
+	Roles         []*metadata.Role         `json:"roles"`
 }
 
 func (h *Handler) exportMetadata() (any, error) {
@@ -305,10 +658,20 @@ func (h *Handler) exportMetadata() (any, error) {
 	if err != nil {
 		return nil, fmt.Errorf("list rest endpoints: %w", err)
 	}
+	contracts, err := h.store.ListContracts()
+	if err != nil {
+		return nil, fmt.Errorf("list contracts: %w", err)
+	}
+	roles, err := h.store.ListRoles()
+	if err != nil {
+		return nil, fmt.Errorf("list roles: %w", err)
+	}
 	return &exportedMetadata{
 		Services:      svcs,
 		Relationships: rels,
 		Permissions:   perms,
 		RESTEndpoints: eps,
+		Contracts:     contracts,
+		Roles:         roles,
 	}, nil
 }
@@ -51,6 +51,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		result, err = h.removeRemoteSchema(req.Args)
 	case "reload_remote_schema":
 		result, err = h.reloadRemoteSchema(r.Context(), req.Args)
+	case "set_header_rules":
+		result, err = h.setHeaderRules(r.Context(), req.Args)
 	case "add_relationship":
 		result, err = h.addRelationship(req.Args)
 	case "remove_relationship":
@@ -59,6 +61,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		result, err = h.createPermission(req.Args)
 	case "drop_permission":
 		result, err = h.dropPermission(req.Args)
+	case "check_permission":
+		result, err = h.checkPermission(r.Context(), req.Args)
+	case "set_role":
+		result, err = h.setRole(req.Args)
+	case "drop_role":
+		result, err = h.dropRole(req.Args)
+	case "create_contract":
+		result, err = h.createContract(req.Args)
+	case "drop_contract":
+		result, err = h.dropContract(req.Args)
+	case "set_router_key_contract":
+		result, err = h.setRouterKeyContract(req.Args)
 	case "create_rest_endpoint":
 		result, err = h.createRESTEndpoint(req.Args)
 	case "drop_rest_endpoint":
@@ -0,0 +1,62 @@
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (s *Store) UpsertContract(c *Contract) error {
+	_, err := s.db.Exec(`
+		INSERT INTO contracts (name, include_tags, exclude_tags, roles)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			include_tags = excluded.include_tags,
+			exclude_tags = excluded.exclude_tags,
+			roles        = excluded.roles
+	`, c.Name, c.IncludeTags, c.ExcludeTags, c.Roles)
+	if err != nil {
+		return fmt.Errorf("upsert contract %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteContract(name string) error {
+	_, err := s.db.Exec(`DELETE FROM contracts WHERE name = ?`, name)
+	return err
+}
+
+func (s *Store) ListContracts() ([]*Contract, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, include_tags, exclude_tags, roles, created_at
+		FROM contracts ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Contract
+	for rows.Next() {
+		c, err := scanContract(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func scanContract(s scanner) (*Contract, error) {
+	var c Contract
+	var createdAt string
+	err := s.Scan(&c.ID, &c.Name, &c.IncludeTags, &c.ExcludeTags, &c.Roles, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	return &c, nil
+}
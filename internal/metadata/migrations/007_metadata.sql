@@ -0,0 +1,2 @@
+-- Per-service retry policy (JSON): retryable conditions, backoff, jitter, budget
+ALTER TABLE services ADD COLUMN retry_policy TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- Per-service in-flight request deduplication (JSON): enabled, key headers
+ALTER TABLE services ADD COLUMN dedupe TEXT NOT NULL DEFAULT '{}';
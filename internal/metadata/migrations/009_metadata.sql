@@ -0,0 +1,2 @@
+-- Per-service header propagation rules (JSON), managed via set_header_rules
+ALTER TABLE services ADD COLUMN header_rules TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- Per-service cap on upstream response size (0 = executor default)
+ALTER TABLE services ADD COLUMN max_response_kb INTEGER NOT NULL DEFAULT 0;
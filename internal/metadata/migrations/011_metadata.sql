@@ -0,0 +1,3 @@
+-- Maximum operations per batched request (0 = unlimited). Unlimited keeps
+-- batches working as before on upgrade; 10 is a sensible cap to set.
+INSERT OR IGNORE INTO settings (key, value) VALUES ('batch_max_size', '0');
@@ -0,0 +1,2 @@
+-- Cache-Control max-age for persisted queries sent via GET (0 = no header)
+INSERT OR IGNORE INTO settings (key, value) VALUES ('persisted_max_age', '0');
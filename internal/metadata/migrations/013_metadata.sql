@@ -0,0 +1,6 @@
+-- Per-service compression of upstream request bodies ('' = none, 'gzip', 'br')
+ALTER TABLE services ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+
+-- Client response compression
+INSERT OR IGNORE INTO settings (key, value) VALUES ('compression_enabled',   '1');
+INSERT OR IGNORE INTO settings (key, value) VALUES ('compression_min_bytes', '1024');
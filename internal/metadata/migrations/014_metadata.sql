@@ -0,0 +1,12 @@
+-- Schema contracts: named, tag-filtered subsets of the merged schema
+CREATE TABLE IF NOT EXISTS contracts (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    name         TEXT NOT NULL UNIQUE,
+    include_tags TEXT NOT NULL DEFAULT '[]',
+    exclude_tags TEXT NOT NULL DEFAULT '[]',
+    roles        TEXT NOT NULL DEFAULT '[]',
+    created_at   TEXT NOT NULL DEFAULT (datetime('now'))
+);
+
+-- Router keys may pin their callers to a contract ('' = full schema)
+ALTER TABLE router_keys ADD COLUMN contract TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Argument permissions may force a value (JSON, session variables allowed); '' = none
+ALTER TABLE permissions ADD COLUMN preset TEXT NOT NULL DEFAULT '';
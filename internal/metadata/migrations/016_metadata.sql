@@ -0,0 +1,7 @@
+-- Per-role permission settings; roles without a row use the defaults
+CREATE TABLE IF NOT EXISTS roles (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    name         TEXT NOT NULL UNIQUE,
+    partial_deny INTEGER NOT NULL DEFAULT 0, -- strip forbidden fields instead of failing the operation
+    created_at   TEXT NOT NULL DEFAULT (datetime('now'))
+);
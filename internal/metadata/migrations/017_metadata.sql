@@ -0,0 +1,3 @@
+-- Role hierarchies and default policies
+ALTER TABLE roles ADD COLUMN inherits TEXT NOT NULL DEFAULT '[]';      -- JSON array of parent roles, consulted in order
+ALTER TABLE roles ADD COLUMN default_policy TEXT NOT NULL DEFAULT ''; -- 'allow' | 'deny' when no rule matches; '' = inherited, else public only
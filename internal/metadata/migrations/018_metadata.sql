@@ -0,0 +1,3 @@
+-- JWT keys may come from a JWKS endpoint instead of the secret column, which
+-- holds the HMAC secret or, for RS*/PS*/ES*/EdDSA, a PEM public key
+ALTER TABLE jwt_secrets ADD COLUMN jwks_url TEXT NOT NULL DEFAULT '';
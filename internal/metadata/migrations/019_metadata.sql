@@ -0,0 +1,6 @@
+-- Per-secret token requirements, overriding the auth config when set
+ALTER TABLE jwt_secrets ADD COLUMN issuer TEXT NOT NULL DEFAULT '';
+ALTER TABLE jwt_secrets ADD COLUMN audience TEXT NOT NULL DEFAULT '[]';        -- JSON array; any one must match
+ALTER TABLE jwt_secrets ADD COLUMN leeway_seconds INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jwt_secrets ADD COLUMN required_claims TEXT NOT NULL DEFAULT '[]'; -- JSON array
+ALTER TABLE jwt_secrets ADD COLUMN claims_namespace TEXT NOT NULL DEFAULT '';
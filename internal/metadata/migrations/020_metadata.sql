@@ -0,0 +1,2 @@
+-- Operations of one batched request executed at once (0 = router default of 8)
+INSERT OR IGNORE INTO settings (key, value) VALUES ('batch_concurrency', '8');
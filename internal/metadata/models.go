@@ -1,6 +1,9 @@
 package metadata
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type ServiceType string
 
@@ -10,16 +13,21 @@ const (
 )
 
 type Service struct {
-	ID         int64       `json:"id"`
-	Name       string      `json:"name"`
-	URL        string      `json:"url"`
-	Type       ServiceType `json:"type"`
-	Headers    string      `json:"headers"` // JSON map
-	Enabled    bool        `json:"enabled"`
-	TimeoutMs  int         `json:"timeout_ms"`  // 0 = use global default (30s)
-	RetryCount int         `json:"retry_count"` // 0 = no retries
-	CreatedAt  time.Time   `json:"created_at"`
-	UpdatedAt  time.Time   `json:"updated_at"`
+	ID            int64       `json:"id"`
+	Name          string      `json:"name"`
+	URL           string      `json:"url"`
+	Type          ServiceType `json:"type"`
+	Headers       string      `json:"headers"` // JSON map
+	Enabled       bool        `json:"enabled"`
+	TimeoutMs     int         `json:"timeout_ms"`      // 0 = use global default (30s)
+	RetryCount    int         `json:"retry_count"`     // 0 = no retries
+	RetryPolicy   string      `json:"retry_policy"`    // JSON retry policy
+	Dedupe        string      `json:"dedupe"`          // JSON deduplication policy
+	HeaderRules   string      `json:"header_rules"`    // JSON header propagation rules
+	MaxResponseKB int         `json:"max_response_kb"` // 0 = executor default
+	Encoding      string      `json:"encoding"`        // upstream request compression: "", "gzip" or "br"
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
 }
 
 type Relationship struct {
@@ -42,6 +50,7 @@ type Permission struct {
 	FieldName string    `json:"field_name"`
 	Allow     bool      `json:"allow"`
 	Condition string    `json:"condition"` // JSON
+	Preset    string    `json:"preset"`    // JSON value forced into an argument; "" = none
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -55,9 +64,37 @@ type RESTEndpoint struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+type Contract struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	IncludeTags string    `json:"include_tags"` // JSON array; empty = every tag
+	ExcludeTags string    `json:"exclude_tags"` // JSON array
+	Roles       string    `json:"roles"`        // JSON array of roles bound to the contract
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Role struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	PartialDeny   bool      `json:"partial_deny"`   // null forbidden fields instead of failing the operation
+	Inherits      string    `json:"inherits"`       // JSON array of parent roles
+	DefaultPolicy string    `json:"default_policy"` // "allow" | "deny"; "" = from parents, else public only
+	CreatedAt     time.Time `json:"created_at"`
+}
+
 type SchemaCache struct {
 	ID          int64     `json:"id"`
 	ServiceName string    `json:"service_name"`
 	SDL         string    `json:"sdl"`
 	FetchedAt   time.Time `json:"fetched_at"`
 }
+
+// JSONList encodes a string list for a JSON array column, treating nil as
+// empty.
+func JSONList(list []string) string {
+	if len(list) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
@@ -8,12 +8,13 @@ import (
 
 func (s *Store) UpsertPermission(p *Permission) error {
 	_, err := s.db.Exec(`
-		INSERT INTO permissions (role, service, type_name, field_name, allow, condition)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO permissions (role, service, type_name, field_name, allow, condition, preset)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(role, service, type_name, field_name) DO UPDATE SET
 			allow     = excluded.allow,
-			condition = excluded.condition
-	`, p.Role, p.Service, p.TypeName, p.FieldName, boolToInt(p.Allow), p.Condition)
+			condition = excluded.condition,
+			preset    = excluded.preset
+	`, p.Role, p.Service, p.TypeName, p.FieldName, boolToInt(p.Allow), p.Condition, p.Preset)
 	if err != nil {
 		return fmt.Errorf("upsert permission %s/%s.%s: %w", p.Role, p.TypeName, p.FieldName, err)
 	}
@@ -30,7 +31,7 @@ func (s *Store) DeletePermission(role, service, typeName, fieldName string) erro
 
 func (s *Store) ListPermissions() ([]*Permission, error) {
 	rows, err := s.db.Query(`
-		SELECT id, role, service, type_name, field_name, allow, condition, created_at
+		SELECT id, role, service, type_name, field_name, allow, condition, preset, created_at
 		FROM permissions ORDER BY role, type_name, field_name
 	`)
 	if err != nil {
@@ -53,7 +54,7 @@ func scanPermission(s scanner) (*Permission, error) {
 	var p Permission
 	var allow int
 	var createdAt string
-	err := s.Scan(&p.ID, &p.Role, &p.Service, &p.TypeName, &p.FieldName, &allow, &p.Condition, &createdAt)
+	err := s.Scan(&p.ID, &p.Role, &p.Service, &p.TypeName, &p.FieldName, &allow, &p.Condition, &p.Preset, &createdAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
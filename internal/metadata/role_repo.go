@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (s *Store) UpsertRole(r *Role) error {
+	_, err := s.db.Exec(`
+		INSERT INTO roles (name, partial_deny, inherits, default_policy)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			partial_deny   = excluded.partial_deny,
+			inherits       = excluded.inherits,
+			default_policy = excluded.default_policy
+	`, r.Name, boolToInt(r.PartialDeny), r.Inherits, r.DefaultPolicy)
+	if err != nil {
+		return fmt.Errorf("upsert role %s: %w", r.Name, err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteRole(name string) error {
+	_, err := s.db.Exec(`DELETE FROM roles WHERE name = ?`, name)
+	return err
+}
+
+func (s *Store) ListRoles() ([]*Role, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, partial_deny, inherits, default_policy, created_at
+		FROM roles ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Role
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func scanRole(s scanner) (*Role, error) {
+	var r Role
+	var partialDeny int
+	var createdAt string
+	err := s.Scan(&r.ID, &r.Name, &partialDeny, &r.Inherits, &r.DefaultPolicy, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.PartialDeny = partialDeny != 0
+	r.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	return &r, nil
+}
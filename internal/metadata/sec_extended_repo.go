@@ -1,6 +1,7 @@
 package metadata
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 )
@@ -152,9 +153,12 @@ func (s *Store) GetPersistedQuery(id string) (*PersistedQuery, error) {
 	err := s.db.QueryRow(
 		`SELECT id, name, query, created_at FROM persisted_queries WHERE id = ?`, id,
 	).Scan(&row.ID, &row.Name, &row.Query, &row.CreatedAt)
-	if err != nil {
+	if err == sql.ErrNoRows {
 		return nil, ErrPersistedQueryNotFound
 	}
+	if err != nil {
+		return nil, fmt.Errorf("get persisted query: %w", err)
+	}
 	return row, nil
 }
 
@@ -3,6 +3,7 @@ package metadata
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,21 +19,53 @@ type JWTSecret struct {
 	ID        int64  `json:"id"`
 	Name      string `json:"name"`
 	Algorithm string `json:"algorithm"`
+	JWKSURL   string `json:"jwks_url,omitempty"`
+	JWTValidation
 	Active    bool   `json:"active"`
 	CreatedAt string `json:"created_at"`
 }
 
-func (s *Store) AddJWTSecret(name, secret, algorithm string) (*JWTSecret, error) {
-	if algorithm == "" {
-		algorithm = "HS256"
+// JWTValidation holds a secret's token requirements. Empty values leave the
+// auth config's in force.
+type JWTValidation struct {
+	Issuer          string `json:"issuer,omitempty"`
+	Audience        string `json:"audience,omitempty"` // JSON array; any one must match
+	LeewaySeconds   int    `json:"leeway_seconds,omitempty"`
+	RequiredClaims  string `json:"required_claims,omitempty"` // JSON array
+	ClaimsNamespace string `json:"claims_namespace,omitempty"`
+}
+
+// JWTKey is the key material of an active JWT secret. Secret is the HMAC
+// secret or a PEM public key; it is empty when keys come from JWKSURL.
+type JWTKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+	JWKSURL   string
+	JWTValidation
+}
+
+// AddJWTSecret stores a new secret described by sec, whose ID, Active and
+// CreatedAt are ignored, and returns the stored row.
+func (s *Store) AddJWTSecret(sec *JWTSecret, secret string) (*JWTSecret, error) {
+	in := *sec
+	if in.Algorithm == "" {
+		in.Algorithm = "HS256"
+	}
+	if in.Audience == "" {
+		in.Audience = "[]"
 	}
-	row := &JWTSecret{}
+	if in.RequiredClaims == "" {
+		in.RequiredClaims = "[]"
+	}
+	row := &in
 	var active int
 	err := s.db.QueryRow(
-		`INSERT INTO jwt_secrets (name, secret, algorithm) VALUES (?, ?, ?)
-		 RETURNING id, name, algorithm, active, created_at`,
-		name, secret, algorithm,
-	).Scan(&row.ID, &row.Name, &row.Algorithm, &active, &row.CreatedAt)
+		`INSERT INTO jwt_secrets (name, secret, algorithm, jwks_url, issuer, audience, leeway_seconds, required_claims, claims_namespace)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 RETURNING id, active, created_at`,
+		in.Name, secret, in.Algorithm, in.JWKSURL, in.Issuer, in.Audience, in.LeewaySeconds, in.RequiredClaims, in.ClaimsNamespace,
+	).Scan(&row.ID, &active, &row.CreatedAt)
 	if err != nil {
 		if isUniqueConstraint(err) {
 			return nil, ErrNameTaken
@@ -45,7 +78,8 @@ func (s *Store) AddJWTSecret(name, secret, algorithm string) (*JWTSecret, error)
 
 func (s *Store) ListJWTSecrets() ([]*JWTSecret, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, algorithm, active, created_at FROM jwt_secrets ORDER BY id`,
+		`SELECT id, name, algorithm, jwks_url, issuer, audience, leeway_seconds, required_claims, claims_namespace, active, created_at
+		 FROM jwt_secrets ORDER BY id`,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("list jwt secrets: %w", err)
@@ -56,7 +90,9 @@ func (s *Store) ListJWTSecrets() ([]*JWTSecret, error) {
 	for rows.Next() {
 		r := &JWTSecret{}
 		var active int
-		if err := rows.Scan(&r.ID, &r.Name, &r.Algorithm, &active, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Algorithm, &r.JWKSURL,
+			&r.Issuer, &r.Audience, &r.LeewaySeconds, &r.RequiredClaims, &r.ClaimsNamespace,
+			&active, &r.CreatedAt); err != nil {
 			return nil, err
 		}
 		r.Active = active == 1
@@ -85,6 +121,30 @@ func (s *Store) ActiveJWTSecretValues() ([]string, error) {
 	return secrets, rows.Err()
 }
 
+// ActiveJWTKeys returns the key material of all active records, oldest first.
+// Called by the JWT middleware to validate incoming tokens.
+func (s *Store) ActiveJWTKeys() ([]*JWTKey, error) {
+	rows, err := s.db.Query(
+		`SELECT name, algorithm, secret, jwks_url, issuer, audience, leeway_seconds, required_claims, claims_namespace
+		 FROM jwt_secrets WHERE active = 1 ORDER BY id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load active jwt keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*JWTKey
+	for rows.Next() {
+		k := &JWTKey{}
+		if err := rows.Scan(&k.Name, &k.Algorithm, &k.Secret, &k.JWKSURL,
+			&k.Issuer, &k.Audience, &k.LeewaySeconds, &k.RequiredClaims, &k.ClaimsNamespace); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
 func (s *Store) DeactivateJWTSecret(id int64) error {
 	res, err := s.db.Exec(`UPDATE jwt_secrets SET active = 0 WHERE id = ?`, id)
 	if err != nil {
@@ -103,6 +163,7 @@ type RouterKey struct {
 	ID        int64  `json:"id"`
 	Name      string `json:"name"`
 	Active    bool   `json:"active"`
+	Contract  string `json:"contract"` // schema contract for callers using this key; "" = full schema
 	CreatedAt string `json:"created_at"`
 }
 
@@ -126,9 +187,9 @@ func (s *Store) AddRouterKey(name, rawKey string) (*RouterKey, error) {
 	var active int
 	err := s.db.QueryRow(
 		`INSERT INTO router_keys (name, key_hash) VALUES (?, ?)
-		 RETURNING id, name, active, created_at`,
+		 RETURNING id, name, active, contract, created_at`,
 		name, hashRouterKey(rawKey),
-	).Scan(&row.ID, &row.Name, &active, &row.CreatedAt)
+	).Scan(&row.ID, &row.Name, &active, &row.Contract, &row.CreatedAt)
 	if err != nil {
 		if isUniqueConstraint(err) {
 			return nil, ErrNameTaken
@@ -141,7 +202,7 @@ func (s *Store) AddRouterKey(name, rawKey string) (*RouterKey, error) {
 
 func (s *Store) ListRouterKeys() ([]*RouterKey, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, active, created_at FROM router_keys ORDER BY id`,
+		`SELECT id, name, active, contract, created_at FROM router_keys ORDER BY id`,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("list router keys: %w", err)
@@ -152,7 +213,7 @@ func (s *Store) ListRouterKeys() ([]*RouterKey, error) {
 	for rows.Next() {
 		r := &RouterKey{}
 		var active int
-		if err := rows.Scan(&r.ID, &r.Name, &active, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &active, &r.Contract, &r.CreatedAt); err != nil {
 			return nil, err
 		}
 		r.Active = active == 1
@@ -164,12 +225,38 @@ func (s *Store) ListRouterKeys() ([]*RouterKey, error) {
 // ValidateRouterKey returns true if rawKey matches any active router key.
 // SHA-256 comparison is fast and safe for 256-bit random keys.
 func (s *Store) ValidateRouterKey(rawKey string) (bool, error) {
-	hash := hashRouterKey(rawKey)
-	var count int
-	err := s.db.QueryRow(
-		`SELECT COUNT(*) FROM router_keys WHERE key_hash = ? AND active = 1`, hash,
-	).Scan(&count)
-	return count > 0, err
+	_, ok, err := s.RouterKeyContract(rawKey)
+	return ok, err
+}
+
+// RouterKeyContract looks up an active router key by its raw value and
+// returns the schema contract bound to it. ok is false when no active key
+// matches.
+func (s *Store) RouterKeyContract(rawKey string) (contract string, ok bool, err error) {
+	err = s.db.QueryRow(
+		`SELECT contract FROM router_keys WHERE key_hash = ? AND active = 1 LIMIT 1`, hashRouterKey(rawKey),
+	).Scan(&contract)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return contract, true, nil
+}
+
+// SetRouterKeyContract binds the named router key to a schema contract;
+// "" removes the binding.
+func (s *Store) SetRouterKeyContract(name, contract string) error {
+	res, err := s.db.Exec(`UPDATE router_keys SET contract = ? WHERE name = ?`, contract, name)
+	if err != nil {
+		return fmt.Errorf("set router key contract: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrRouterKeyNotFound
+	}
+	return nil
 }
 
 func (s *Store) HasActiveRouterKeys() (bool, error) {
@@ -10,23 +10,44 @@ import (
 
 func (s *Store) UpsertService(svc *Service) error {
 	_, err := s.db.Exec(`
-		INSERT INTO services (name, url, type, headers, enabled, timeout_ms, retry_count, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now'))
+		INSERT INTO services (name, url, type, headers, enabled, timeout_ms, retry_count, retry_policy, dedupe, max_response_kb, encoding, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))
 		ON CONFLICT(name) DO UPDATE SET
-			url         = excluded.url,
-			type        = excluded.type,
-			headers     = excluded.headers,
-			enabled     = excluded.enabled,
-			timeout_ms  = excluded.timeout_ms,
-			retry_count = excluded.retry_count,
-			updated_at  = excluded.updated_at
-	`, svc.Name, svc.URL, svc.Type, svc.Headers, boolToInt(svc.Enabled), svc.TimeoutMs, svc.RetryCount)
+			url             = excluded.url,
+			type            = excluded.type,
+			headers         = excluded.headers,
+			enabled         = excluded.enabled,
+			timeout_ms      = excluded.timeout_ms,
+			retry_count     = excluded.retry_count,
+			retry_policy    = excluded.retry_policy,
+			dedupe          = excluded.dedupe,
+			max_response_kb = excluded.max_response_kb,
+			encoding        = excluded.encoding,
+			updated_at      = excluded.updated_at
+	`, svc.Name, svc.URL, svc.Type, svc.Headers, boolToInt(svc.Enabled), svc.TimeoutMs, svc.RetryCount,
+		jsonOrEmpty(svc.RetryPolicy), jsonOrEmpty(svc.Dedupe), svc.MaxResponseKB, svc.Encoding)
 	if err != nil {
 		return fmt.Errorf("upsert service %s: %w", svc.Name, err)
 	}
 	return nil
 }
 
+// SetServiceHeaderRules replaces a service's header propagation rules.
+// UpsertService never touches this column, so rules survive config bootstrap.
+func (s *Store) SetServiceHeaderRules(name, rules string) error {
+	res, err := s.db.Exec(
+		`UPDATE services SET header_rules = ?, updated_at = datetime('now') WHERE name = ?`,
+		jsonOrEmpty(rules), name,
+	)
+	if err != nil {
+		return fmt.Errorf("set header rules for %s: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("service %q not found", name)
+	}
+	return nil
+}
+
 func (s *Store) DeleteService(name string) error {
 	_, err := s.db.Exec(`DELETE FROM services WHERE name = ?`, name)
 	return err
@@ -34,7 +55,7 @@ func (s *Store) DeleteService(name string) error {
 
 func (s *Store) GetService(name string) (*Service, error) {
 	row := s.db.QueryRow(`
-		SELECT id, name, url, type, headers, enabled, timeout_ms, retry_count, created_at, updated_at
+		SELECT id, name, url, type, headers, enabled, timeout_ms, retry_count, retry_policy, dedupe, header_rules, max_response_kb, encoding, created_at, updated_at
 		FROM services WHERE name = ?
 	`, name)
 	return scanService(row)
@@ -42,7 +63,7 @@ func (s *Store) GetService(name string) (*Service, error) {
 
 func (s *Store) ListServices() ([]*Service, error) {
 	rows, err := s.db.Query(`
-		SELECT id, name, url, type, headers, enabled, timeout_ms, retry_count, created_at, updated_at
+		SELECT id, name, url, type, headers, enabled, timeout_ms, retry_count, retry_policy, dedupe, header_rules, max_response_kb, encoding, created_at, updated_at
 		FROM services ORDER BY name
 	`)
 	if err != nil {
@@ -67,7 +88,8 @@ func scanService(s scanner) (*Service, error) {
 	var enabled int
 	err := s.Scan(
 		&svc.ID, &svc.Name, &svc.URL, &svc.Type,
-		&svc.Headers, &enabled, &svc.TimeoutMs, &svc.RetryCount,
+		&svc.Headers, &enabled, &svc.TimeoutMs, &svc.RetryCount, &svc.RetryPolicy, &svc.Dedupe, &svc.HeaderRules,
+		&svc.MaxResponseKB, &svc.Encoding,
 		&createdAt, &updatedAt,
 	)
 	if err == sql.ErrNoRows {
@@ -89,7 +111,7 @@ func (s *Store) UpsertSchemaCache(serviceName, sdl string) error {
 		INSERT INTO schema_cache (service_name, sdl, fetched_at)
 		VALUES (?, ?, datetime('now'))
 		ON CONFLICT(service_name) DO UPDATE SET
-			sdl        = excluded.sdl,
+			sdl          = excluded.sdl,
 			fetched_at = excluded.fetched_at
 	`, serviceName, sdl)
 	return err
@@ -118,6 +140,14 @@ func (s *Store) DeleteSchemaCache(serviceName string) error {
 
 // --- helpers ---
 
+// jsonOrEmpty defaults an unset JSON column value to an empty object.
+func jsonOrEmpty(raw string) string {
+	if raw == "" {
+		return "{}"
+	}
+	return raw
+}
+
 type scanner interface {
 	Scan(dest ...any) error
 }
@@ -4,17 +4,23 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"slices"
+	"sync"
 	"time"
 )
 
-// Store writes and queries the query_log table in metrics.db.
+// Store writes and queries the query_log table in metrics.db. It also keeps
+// in-memory counters, which restart from zero with the process.
 type Store struct {
 	db *sql.DB
+
+	mu           sync.Mutex
+	authFailures map[string]int64
 }
 
 func New(db *sql.DB) *Store {
-	return &Store{db: db}
+	return &Store{db: db, authFailures: map[string]int64{}}
 }
 
 // QueryEntry is one recorded GraphQL operation.
@@ -37,6 +43,13 @@ func (s *Store) RecordQuery(e *QueryEntry) error {
 	return err
 }
 
+// RecordAuthFailure counts a request whose token was rejected for reason.
+func (s *Store) RecordAuthFailure(reason string) {
+	s.mu.Lock()
+	s.authFailures[reason]++
+	s.mu.Unlock()
+}
+
 // ── Summary types ─────────────────────────────────────────────────────────────
 
 type Summary struct {
@@ -49,6 +62,8 @@ type Summary struct {
 	LatencyP99Ms int64          `json:"latency_p99_ms"`
 	Operations   []*OpStat      `json:"operations"`
 	RecentErrors []*RecentError `json:"recent_errors"`
+	// AuthFailures counts rejected tokens per reason since start.
+	AuthFailures map[string]int64 `json:"auth_failures"`
 }
 
 type OpStat struct {
@@ -100,6 +115,9 @@ func (s *Store) Summary(limit int) (*Summary, error) {
 		Operations:   ops,
 		RecentErrors: recent,
 	}
+	s.mu.Lock()
+	sum.AuthFailures = maps.Clone(s.authFailures)
+	s.mu.Unlock()
 	if totals.total > 0 {
 		sum.ErrorRate = float64(sum.ErrorCount) / float64(totals.total)
 	}
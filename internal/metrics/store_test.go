@@ -53,6 +53,9 @@ func TestRecordAndSummary(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
+	s.RecordAuthFailure("expired")
+	s.RecordAuthFailure("expired")
+	s.RecordAuthFailure("malformed")
 
 	sum, err := s.Summary(10)
 	if err != nil {
@@ -80,6 +83,9 @@ func TestRecordAndSummary(t *testing.T) {
 	if len(sum.RecentErrors) != 2 {
 		t.Errorf("expected 2 recent errors, got %d", len(sum.RecentErrors))
 	}
+	if sum.AuthFailures["expired"] != 2 || sum.AuthFailures["malformed"] != 1 {
+		t.Errorf("expected auth failures expired=2 malformed=1, got %v", sum.AuthFailures)
+	}
 }
 
 func TestPercentile(t *testing.T) {
@@ -0,0 +1,185 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/vektah/gqlparser/v2/ast"
+
+	"github.com/deformal/kastql/internal/metadata"
+)
+
+// Contract is a named subset of the merged schema selected by @tag. A field
+// is part of the contract when neither it nor its type carries an excluded
+// tag and, if Include is set, one of them carries an included tag. Types
+// left without fields disappear along with everything that refers to them.
+type Contract struct {
+	Name    string   `json:"name"`
+	Include []string `json:"include_tags"`
+	Exclude []string `json:"exclude_tags"`
+	Roles   []string `json:"roles"`
+}
+
+// ParseContract decodes a contract row from the metadata store.
+func ParseContract(c *metadata.Contract) (*Contract, error) {
+	out := &Contract{Name: c.Name}
+	for _, f := range []struct {
+		raw  string
+		dst  *[]string
+		name string
+	}{
+		{c.IncludeTags, &out.Include, "include_tags"},
+		{c.ExcludeTags, &out.Exclude, "exclude_tags"},
+		{c.Roles, &out.Roles, "roles"},
+	} {
+		if f.raw == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(f.raw), f.dst); err != nil {
+			return nil, fmt.Errorf("decode contract %s %s: %w", c.Name, f.name, err)
+		}
+	}
+	return out, nil
+}
+
+// allows reports whether typeName.fieldName is part of the contract.
+func (c *Contract) allows(tags map[string][]string, typeName, fieldName string) bool {
+	own := tags[typeName+"."+fieldName]
+	parent := tags[typeName]
+	has := func(list []string) bool {
+		for _, t := range list {
+			if slices.Contains(own, t) || slices.Contains(parent, t) {
+				return true
+			}
+		}
+		return false
+	}
+	if has(c.Exclude) {
+		return false
+	}
+	return len(c.Include) == 0 || has(c.Include)
+}
+
+type contractCtxKey struct{}
+
+// WithContract returns a context whose queries are planned against the named
+// contract, overriding any contract bound to the caller's role.
+func WithContract(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contractCtxKey{}, name)
+}
+
+// contractCache holds the contracts from the store and the schemas built
+// from them for one merged schema. schemas is guarded by Planner.contractMu;
+// the rest is immutable once loaded.
+type contractCache struct {
+	merged  *MergedSchema
+	byName  map[string]*Contract
+	byRole  map[string]*Contract
+	schemas map[string]*ast.Schema
+}
+
+// ResetContracts drops the cached contracts so the next plan reloads them
+// from the store. Call after creating or dropping a contract.
+func (p *Planner) ResetContracts() {
+	p.contractMu.Lock()
+	p.contracts = nil
+	p.contractGen++
+	p.contractMu.Unlock()
+}
+
+// callerSchema returns the schema a caller may query: the contract named in
+// ctx, else the contract bound to role, else the full merged schema. Plans
+// only take the read lock; the store and filterSchema run unlocked, so a
+// cold contract never stalls callers of other contracts.
+func (p *Planner) callerSchema(ctx context.Context, merged *MergedSchema, role string) (*ast.Schema, error) {
+	cache, err := p.contractsFor(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *Contract
+	if name, _ := ctx.Value(contractCtxKey{}).(string); name != "" {
+		if c = cache.byName[name]; c == nil {
+			return nil, fmt.Errorf("schema contract %q not found", name)
+		}
+	} else if c = cache.byRole[role]; c == nil {
+		return merged.Schema, nil
+	}
+
+	p.contractMu.RLock()
+	schema := cache.schemas[c.Name]
+	p.contractMu.RUnlock()
+	if schema != nil {
+		return schema, nil
+	}
+
+	schema = filterSchema(merged.Schema, func(typeName, fieldName string) bool {
+		return c.allows(merged.Tags, typeName, fieldName)
+	})
+	p.contractMu.Lock()
+	defer p.contractMu.Unlock()
+	if built := cache.schemas[c.Name]; built != nil {
+		return built, nil // another plan got there first
+	}
+	cache.schemas[c.Name] = schema
+	return schema, nil
+}
+
+// contractsFor returns the contract cache for merged, loading it from the
+// store when it is missing or belongs to an older merged schema.
+func (p *Planner) contractsFor(merged *MergedSchema) (*contractCache, error) {
+	p.contractMu.RLock()
+	cache, gen := p.contracts, p.contractGen
+	p.contractMu.RUnlock()
+	if cache != nil && cache.merged == merged {
+		return cache, nil
+	}
+
+	cache, err := p.loadContracts(merged)
+	if err != nil {
+		return nil, err
+	}
+	p.contractMu.Lock()
+	defer p.contractMu.Unlock()
+	if cur := p.contracts; cur != nil && cur.merged == merged {
+		return cur, nil
+	}
+	if p.contractGen == gen {
+		p.contracts = cache
+	}
+	return cache, nil
+}
+
+func (p *Planner) loadContracts(merged *MergedSchema) (*contractCache, error) {
+	cache := &contractCache{
+		merged:  merged,
+		byName:  map[string]*Contract{},
+		byRole:  map[string]*Contract{},
+		schemas: map[string]*ast.Schema{},
+	}
+	if p.store == nil {
+		return cache, nil
+	}
+	rows, err := p.store.ListContracts()
+	if err != nil {
+		return nil, fmt.Errorf("load contracts: %w", err)
+	}
+	for _, row := range rows {
+		c, err := ParseContract(row)
+		if err != nil {
+			return nil, err
+		}
+		cache.byName[c.Name] = c
+		for _, role := range c.Roles {
+			if cache.byRole[role] == nil {
+				cache.byRole[role] = c
+			}
+		}
+	}
+	return cache, nil
+}
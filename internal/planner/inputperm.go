@@ -0,0 +1,167 @@
+package planner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// InputChecker is optionally implemented by a PermissionChecker to restrict
+// the arguments and input object fields a role may set. InputRule looks up
+// the rule for an argument, named "field(arg)" on the type declaring the
+// field, or for a field of an input object type, passed to service. found
+// is false when no rule exists; the input is then allowed whenever the field
+// is.
+//
+// condition is a set of operators the value must satisfy, such as
+// {"_neq": true}. preset, when non-nil, replaces the argument's value
+// whatever the client sent. Session variables in both are already resolved.
+type InputChecker interface {
+	InputRule(ctx context.Context, role, service, typeName, fieldName string) (allow bool, condition map[string]any, preset any, found bool, err error)
+}
+
+type inputRule struct {
+	allow     bool
+	condition map[string]any
+	preset    any
+	found     bool
+}
+
+// inputRule returns the rule for typeName.fieldName in service, cached for
+// the plan.
+func (ps *planSession) inputRule(service, typeName, fieldName string) (inputRule, error) {
+	ic, ok := ps.checker.(InputChecker)
+	if !ok {
+		return inputRule{}, nil
+	}
+	key := service + "\x00" + typeName + "." + fieldName
+	if r, ok := ps.inputRules[key]; ok {
+		return r, nil
+	}
+	var r inputRule
+	var err error
+	r.allow, r.condition, r.preset, r.found, err = ic.InputRule(ps.ctx, ps.role, service, typeName, fieldName)
+	if err != nil {
+		return inputRule{}, fmt.Errorf("permission check error: %w", err)
+	}
+	if ps.inputRules == nil {
+		ps.inputRules = map[string]inputRule{}
+	}
+	ps.inputRules[key] = r
+	return r, nil
+}
+
+// checkArguments enforces argument and input field permissions on a field
+// of typeName resolved by service. Arguments with a preset are replaced by
+// it; the returned field is the one to plan.
+func (ps *planSession) checkArguments(service, typeName string, field *ast.Field) (*ast.Field, error) {
+	if _, ok := ps.checker.(InputChecker); !ok {
+		return field, nil
+	}
+	var presets ast.ArgumentList
+	for _, argDef := range field.Definition.Arguments {
+		name := field.Name + "(" + argDef.Name + ")"
+		rule, err := ps.inputRule(service, typeName, name)
+		if err != nil {
+			return nil, err
+		}
+		if rule.found && rule.preset != nil {
+			val := literalValue(rule.preset)
+			if val == nil {
+				return nil, fmt.Errorf("preset for %s.%s is not a scalar value", typeName, name)
+			}
+			presets = append(presets, &ast.Argument{Name: argDef.Name, Value: val})
+			ps.usesClaims = true
+			continue
+		}
+
+		arg := field.Arguments.ForName(argDef.Name)
+		if arg == nil {
+			continue
+		}
+		value, err := arg.Value.Value(ps.variables)
+		if err != nil {
+			return nil, err
+		}
+		if err := ps.checkInput(rule, typeName+"."+name, value); err != nil {
+			return nil, err
+		}
+		if err := ps.checkInputObject(service, argDef.Type, value); err != nil {
+			return nil, err
+		}
+	}
+	if len(presets) == 0 {
+		return field, nil
+	}
+
+	clone := *field
+	clone.Arguments = nil
+	for _, a := range field.Arguments {
+		if presets.ForName(a.Name) == nil {
+			clone.Arguments = append(clone.Arguments, a)
+		}
+	}
+	clone.Arguments = append(clone.Arguments, presets...)
+	return &clone, nil
+}
+
+// checkInput applies a rule to a value the client set. Null values are not
+// checked: they set nothing.
+func (ps *planSession) checkInput(rule inputRule, name string, value any) error {
+	if !rule.found || value == nil {
+		return nil
+	}
+	if !rule.allow {
+		return fmt.Errorf("permission denied: role %q cannot set %s", ps.role, name)
+	}
+	for op, want := range rule.condition {
+		if !matchOperator(op, value, want) {
+			return fmt.Errorf("permission denied: role %q cannot set %s to %v", ps.role, name, value)
+		}
+	}
+	return nil
+}
+
+// checkInputObject walks a value of input type t, checking every input
+// object field that is set, including those inside lists.
+func (ps *planSession) checkInputObject(service string, t *ast.Type, value any) error {
+	if t == nil || value == nil {
+		return nil
+	}
+	if t.Elem != nil {
+		list, ok := value.([]any)
+		if !ok {
+			// A single value is coerced to a one-element list.
+			return ps.checkInputObject(service, t.Elem, value)
+		}
+		for _, v := range list {
+			if err := ps.checkInputObject(service, t.Elem, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	def := ps.merged.Schema.Types[t.NamedType]
+	obj, ok := value.(map[string]any)
+	if def == nil || def.Kind != ast.InputObject || !ok {
+		return nil
+	}
+	for _, f := range def.Fields {
+		v, set := obj[f.Name]
+		if !set {
+			continue
+		}
+		rule, err := ps.inputRule(service, def.Name, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := ps.checkInput(rule, def.Name+"."+f.Name, v); err != nil {
+			return err
+		}
+		if err := ps.checkInputObject(service, f.Type, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
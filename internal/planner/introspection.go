@@ -1,7 +1,9 @@
 package planner
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/vektah/gqlparser/v2/ast"
 )
@@ -195,6 +197,9 @@ func (b *introspectionBuilder) kindOf(name string) string {
 func (b *introspectionBuilder) buildFields(fields ast.FieldList) []map[string]any {
 	result := make([]map[string]any, 0, len(fields))
 	for _, f := range fields {
+		if strings.HasPrefix(f.Name, "__") {
+			continue // __schema / __type are implicit, not listed
+		}
 		dep := f.Directives.ForName("deprecated")
 		isDeprecated := dep != nil
 		var deprecationReason any
@@ -330,3 +335,154 @@ func nilStr(s string) any {
 	}
 	return s
 }
+
+// resolveMetaField answers one root meta-field (__schema, __type or
+// __typename) from schema, shaped by the field's selection set. Type data
+// comes from BuildIntrospectionResponse over the caller's schema, so hidden
+// types and fields never appear.
+func (ps *planSession) resolveMetaField(field *ast.Field, rootType string) (any, error) {
+	if field.Name == "__typename" {
+		return rootType, nil
+	}
+	idx, err := ps.introspectionIndex()
+	if err != nil {
+		return nil, err
+	}
+	p := &introspectionProjector{variables: ps.variables, fragments: ps.fragments, types: idx.types}
+	switch field.Name {
+	case "__schema":
+		return p.project(idx.schema, field.SelectionSet, "__Schema"), nil
+	case "__type":
+		name, _ := field.ArgumentMap(ps.variables)["name"].(string)
+		t, ok := idx.types[name]
+		if !ok {
+			return nil, nil
+		}
+		return p.project(t, field.SelectionSet, "__Type"), nil
+	}
+	return nil, fmt.Errorf("unknown meta-field %q", field.Name)
+}
+
+// introspectionData is the full introspection result for one schema, with
+// its types indexed by name.
+type introspectionData struct {
+	schema map[string]any
+	types  map[string]map[string]any
+}
+
+// introspectionIndex builds the role's introspection data once per plan.
+func (ps *planSession) introspectionIndex() (*introspectionData, error) {
+	if ps.introspection != nil {
+		return ps.introspection, nil
+	}
+	schema, err := roleSchema(ps.ctx, ps.merged, ps.schema, ps.checker, ps.role)
+	if err != nil {
+		return nil, fmt.Errorf("permission check error: %w", err)
+	}
+	full := BuildIntrospectionResponse(schema)["__schema"].(map[string]any)
+	idx := &introspectionData{schema: full, types: map[string]map[string]any{}}
+	for _, t := range full["types"].([]map[string]any) {
+		idx.types[t["name"].(string)] = t
+	}
+	ps.introspection = idx
+	return idx, nil
+}
+
+// introspectionProjector shapes introspection maps to a selection set,
+// applying aliases, fragments, @skip / @include and includeDeprecated.
+type introspectionProjector struct {
+	variables map[string]any
+	fragments ast.FragmentDefinitionList
+	types     map[string]map[string]any
+}
+
+func (p *introspectionProjector) project(value any, sel ast.SelectionSet, typeName string) any {
+	switch v := value.(type) {
+	case []map[string]any:
+		out := make([]any, 0, len(v))
+		for _, item := range v {
+			out = append(out, p.project(item, sel, typeName))
+		}
+		return out
+	case map[string]any:
+		out := map[string]any{}
+		p.projectObject(v, sel, typeName, out)
+		return out
+	}
+	return value
+}
+
+func (p *introspectionProjector) projectObject(obj map[string]any, sel ast.SelectionSet, typeName string, out map[string]any) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *ast.Field:
+			if !p.included(s.Directives) {
+				continue
+			}
+			if s.Name == "__typename" {
+				out[s.Alias] = typeName
+				continue
+			}
+			val, ok := obj[s.Name]
+			if !ok && typeName == "__Type" {
+				// Type references only carry kind, name and ofType; the
+				// rest comes from the full type.
+				if name, _ := obj["name"].(string); name != "" {
+					val = p.types[name][s.Name]
+				}
+			}
+			val = p.withoutDeprecated(s, val)
+			childType := ""
+			if s.Definition != nil {
+				childType = namedTypeName(s.Definition.Type)
+			}
+			out[s.Alias] = p.project(val, s.SelectionSet, childType)
+		case *ast.InlineFragment:
+			if p.included(s.Directives) && (s.TypeCondition == "" || s.TypeCondition == typeName) {
+				p.projectObject(obj, s.SelectionSet, typeName, out)
+			}
+		case *ast.FragmentSpread:
+			def := p.fragments.ForName(s.Name)
+			if def != nil && p.included(s.Directives) && def.TypeCondition == typeName {
+				p.projectObject(obj, def.SelectionSet, typeName, out)
+			}
+		}
+	}
+}
+
+// withoutDeprecated drops deprecated fields and enum values unless the
+// selection asks for includeDeprecated: true.
+func (p *introspectionProjector) withoutDeprecated(field *ast.Field, val any) any {
+	if field.Name != "fields" && field.Name != "enumValues" {
+		return val
+	}
+	items, ok := val.([]map[string]any)
+	if !ok {
+		return val
+	}
+	if include, _ := field.ArgumentMap(p.variables)["includeDeprecated"].(bool); include {
+		return val
+	}
+	out := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if dep, _ := item["isDeprecated"].(bool); !dep {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// included evaluates @skip and @include.
+func (p *introspectionProjector) included(dirs ast.DirectiveList) bool {
+	if d := dirs.ForName("skip"); d != nil {
+		if skip, _ := d.ArgumentMap(p.variables)["if"].(bool); skip {
+			return false
+		}
+	}
+	if d := dirs.ForName("include"); d != nil {
+		if include, _ := d.ArgumentMap(p.variables)["if"].(bool); !include {
+			return false
+		}
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package planner
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 
 	gqlparser "github.com/vektah/gqlparser/v2"
@@ -46,11 +47,17 @@ func Merge(entries []*registry.ServiceEntry) (*MergedSchema, error) {
 		SubscriptionOwnership: make(map[string]string),
 		TypeOwnership:         make(map[string]string),
 		EntityKeys:            make(map[string]map[string][]string),
+		Tags:                  make(map[string][]string),
 		ServiceURLs:           make(map[string]string),
 		ServiceTypes:          make(map[string]string),
 		ServiceHeaders:        make(map[string]map[string]string),
 		ServiceTimeoutMs:      make(map[string]int),
+		ServiceMaxBodyKB:      make(map[string]int),
+		ServiceEncoding:       make(map[string]string),
 		ServiceRetryCount:     make(map[string]int),
+		ServiceRetry:          make(map[string]RetryPolicy),
+		ServiceDedupe:         make(map[string]DedupePolicy),
+		ServiceHeaderRule:     make(map[string]HeaderRules),
 	}
 
 	// accumulated type definitions (name → definition)
@@ -66,7 +73,27 @@ func Merge(entries []*registry.ServiceEntry) (*MergedSchema, error) {
 			result.ServiceHeaders[entry.Name] = h
 		}
 		result.ServiceTimeoutMs[entry.Name] = entry.TimeoutMs
+		result.ServiceMaxBodyKB[entry.Name] = entry.MaxResponseKB
+		result.ServiceEncoding[entry.Name] = entry.Encoding
 		result.ServiceRetryCount[entry.Name] = entry.RetryCount
+		policy, err := ParseRetryPolicy(entry.RetryPolicy)
+		if err != nil {
+			// One bad row must not take the whole gateway down.
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("retry policy for %s: %v; using the default", entry.Name, err))
+			policy = RetryPolicy{}
+		}
+		result.ServiceRetry[entry.Name] = policy
+		dedupe, err := ParseDedupePolicy(entry.Dedupe)
+		if err != nil {
+			return nil, fmt.Errorf("dedupe policy for %s: %w", entry.Name, err)
+		}
+		result.ServiceDedupe[entry.Name] = dedupe
+		headerRules, err := ParseHeaderRules(entry.HeaderRules)
+		if err != nil {
+			return nil, fmt.Errorf("header rules for %s: %w", entry.Name, err)
+		}
+		result.ServiceHeaderRule[entry.Name] = headerRules
 
 		doc, err := parseServiceSDL(entry)
 		if err != nil {
@@ -78,6 +105,7 @@ func Merge(entries []*registry.ServiceEntry) (*MergedSchema, error) {
 			if def.BuiltIn {
 				continue
 			}
+			recordTags(def, result.Tags)
 			processDefinition(def, entry.Name, false, result,
 				queryFields, mutationFields, subscriptionFields, otherTypes)
 		}
@@ -87,6 +115,7 @@ func Merge(entries []*registry.ServiceEntry) (*MergedSchema, error) {
 			if ext.BuiltIn {
 				continue
 			}
+			recordTags(ext, result.Tags)
 			processDefinition(ext, entry.Name, true, result,
 				queryFields, mutationFields, subscriptionFields, otherTypes)
 		}
@@ -259,6 +288,27 @@ func processDefinition(
 	}
 }
 
+// recordTags adds the @tag names on def and its fields to tags. Tags from
+// every service contributing to a type or field are combined.
+func recordTags(def *ast.Definition, tags map[string][]string) {
+	if federationScalarNames[def.Name] || strings.HasPrefix(def.Name, "__") {
+		return
+	}
+	add := func(key string, dirs ast.DirectiveList) {
+		for _, d := range dirs.ForNames("tag") {
+			arg := d.Arguments.ForName("name")
+			if arg == nil || arg.Value == nil || slices.Contains(tags[key], arg.Value.Raw) {
+				continue
+			}
+			tags[key] = append(tags[key], arg.Value.Raw)
+		}
+	}
+	add(def.Name, def.Directives)
+	for _, f := range def.Fields {
+		add(def.Name+"."+f.Name, f.Directives)
+	}
+}
+
 // allFieldsExternal returns true if every field in the definition is @external,
 // meaning this service is just referencing a type it doesn't own.
 func allFieldsExternal(def *ast.Definition) bool {
@@ -308,6 +358,12 @@ func stripFederationFromDef(def *ast.Definition) *ast.Definition {
 	return &stripped
 }
 
+// streamDirectiveSDL declares @stream so clients can request incremental
+// delivery of list fields.
+const streamDirectiveSDL = `directive @stream(if: Boolean! = true, label: String, initialCount: Int = 0) on FIELD
+
+`
+
 // buildMergedSDL constructs the final merged SDL string from collected types.
 func buildMergedSDL(
 	queryFields, mutationFields, subscriptionFields map[string]*ast.FieldDefinition,
@@ -315,6 +371,9 @@ func buildMergedSDL(
 ) string {
 	var b strings.Builder
 
+	// @defer is part of the gqlparser prelude; @stream is not yet.
+	b.WriteString(streamDirectiveSDL)
+
 	if len(queryFields) > 0 {
 		b.WriteString("type Query {\n")
 		for _, f := range queryFields {
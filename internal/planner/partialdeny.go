@@ -0,0 +1,95 @@
+package planner
+
+import (
+	"fmt"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// PartialDenier is optionally implemented by a PermissionChecker to let a
+// role's queries go ahead without the fields it may not access. Those fields
+// are stripped from the plan and come back as null, each with a FORBIDDEN
+// error, instead of the whole operation being refused. A non-null field
+// nulls its nearest nullable parent instead.
+type PartialDenier interface {
+	PartialDeny(role string) (bool, error)
+}
+
+// DeniedField is a field stripped from the plan under partial denial. Path
+// holds response keys from the root of the data. NullPath is the prefix of
+// Path the executor sets to null: Path itself, or for a non-null field its
+// nearest nullable ancestor, as GraphQL propagates nulls. Message is
+// reported at Path. A nil NullPath means Path.
+type DeniedField struct {
+	Path     []string
+	NullPath []string
+	Message  string
+}
+
+// DeniedPlaceholder is the response key selected in place of a selection set
+// left empty by partial denial, which GraphQL does not allow. The executor
+// removes it along with nulling the denied fields.
+const DeniedPlaceholder = "kastql_denied"
+
+// partialDeny reports whether the role's forbidden fields are stripped
+// rather than failing the plan.
+func (ps *planSession) partialDeny() (bool, error) {
+	pd, ok := ps.checker.(PartialDenier)
+	if !ok {
+		return false, nil
+	}
+	on, err := pd.PartialDeny(ps.role)
+	if err != nil {
+		return false, fmt.Errorf("permission check error: %w", err)
+	}
+	return on, nil
+}
+
+// deny records field as stripped. Root fields are nulled in the merged
+// response; nested ones in the data of the root step being built. A
+// non-null field whose null would propagate to the root of the data can't
+// be stripped; deny returns its error so the plan fails instead.
+func (ps *planSession) deny(field *ast.Field, parentPath []string, err error) error {
+	path := append(append([]string{}, parentPath...), field.Alias)
+	at := len(path)
+	if field.Definition.Type.NonNull {
+		at = 0
+		for i := len(parentPath) - 1; i >= 0; i-- {
+			if ps.nullable[i] {
+				at = i + 1
+				break
+			}
+		}
+		if at == 0 {
+			return err
+		}
+	}
+	d := DeniedField{Path: path, NullPath: path[:at], Message: err.Error()}
+	if len(parentPath) == 0 {
+		ps.deniedRoots = append(ps.deniedRoots, d)
+		return nil
+	}
+	ps.denied = append(ps.denied, d)
+	return nil
+}
+
+// walkField walks sel, the selection of field at path. It records whether
+// field is nullable so deny can find where a denied field's null lands.
+func (ps *planSession) walkField(field *ast.Field, sel ast.SelectionSet, parentStepID, service, typeName string, path []string) (ast.SelectionSet, []*Step, error) {
+	ps.nullable = append(ps.nullable, !field.Definition.Type.NonNull)
+	defer func() { ps.nullable = ps.nullable[:len(ps.nullable)-1] }()
+	return ps.walkSelections(sel, parentStepID, service, typeName, path)
+}
+
+func deniedPlaceholder() *ast.Field {
+	return &ast.Field{Alias: DeniedPlaceholder, Name: "__typename"}
+}
+
+// onlyPlaceholder reports whether every field of sel was denied.
+func onlyPlaceholder(sel ast.SelectionSet) bool {
+	if len(sel) != 1 {
+		return false
+	}
+	f, ok := sel[0].(*ast.Field)
+	return ok && f.Alias == DeniedPlaceholder
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,9 +19,10 @@ import (
 )
 
 // PermissionChecker is implemented by auth.Checker to enforce field-level access.
-// Defined here to avoid a circular import between auth ↔ planner.
+// Defined here to avoid a circular import between auth ↔ planner. service is
+// the service that resolves the field, so rules can be scoped to one service.
 type PermissionChecker interface {
-	CanAccess(ctx context.Context, role, typeName, fieldName string) (bool, error)
+	CanAccess(ctx context.Context, role, service, typeName, fieldName string) (bool, error)
 }
 
 // Planner plans GraphQL queries against a merged schema.
@@ -31,6 +33,10 @@ type Planner struct {
 	log     *zap.Logger
 	stepSeq atomic.Uint64
 	checker PermissionChecker // optional; nil = allow everything
+
+	contractMu  sync.RWMutex
+	contracts   *contractCache // loaded on first use; nil after ResetContracts
+	contractGen uint64         // bumped by ResetContracts so an in-flight load isn't installed
 }
 
 // New creates a Planner. Call Update whenever the service registry changes.
@@ -43,6 +49,25 @@ func (p *Planner) SetChecker(c PermissionChecker) {
 	p.checker = c
 }
 
+// Checker returns the attached permission checker, or nil.
+func (p *Planner) Checker() PermissionChecker {
+	return p.checker
+}
+
+// PermissionReloader is implemented by permission checkers that cache rules.
+type PermissionReloader interface {
+	Reload() error
+}
+
+// ReloadPermissions refreshes the checker's cached rules, if it keeps any.
+// Call after permissions change.
+func (p *Planner) ReloadPermissions() error {
+	if r, ok := p.checker.(PermissionReloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
 // Update rebuilds the merged schema from the current registry state.
 // Call this after any service add/remove/reload.
 func (p *Planner) Update(entries []*registry.ServiceEntry) error {
@@ -59,6 +84,9 @@ func (p *Planner) Update(entries []*registry.ServiceEntry) error {
 	p.mu.Lock()
 	p.merged = merged
 	p.mu.Unlock()
+	for _, w := range merged.Warnings {
+		p.log.Warn("schema merge", zap.String("warning", w))
+	}
 	p.log.Info("planner schema updated",
 		zap.Int("services", len(entries)),
 		zap.Int("query_fields", len(merged.QueryOwnership)),
@@ -131,9 +159,11 @@ func (p *Planner) MergedSDL() string {
 	return p.merged.SDL
 }
 
-// Plan parses the query and produces a QueryPlan. Returns an error if the
-// query is invalid, no schema is loaded, or a permission check fails.
-func (p *Planner) Plan(_ context.Context, query string, variables map[string]any, role string) (*QueryPlan, error) {
+// Plan parses the query and produces a QueryPlan for the operation selected
+// by WithOperationName. Returns an error if the query is invalid, no schema
+// is loaded, the operation cannot be selected, or a permission check fails.
+// Queries are validated against the caller's schema contract, if any.
+func (p *Planner) Plan(ctx context.Context, query string, variables map[string]any, role string) (*QueryPlan, error) {
 	p.mu.RLock()
 	merged := p.merged
 	p.mu.RUnlock()
@@ -142,48 +172,112 @@ func (p *Planner) Plan(_ context.Context, query string, variables map[string]any
 		return nil, errors.New("no schema loaded — register at least one service")
 	}
 
-	doc, gqlErr := gqlparser.LoadQueryWithRules(merged.Schema, query, rules.NewDefaultRules())
+	schema, err := p.callerSchema(ctx, merged, role)
+	if err != nil {
+		return nil, err
+	}
+	doc, gqlErr := gqlparser.LoadQueryWithRules(schema, query, rules.NewDefaultRules())
 	if gqlErr != nil {
 		return nil, gqlErr
 	}
 
 	ps := &planSession{
+		ctx:       ctx,
 		p:         p,
 		merged:    merged,
+		schema:    schema,
 		variables: variables,
 		fragments: doc.Fragments,
 		store:     p.store,
 		role:      role,
 		checker:   p.checker,
 	}
+	if ps.stripDenied, err = ps.partialDeny(); err != nil {
+		return nil, err
+	}
 
-	var allSteps []*Step
-	plan := &QueryPlan{}
-	for i, op := range doc.Operations {
-		if i == 0 {
-			plan.OperationType = strings.ToLower(string(op.Operation))
-			plan.OperationName = op.Name
-		}
-		steps, err := ps.planOperation(op)
-		if err != nil {
-			return nil, err
-		}
-		allSteps = append(allSteps, steps...)
+	op, err := selectOperation(doc.Operations, operationName(ctx))
+	if err != nil {
+		return nil, err
+	}
+	steps, err := ps.planOperation(op)
+	if err != nil {
+		return nil, err
 	}
 
-	plan.Steps = allSteps
+	plan := &QueryPlan{
+		OperationType: strings.ToLower(string(op.Operation)),
+		OperationName: op.Name,
+	}
+	plan.Steps = steps
+	plan.Streams = ps.streams
+	plan.Introspection = ps.meta
+	plan.Introspects = ps.introspects
+	plan.Denied = ps.deniedRoots
+	plan.UsesClaims = ps.usesClaims
 	return plan, nil
 }
 
+type operationNameCtxKey struct{}
+
+// WithOperationName returns a context whose documents are planned for the
+// named operation, as a request's operationName selects it.
+func WithOperationName(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, operationNameCtxKey{}, name)
+}
+
+func operationName(ctx context.Context) string {
+	name, _ := ctx.Value(operationNameCtxKey{}).(string)
+	return name
+}
+
+// selectOperation picks the operation to execute: the one named name, or the
+// document's only operation when name is empty. Only that operation is
+// planned, so a document cannot smuggle a mutation in behind a query.
+func selectOperation(ops ast.OperationList, name string) (*ast.OperationDefinition, error) {
+	if name == "" {
+		if len(ops) != 1 {
+			return nil, errors.New("operationName is required when the document contains several operations")
+		}
+		return ops[0], nil
+	}
+	if op := ops.ForName(name); op != nil {
+		return op, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
 // planSession holds per-request state for planning.
 type planSession struct {
+	ctx       context.Context
 	p         *Planner
 	merged    *MergedSchema
+	schema    *ast.Schema // merged.Schema narrowed to the caller's contract
 	variables map[string]any
 	fragments ast.FragmentDefinitionList
 	store     *metadata.Store
 	role      string
 	checker   PermissionChecker
+	streams   []StreamMeta
+
+	rowFilters []RowFilter          // row conditions of the root step being built
+	inputRules map[string]inputRule // argument and input field rules looked up so far
+	usesClaims bool                 // a row condition or preset was applied
+
+	// Under partial denial forbidden fields are stripped instead of failing
+	// the plan.
+	stripDenied bool
+	denied      []DeniedField // nested fields denied in the root step being built
+	deniedRoots []DeniedField // denied root fields
+	nullable    []bool        // per key of the path being walked: its field is nullable
+
+	// Root meta-fields are answered here rather than by a service.
+	meta          map[string]any     // response key → value
+	introspects   bool               // __schema or __type was selected
+	introspection *introspectionData // built on first use
 }
 
 func (ps *planSession) nextID() string {
@@ -194,59 +288,231 @@ func (ps *planSession) nextID() string {
 func (ps *planSession) planOperation(op *ast.OperationDefinition) ([]*Step, error) {
 	opType := strings.ToLower(string(op.Operation))
 
+	// Root fields are checked under the schema's real root type name, the
+	// same question introspection filtering asks of the checker.
 	var ownershipMap map[string]string
+	var root *ast.Definition
 	switch op.Operation {
 	case ast.Query:
-		ownershipMap = ps.merged.QueryOwnership
+		ownershipMap, root = ps.merged.QueryOwnership, ps.merged.Schema.Query
 	case ast.Mutation:
-		ownershipMap = ps.merged.MutationOwnership
+		ownershipMap, root = ps.merged.MutationOwnership, ps.merged.Schema.Mutation
 	case ast.Subscription:
-		ownershipMap = ps.merged.SubscriptionOwnership
+		ownershipMap, root = ps.merged.SubscriptionOwnership, ps.merged.Schema.Subscription
 	default:
 		return nil, fmt.Errorf("unknown operation type: %s", op.Operation)
 	}
+	if root == nil {
+		return nil, fmt.Errorf("schema does not support %s operations", opType)
+	}
 
-	// Group root selections by owning service
-	byService := map[string]ast.SelectionSet{}
-	for _, sel := range op.SelectionSet {
-		field, ok := sel.(*ast.Field)
-		if !ok {
-			continue // inline fragments at root — skip for now
+	// Group root selections by owning service. Mutation fields execute
+	// serially in document order, so only contiguous fields of the same
+	// service share a step; the executor runs those steps one at a time.
+	// Fields from a @defer fragment get their own group so they can be
+	// delivered after the rest of the response.
+	type serviceGroup struct {
+		service    string
+		deferred   *DeferMeta
+		selections ast.SelectionSet
+	}
+	var groups []*serviceGroup
+	byService := map[string]*serviceGroup{}
+	for _, rf := range ps.rootFields(op.SelectionSet, nil, op.Operation != ast.Mutation) {
+		if strings.HasPrefix(rf.field.Name, "__") {
+			if err := ps.addMetaField(op, rf.field); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		svc := ownershipMap[field.Name]
+		svc := ownershipMap[rf.field.Name]
 		if svc == "" {
-			return nil, fmt.Errorf("field %q not found in any registered service", field.Name)
+			return nil, fmt.Errorf("field %q not found in any registered service", rf.field.Name)
+		}
+		key := svc
+		if rf.deferred != nil {
+			key += "\x00" + rf.deferred.Label
+		}
+		g := byService[key]
+		if op.Operation == ast.Mutation {
+			// Only the immediately preceding group may be extended.
+			if n := len(groups); n == 0 || groups[n-1].service != svc {
+				g = nil
+			}
+		}
+		if g == nil {
+			g = &serviceGroup{service: svc, deferred: rf.deferred}
+			groups = append(groups, g)
+			byService[key] = g
 		}
-		byService[svc] = append(byService[svc], sel)
+		g.selections = append(g.selections, rf.field)
 	}
 
 	var steps []*Step
-	for svcName, selections := range byService {
-		rootSteps, err := ps.buildRootStep(opType, op.Name, op.VariableDefinitions, svcName, selections)
+	for _, g := range groups {
+		rootSteps, err := ps.buildRootStep(opType, op.Name, op.VariableDefinitions, g.service, root.Name, g.selections)
 		if err != nil {
 			return nil, err
 		}
+		if g.deferred != nil {
+			markDeferred(rootSteps, g.deferred)
+		}
 		steps = append(steps, rootSteps...)
 	}
+
+	// Never share upstream calls within a mutation: the root step writes, and
+	// entity steps after it must observe the write rather than a response
+	// that another request had already in flight.
+	if op.Operation == ast.Mutation {
+		for _, s := range steps {
+			s.Dedupe = nil
+		}
+	}
 	return steps, nil
 }
 
+// addMetaField resolves a root __schema, __type or __typename selection.
+func (ps *planSession) addMetaField(op *ast.OperationDefinition, field *ast.Field) error {
+	rootType := ps.merged.Schema.Query.Name
+	switch op.Operation {
+	case ast.Mutation:
+		rootType = ps.merged.Schema.Mutation.Name
+	case ast.Subscription:
+		rootType = ps.merged.Schema.Subscription.Name
+	}
+	if field.Name != "__typename" {
+		ps.introspects = true
+	}
+	val, err := ps.resolveMetaField(field, rootType)
+	if err != nil {
+		return err
+	}
+	if ps.meta == nil {
+		ps.meta = map[string]any{}
+	}
+	ps.meta[field.Alias] = val
+	return nil
+}
+
+type rootField struct {
+	field    *ast.Field
+	deferred *DeferMeta
+}
+
+// rootFields flattens fragments at the operation root into their fields.
+// Fields inside a @defer fragment are tagged with it when allowDefer is set;
+// mutations ignore @defer at the root so their fields stay in order.
+func (ps *planSession) rootFields(sel ast.SelectionSet, deferred *DeferMeta, allowDefer bool) []rootField {
+	var out []rootField
+	for _, s := range sel {
+		if f, ok := s.(*ast.Field); ok {
+			out = append(out, rootField{field: f, deferred: deferred})
+			continue
+		}
+		fragSel, _, dm, ok := ps.fragmentSelection(s)
+		if !ok {
+			continue
+		}
+		if dm == nil || !allowDefer {
+			dm = deferred
+		}
+		out = append(out, ps.rootFields(fragSel, dm, allowDefer)...)
+	}
+	return out
+}
+
+// fragmentSelection resolves an inline fragment or fragment spread to its
+// selection set and type condition, plus its @defer settings when it is
+// deferred. ok is false for unknown fragments.
+func (ps *planSession) fragmentSelection(sel ast.Selection) (set ast.SelectionSet, typeCond string, deferred *DeferMeta, ok bool) {
+	var dirs ast.DirectiveList
+	switch f := sel.(type) {
+	case *ast.InlineFragment:
+		set, typeCond, dirs = f.SelectionSet, f.TypeCondition, f.Directives
+	case *ast.FragmentSpread:
+		def := ps.fragments.ForName(f.Name)
+		if def == nil {
+			return nil, "", nil, false
+		}
+		set, typeCond, dirs = def.SelectionSet, def.TypeCondition, f.Directives
+	default:
+		return nil, "", nil, false
+	}
+
+	if d := dirs.ForName("defer"); d != nil {
+		args := d.ArgumentMap(ps.variables)
+		if on, isBool := args["if"].(bool); !isBool || on {
+			label, _ := args["label"].(string)
+			deferred = &DeferMeta{Label: label}
+		}
+	}
+	return set, typeCond, deferred, true
+}
+
+// streamMeta returns the @stream settings of a list field, or nil when the
+// field is not streamed.
+func (ps *planSession) streamMeta(field *ast.Field, parentPath []string) *StreamMeta {
+	d := field.Directives.ForName("stream")
+	if d == nil || field.Definition.Type.Elem == nil {
+		return nil
+	}
+	args := d.ArgumentMap(ps.variables)
+	if on, isBool := args["if"].(bool); isBool && !on {
+		return nil
+	}
+	sm := &StreamMeta{Path: append(append([]string{}, parentPath...), field.Alias)}
+	sm.Label, _ = args["label"].(string)
+	switch n := args["initialCount"].(type) {
+	case int64:
+		sm.InitialCount = int(n)
+	case float64: // from JSON variables
+		sm.InitialCount = int(n)
+	}
+	sm.InitialCount = max(sm.InitialCount, 0)
+	return sm
+}
+
+// markDeferred tags steps that are not already part of a nested @defer.
+func markDeferred(steps []*Step, dm *DeferMeta) {
+	for _, s := range steps {
+		if s.Meta.Defer == nil {
+			s.Meta.Defer = dm
+		}
+	}
+}
+
+// dedupePolicy returns the service's deduplication policy, or nil when
+// deduplication is disabled for it.
+func (ps *planSession) dedupePolicy(serviceName string) *DedupePolicy {
+	dp, ok := ps.merged.ServiceDedupe[serviceName]
+	if !ok || !dp.Enabled {
+		return nil
+	}
+	return &dp
+}
+
 // buildRootStep creates a Step for a service's slice of root selections and
 // any dependent steps needed for cross-service fields within.
 func (ps *planSession) buildRootStep(
 	opType, opName string,
 	varDefs ast.VariableDefinitionList,
-	serviceName string,
+	serviceName, rootType string,
 	selections ast.SelectionSet,
 ) ([]*Step, error) {
 	rootID := ps.nextID()
+	ps.rowFilters = nil
+	ps.denied = nil
 
 	// Walk selections to detect cross-service nested fields and build the
 	// service-local selection (possibly injecting @key fields for federation).
-	localSel, dependents, err := ps.walkSelections(selections, rootID, serviceName, "Query", nil)
+	localSel, dependents, err := ps.walkSelections(selections, rootID, serviceName, rootType, nil)
 	if err != nil {
 		return nil, err
 	}
+	if onlyPlaceholder(localSel) && len(dependents) == 0 {
+		// Every root field was denied; there is nothing to ask the service.
+		return nil, nil
+	}
 
 	// Build the sub-query string
 	var qb strings.Builder
@@ -254,7 +520,7 @@ func (ps *planSession) buildRootStep(
 	if opName != "" {
 		fmt.Fprintf(&qb, " %s", opName)
 	}
-	vars := varDefsToSDL(varDefs)
+	vars := varDefsToSDL(ps.usedVarDefs(varDefs, localSel))
 	if vars != "" {
 		qb.WriteString(vars)
 	}
@@ -262,17 +528,41 @@ func (ps *planSession) buildRootStep(
 	qb.WriteString(selectionToQueryString(localSel, nil, "  "))
 	qb.WriteString("}")
 
+	// Mutation root steps are never retried unless the service explicitly
+	// opts in — a retry after a lost response could apply the write twice.
+	policy := ps.merged.ServiceRetry[serviceName]
+	retryCount := ps.merged.ServiceRetryCount[serviceName]
+	if opType == "mutation" && !policy.AllowMutations {
+		retryCount = 0
+	}
+
 	root := &Step{
 		ID:          rootID,
 		ServiceName: serviceName,
 		ServiceURL:  ps.merged.ServiceURLs[serviceName],
 		ServiceType: ps.merged.ServiceTypes[serviceName],
-		RetryCount:  ps.merged.ServiceRetryCount[serviceName],
+		RetryCount:  retryCount,
 		TimeoutMs:   ps.merged.ServiceTimeoutMs[serviceName],
-		Query:       qb.String(),
-		Variables:   ps.variables,
-		MergePath:   nil,
-		Meta:        StepMeta{Kind: StepKindRoot},
+		RetryPolicy: policy,
+		Dedupe:      ps.dedupePolicy(serviceName),
+
+		StaticHeaders: ps.merged.ServiceHeaders[serviceName],
+		HeaderRules:   ps.merged.ServiceHeaderRule[serviceName],
+		MaxResponseKB: ps.merged.ServiceMaxBodyKB[serviceName],
+		Encoding:      ps.merged.ServiceEncoding[serviceName],
+
+		Query:     qb.String(),
+		Variables: ps.variables,
+		Uploads:   ps.uploadsFor(localSel),
+		MergePath: nil,
+		Meta:      StepMeta{Kind: StepKindRoot},
+
+		RowFilters: ps.rowFilters,
+		Denied:     ps.denied,
+	}
+	if len(root.Uploads) > 0 {
+		// Uploads encode as null, so dedupe keys can't tell files apart.
+		root.Dedupe = nil
 	}
 
 	all := append([]*Step{root}, dependents...)
@@ -295,12 +585,29 @@ func (ps *planSession) walkSelections(
 ) (ast.SelectionSet, []*Step, error) {
 	var localSel ast.SelectionSet
 	var dependents []*Step
+	stripped := false // a denied field was left out under partial denial
 
 	for _, sel := range selections {
 		field, ok := sel.(*ast.Field)
 		if !ok {
-			// Inline fragments / fragment spreads: include as-is
-			localSel = append(localSel, sel)
+			// Fragments on the current type are flattened so cross-service
+			// fields inside them are planned like any other; their steps are
+			// deferred when the fragment is. Fragments on other types are
+			// included as-is.
+			fragSel, typeCond, deferred, ok := ps.fragmentSelection(sel)
+			if !ok || (typeCond != "" && typeCond != currentType) {
+				localSel = append(localSel, sel)
+				continue
+			}
+			nestedSel, deps, err := ps.walkSelections(fragSel, parentStepID, currentService, currentType, parentPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			if deferred != nil {
+				markDeferred(deps, deferred)
+			}
+			localSel = append(localSel, nestedSel...)
+			dependents = append(dependents, deps...)
 			continue
 		}
 
@@ -311,19 +618,48 @@ func (ps *planSession) walkSelections(
 		}
 
 		// Permission check before we go any further.
+		var cond map[string]any
 		if ps.checker != nil {
-			allowed, err := ps.checker.CanAccess(context.Background(), ps.role, currentType, field.Name)
+			allowed, err := ps.checker.CanAccess(ps.ctx, ps.role, currentService, currentType, field.Name)
 			if err != nil {
 				return nil, nil, fmt.Errorf("permission check error: %w", err)
 			}
 			if !allowed {
-				return nil, nil, fmt.Errorf("permission denied: role %q cannot access %s.%s", ps.role, currentType, field.Name)
+				err := fmt.Errorf("permission denied: role %q cannot access %s.%s on service %q", ps.role, currentType, field.Name, currentService)
+				if !ps.stripDenied {
+					return nil, nil, err
+				}
+				if err := ps.deny(field, parentPath, err); err != nil {
+					return nil, nil, err
+				}
+				stripped = true
+				continue
+			}
+			if cond, err = ps.condition(currentService, currentType, field.Name); err != nil {
+				return nil, nil, err
 			}
+			if field, err = ps.checkArguments(currentService, currentType, field); err != nil {
+				return nil, nil, err
+			}
+			sel = field
+		}
+
+		if sm := ps.streamMeta(field, parentPath); sm != nil {
+			ps.streams = append(ps.streams, *sm)
 		}
 
 		returnType := namedTypeName(field.Definition.Type)
+		if cond != nil && len(parentPath) == 0 {
+			field, cond = injectConditionArgs(field, cond, ps.merged.Schema.Types[returnType])
+			sel = field
+		}
 		if returnType == "" || isScalarOrEnum(returnType, ps.merged.Schema) {
-			// Scalar / enum — always stays with the current service
+			// Scalar / enum — always stays with the current service.
+			// Row conditions only filter objects; refuse rather than
+			// return the value unchecked.
+			if cond != nil {
+				return nil, nil, fmt.Errorf("row condition on %s.%s cannot be enforced: it returns %s, not an object", currentType, field.Name, returnType)
+			}
 			localSel = append(localSel, sel)
 			continue
 		}
@@ -334,13 +670,20 @@ func (ps *planSession) walkSelections(
 		if typeOwner == "" || typeOwner == currentService {
 			// Same service (or unknown) — recurse into nested selection
 			if len(field.SelectionSet) > 0 {
-				nestedPath := append(append([]string{}, parentPath...), field.Name)
-				nestedSel, deps, err := ps.walkSelections(field.SelectionSet, parentStepID, currentService, returnType, nestedPath)
+				nestedPath := append(append([]string{}, parentPath...), field.Alias)
+				nestedSel, deps, err := ps.walkField(field, field.SelectionSet, parentStepID, currentService, returnType, nestedPath)
 				if err != nil {
 					return nil, nil, err
 				}
 				// Replace the field's selection set with the local-only subset
 				localField := cloneFieldWithSel(field, nestedSel)
+				if cond != nil {
+					// Added after the walk: the fields a condition reads are
+					// never returned, so they need no permission of their own.
+					if localField, err = ps.addRowFilter(localField, cond, ps.merged.Schema.Types[returnType], nestedPath); err != nil {
+						return nil, nil, err
+					}
+				}
 				localSel = append(localSel, localField)
 				dependents = append(dependents, deps...)
 			} else {
@@ -350,7 +693,10 @@ func (ps *planSession) walkSelections(
 		}
 
 		// Cross-service field: returnType is owned by a different service.
-		fieldPath := append(append([]string{}, parentPath...), field.Name)
+		fieldPath := append(append([]string{}, parentPath...), field.Alias)
+		if cond != nil {
+			return nil, nil, fmt.Errorf("row conditions are not supported on cross-service field %s.%s", currentType, field.Name)
+		}
 
 		// Determine resolution strategy
 		if ps.merged.ServiceTypes[currentService] == "federation" ||
@@ -363,13 +709,25 @@ func (ps *planSession) walkSelections(
 				continue
 			}
 
-			// Inject @key fields into the local selection for this field
-			localField := injectKeyFields(field, keyFields)
+			// The local service only supplies the @key fields; everything
+			// else is fetched from the owner through _entities.
+			localField := injectKeyFields(cloneFieldWithSel(field, onlyKeyFields(field.SelectionSet, keyFields)), keyFields)
 			localSel = append(localSel, localField)
 
-			// Build the _entities sub-query selection
-			entitySel := onlyNonKeyFields(field.SelectionSet, keyFields)
-			if len(entitySel) == 0 {
+			// Build the _entities sub-query selection, checked against the
+			// owner's permissions like any other selection. The entity step
+			// merges into the parent's data in place, so steps nested under
+			// it depend on the parent too.
+			filters := len(ps.rowFilters)
+			entitySel, deps, err := ps.walkField(field, onlyNonKeyFields(field.SelectionSet, keyFields), parentStepID, typeOwner, returnType, fieldPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(ps.rowFilters) > filters {
+				return nil, nil, fmt.Errorf("row conditions are not supported inside entity field %s.%s", currentType, field.Name)
+			}
+			if len(entitySel) == 0 || onlyPlaceholder(entitySel) {
+				dependents = append(dependents, deps...)
 				continue // nothing to fetch from entity service
 			}
 			entitySelStr := "{\n" + selectionToQueryString(entitySel, nil, "    ") + "  }"
@@ -382,10 +740,18 @@ func (ps *planSession) walkSelections(
 				ServiceType: ps.merged.ServiceTypes[typeOwner],
 				RetryCount:  ps.merged.ServiceRetryCount[typeOwner],
 				TimeoutMs:   ps.merged.ServiceTimeoutMs[typeOwner],
-				Query:       buildEntitiesQuery(returnType, keyFields, entitySelStr),
-				Variables:   ps.variables,
-				DependsOn:   []string{parentStepID},
-				MergePath:   fieldPath,
+				RetryPolicy: ps.merged.ServiceRetry[typeOwner],
+				Dedupe:      ps.dedupePolicy(typeOwner),
+
+				StaticHeaders: ps.merged.ServiceHeaders[typeOwner],
+				HeaderRules:   ps.merged.ServiceHeaderRule[typeOwner],
+				MaxResponseKB: ps.merged.ServiceMaxBodyKB[typeOwner],
+				Encoding:      ps.merged.ServiceEncoding[typeOwner],
+
+				Query:     buildEntitiesQuery(returnType, keyFields, entitySelStr),
+				Variables: ps.variables,
+				DependsOn: []string{parentStepID},
+				MergePath: fieldPath,
 				Meta: StepMeta{
 					Kind: StepKindEntity,
 					Entity: &EntityMeta{
@@ -394,10 +760,12 @@ func (ps *planSession) walkSelections(
 						ParentStepID: parentStepID,
 						ParentPath:   fieldPath,
 						Selection:    entitySelStr,
+						Fields:       entityFields(entitySel),
 					},
 				},
 			}
 			dependents = append(dependents, dep)
+			dependents = append(dependents, deps...)
 
 		} else {
 			// Stitching join — look up relationship from metadata
@@ -420,10 +788,18 @@ func (ps *planSession) walkSelections(
 				ServiceType: ps.merged.ServiceTypes[typeOwner],
 				RetryCount:  ps.merged.ServiceRetryCount[typeOwner],
 				TimeoutMs:   ps.merged.ServiceTimeoutMs[typeOwner],
-				Query:       buildJoinQuery(rel.TargetType, rel.SourceField, field.SelectionSet),
-				Variables:   ps.variables,
-				DependsOn:   []string{parentStepID},
-				MergePath:   fieldPath,
+				RetryPolicy: ps.merged.ServiceRetry[typeOwner],
+				Dedupe:      ps.dedupePolicy(typeOwner),
+
+				StaticHeaders: ps.merged.ServiceHeaders[typeOwner],
+				HeaderRules:   ps.merged.ServiceHeaderRule[typeOwner],
+				MaxResponseKB: ps.merged.ServiceMaxBodyKB[typeOwner],
+				Encoding:      ps.merged.ServiceEncoding[typeOwner],
+
+				Query:     buildJoinQuery(rel.TargetType, rel.SourceField, field.SelectionSet),
+				Variables: ps.variables,
+				DependsOn: []string{parentStepID},
+				MergePath: fieldPath,
 				Meta: StepMeta{
 					Kind: StepKindJoin,
 					Join: &JoinMeta{
@@ -439,6 +815,9 @@ func (ps *planSession) walkSelections(
 		}
 	}
 
+	if stripped && len(localSel) == 0 {
+		localSel = append(localSel, deniedPlaceholder())
+	}
 	return localSel, dependents, nil
 }
 
@@ -547,6 +926,28 @@ func injectFieldByName(f *ast.Field, fieldName string) *ast.Field {
 	return cloneFieldWithSel(f, sel)
 }
 
+// entityFields splits an entity selection into its top-level fields, using
+// the same indentation as the full selection so the parts concatenate back
+// into it. Returns nil if the selection contains fragments.
+func entityFields(sel ast.SelectionSet) []EntityField {
+	fields := make([]EntityField, 0, len(sel))
+	for _, s := range sel {
+		f, ok := s.(*ast.Field)
+		if !ok {
+			return nil
+		}
+		key := f.Alias
+		if key == "" {
+			key = f.Name
+		}
+		fields = append(fields, EntityField{
+			ResponseKey: key,
+			Selection:   selectionToQueryString(ast.SelectionSet{f}, nil, "    "),
+		})
+	}
+	return fields
+}
+
 // onlyNonKeyFields returns the sub-selections that are NOT key fields.
 // These are the fields we need to fetch from the entity's owning service.
 func onlyNonKeyFields(sel ast.SelectionSet, keyFields []string) ast.SelectionSet {
@@ -564,6 +965,17 @@ func onlyNonKeyFields(sel ast.SelectionSet, keyFields []string) ast.SelectionSet
 	return out
 }
 
+// onlyKeyFields returns the @key fields the client selected, aliases and all.
+func onlyKeyFields(sel ast.SelectionSet, keyFields []string) ast.SelectionSet {
+	var out ast.SelectionSet
+	for _, s := range sel {
+		if f, ok := s.(*ast.Field); ok && slices.Contains(keyFields, f.Name) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // isScalarOrEnum returns true if typeName is a scalar or enum in the schema.
 func isScalarOrEnum(typeName string, schema *ast.Schema) bool {
 	if schema == nil {
@@ -2,8 +2,12 @@ package planner
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/deformal/kastql/internal/auth"
 	"github.com/deformal/kastql/internal/metadata"
 	"github.com/deformal/kastql/internal/registry"
 	"go.uber.org/zap"
@@ -170,3 +174,827 @@ func TestPlanMultiService(t *testing.T) {
 		t.Errorf("expected both services in plan, got %v", services)
 	}
 }
+
+func TestPlanDeferAndStream(t *testing.T) {
+	entries := []*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "federation", federationUsersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "federation", federationOrdersSDL),
+	}
+
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update(entries); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	plan, err := p.Plan(context.Background(), `{
+		list: orders @stream(initialCount: 1) {
+			id
+			... @defer(label: "buyer") { user { name } }
+		}
+		... @defer(label: "me") { user(id: "1") { name } }
+	}`, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	labels := map[string]string{}
+	for _, s := range plan.Steps {
+		label := "<initial>"
+		if s.Meta.Defer != nil {
+			label = s.Meta.Defer.Label
+		}
+		labels[s.ServiceName+"/"+string(s.Meta.Kind)] = label
+	}
+	want := map[string]string{
+		"orders-svc/root":  "<initial>",
+		"users-svc/entity": "buyer",
+		"users-svc/root":   "me",
+	}
+	for k, v := range want {
+		if labels[k] != v {
+			t.Errorf("%s: expected %q, got %q (all: %v)", k, v, labels[k], labels)
+		}
+	}
+
+	if len(plan.Streams) != 1 || plan.Streams[0].Path[0] != "list" || plan.Streams[0].InitialCount != 1 {
+		t.Errorf("expected stream on list with initialCount 1, got %+v", plan.Streams)
+	}
+	if !plan.Incremental() {
+		t.Error("expected plan to be incremental")
+	}
+}
+
+var ordersMutationSDL = `
+type Query {
+  order(id: ID!): Order
+}
+type Mutation {
+  createOrder(total: Float!): Order
+}
+type Order {
+  id: ID!
+  total: Float!
+}
+`
+
+func TestPlanMutationNotRetried(t *testing.T) {
+	entry := makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersMutationSDL)
+	entry.RetryCount = 3
+
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{entry}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	plan, err := p.Plan(context.Background(), `mutation { createOrder(total: 1) { id } }`, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if got := plan.Steps[0].RetryCount; got != 0 {
+		t.Errorf("expected mutation root step to have 0 retries, got %d", got)
+	}
+
+	plan, err = p.Plan(context.Background(), `{ order(id: "1") { id } }`, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if got := plan.Steps[0].RetryCount; got != 3 {
+		t.Errorf("expected query root step to keep 3 retries, got %d", got)
+	}
+
+	entry.RetryPolicy = `{"allow_mutations":true}`
+	if err := p.Update([]*registry.ServiceEntry{entry}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	plan, err = p.Plan(context.Background(), `mutation { createOrder(total: 1) { id } }`, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if got := plan.Steps[0].RetryCount; got != 3 {
+		t.Errorf("expected opted-in mutation to keep 3 retries, got %d", got)
+	}
+}
+
+func TestPlanSelectsOperation(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	entry := makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersMutationSDL)
+	if err := p.Update([]*registry.ServiceEntry{entry}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	doc := `query A { order(id: "1") { id } } mutation B { createOrder(total: 1) { id } }`
+	if _, err := p.Plan(context.Background(), doc, nil, "public"); err == nil {
+		t.Error("expected a document with several operations to need operationName")
+	}
+	if _, err := p.Plan(WithOperationName(context.Background(), "C"), doc, nil, "public"); err == nil {
+		t.Error("expected an unknown operationName to be refused")
+	}
+
+	plan, err := p.Plan(WithOperationName(context.Background(), "A"), doc, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan A: %v", err)
+	}
+	if plan.OperationType != "query" || len(plan.Steps) != 1 || strings.Contains(plan.Steps[0].Query, "createOrder") {
+		t.Errorf("expected only query A to be planned, got %s with %d steps", plan.OperationType, len(plan.Steps))
+	}
+
+	// The mutation is planned as one, so the executor runs it serially.
+	plan, err = p.Plan(WithOperationName(context.Background(), "B"), doc, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan B: %v", err)
+	}
+	if plan.OperationType != "mutation" || plan.OperationName != "B" || len(plan.Steps) != 1 {
+		t.Errorf("expected only mutation B to be planned, got %s %q with %d steps", plan.OperationType, plan.OperationName, len(plan.Steps))
+	}
+}
+
+var usersMutationSDL = `
+type Query {
+  user(id: ID!): User
+}
+type Mutation {
+  createUser(name: String!): User
+}
+type User {
+  id: ID!
+  name: String!
+}
+`
+
+func TestPlanMutationFieldOrder(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", usersMutationSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersMutationSDL),
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	plan, err := p.Plan(context.Background(), `mutation {
+		a: createUser(name: "a") { id }
+		b: createUser(name: "b") { id }
+		c: createOrder(total: 1) { id }
+		d: createUser(name: "d") { id }
+	}`, nil, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	want := []string{"users-svc", "orders-svc", "users-svc"}
+	if len(plan.Steps) != len(want) {
+		t.Fatalf("expected %d steps, got %d", len(want), len(plan.Steps))
+	}
+	for i, s := range plan.Steps {
+		if s.ServiceName != want[i] {
+			t.Errorf("step %d: expected %s, got %s", i, want[i], s.ServiceName)
+		}
+	}
+}
+
+var filesMutationSDL = `
+scalar Upload
+type Query {
+  file(id: ID!): File
+}
+type Mutation {
+  uploadFiles(files: [Upload!]!): [File!]!
+}
+type File {
+  id: ID!
+}
+`
+
+func TestPlanUploadsGoToConsumingStep(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", usersMutationSDL),
+		makeEntry("files-svc", "http://files/graphql", "stitching", filesMutationSDL),
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	a, b := &Upload{}, &Upload{}
+	vars := map[string]any{"name": "x", "files": []any{a, b}}
+	plan, err := p.Plan(context.Background(), `mutation($name: String!, $files: [Upload!]!) {
+		createUser(name: $name) { id }
+		uploadFiles(files: $files) { id }
+	}`, vars, "public")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	for _, s := range plan.Steps {
+		switch s.ServiceName {
+		case "users-svc":
+			if len(s.Uploads) != 0 {
+				t.Errorf("users-svc should send no files, got %d", len(s.Uploads))
+			}
+		case "files-svc":
+			if len(s.Uploads) != 2 || s.Uploads[0].Path != "variables.files.0" || s.Uploads[1].Upload != b {
+				t.Errorf("unexpected files-svc uploads: %+v", s.Uploads)
+			}
+		}
+	}
+}
+
+func TestParseRetryPolicy(t *testing.T) {
+	if _, err := ParseRetryPolicy(`{"retry_on":["5xx","429","timeout"],"budget_ratio":0.2}`); err != nil {
+		t.Errorf("expected valid policy, got %v", err)
+	}
+	if _, err := ParseRetryPolicy(`{"retry_on":["sometimes"]}`); err == nil {
+		t.Error("expected unknown retry_on condition to be rejected")
+	}
+	if _, err := ParseRetryPolicy(`{"budget_ratio":2}`); err == nil {
+		t.Error("expected budget_ratio > 1 to be rejected")
+	}
+}
+
+func TestParseHeaderRulesResponse(t *testing.T) {
+	if _, err := ParseHeaderRules(`{"response":["Set-Cookie","X-Trace-Id"]}`); err != nil {
+		t.Errorf("expected valid rules, got %v", err)
+	}
+	for _, name := range []string{"Content-Length", "content-encoding", "Transfer-Encoding", "Connection"} {
+		if _, err := ParseHeaderRules(`{"response":["` + name + `"]}`); err == nil {
+			t.Errorf("expected %s to be refused as a response header", name)
+		}
+	}
+}
+
+func TestMergeInvalidRetryPolicy(t *testing.T) {
+	users := makeEntry("users-svc", "http://users/graphql", "stitching", usersSDL)
+	users.RetryPolicy = `{"retry_on":["sometimes"]}`
+	merged, err := Merge([]*registry.ServiceEntry{
+		users,
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersSDL),
+	})
+	if err != nil {
+		t.Fatalf("expected a bad retry policy not to fail the merge, got %v", err)
+	}
+	if len(merged.Warnings) != 1 || len(merged.ServiceRetry["users-svc"].RetryOn) != 0 {
+		t.Errorf("expected one warning and the default policy, got %v %+v", merged.Warnings, merged.ServiceRetry["users-svc"])
+	}
+}
+
+// denyChecker denies the listed "Type.field" pairs; a "Type." entry denies
+// every field of the type and an "@service" entry every field it resolves.
+type denyChecker map[string]bool
+
+func (d denyChecker) CanAccess(_ context.Context, _, service, typeName, fieldName string) (bool, error) {
+	return !d["@"+service] && !d[typeName+"."] && !d[typeName+"."+fieldName], nil
+}
+
+// partialDenyChecker is a denyChecker whose role has partial denial on.
+type partialDenyChecker struct{ denyChecker }
+
+func (partialDenyChecker) PartialDeny(string) (bool, error) { return true, nil }
+
+func TestPlanPartialDeny(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", usersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(partialDenyChecker{denyChecker{"User.email": true, "@orders-svc": true}})
+
+	plan, err := p.Plan(context.Background(), `{
+		users { id }
+		me: user(id: "1") { email }
+		order(id: "1") { id }
+	}`, nil, "partner")
+	if err != nil {
+		t.Fatalf("expected denied fields to be stripped, got %v", err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].ServiceName != "users-svc" {
+		t.Fatalf("expected only a users-svc step, got %+v", plan.Steps)
+	}
+	q := plan.Steps[0].Query
+	if strings.Contains(q, "email") || !strings.Contains(q, DeniedPlaceholder+": __typename") {
+		t.Errorf("expected email stripped and the empty selection filled, got:\n%s", q)
+	}
+
+	// email is non-null, so its null lands on the nullable me.
+	var got []string
+	for _, d := range plan.Steps[0].Denied {
+		got = append(got, strings.Join(d.Path, ".")+"->"+strings.Join(d.NullPath, "."))
+	}
+	for _, d := range plan.Denied {
+		got = append(got, strings.Join(d.Path, ".")+"->"+strings.Join(d.NullPath, "."))
+	}
+	if want := []string{"me.email->me", "order->order"}; !slices.Equal(got, want) {
+		t.Errorf("denied = %v, want %v", got, want)
+	}
+
+	// Nulls that would reach the root of the data fail the plan instead.
+	for _, query := range []string{`{ users { id email } }`, `{ orders { id } }`} {
+		if _, err := p.Plan(context.Background(), query, nil, "partner"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Errorf("%s: expected a permission error, got %v", query, err)
+		}
+	}
+}
+
+func TestPlanServiceScopedPermissions(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", usersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(denyChecker{"@orders-svc": true})
+
+	if _, err := p.Plan(context.Background(), `{ users { id name } }`, nil, "partner"); err != nil {
+		t.Fatalf("expected users-svc to stay reachable, got %v", err)
+	}
+	_, err := p.Plan(context.Background(), `{ orders { id } }`, nil, "partner")
+	if err == nil || !strings.Contains(err.Error(), `Query.orders on service "orders-svc"`) {
+		t.Fatalf("expected a denial naming orders-svc, got %v", err)
+	}
+
+	schema, err := p.SchemaFor(context.Background(), "partner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Types["Order"] != nil || schema.Query.Fields.ForName("orders") != nil {
+		t.Error("expected orders-svc fields to be hidden from the role's schema")
+	}
+}
+
+func TestPlanFederatedEntityPermissions(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "federation", federationUsersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "federation", federationOrdersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	p.SetChecker(denyChecker{"@users-svc": true})
+	_, err := p.Plan(context.Background(), `{ orders { user { name email } } }`, nil, "partner")
+	if err == nil || !strings.Contains(err.Error(), `User.name on service "users-svc"`) {
+		t.Fatalf("expected entity fields to be denied on users-svc, got %v", err)
+	}
+	if _, err := p.Plan(context.Background(), `{ orders { id user { id } } }`, nil, "partner"); err != nil {
+		t.Errorf("expected the key field to need no entity fetch, got %v", err)
+	}
+
+	// With Order.user nullable, a denied User.email nulls the user.
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "federation", federationUsersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "federation", strings.Replace(federationOrdersSDL, "user: User!", "user: User", 1)),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(partialDenyChecker{denyChecker{"User.email": true}})
+	plan, err := p.Plan(context.Background(), `{ orders { user { name email } } }`, nil, "partner")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if len(plan.Steps) != 2 {
+		t.Fatalf("expected a root and an entity step, got %+v", plan.Steps)
+	}
+	root, entity := plan.Steps[0], plan.Steps[1]
+	if strings.Contains(root.Query, "name") || strings.Contains(root.Query, "email") {
+		t.Errorf("expected orders-svc to be asked for the key only, got:\n%s", root.Query)
+	}
+	if strings.Contains(entity.Query, "email") || !strings.Contains(entity.Query, "name") {
+		t.Errorf("expected email stripped from the entity query, got:\n%s", entity.Query)
+	}
+	if len(root.Denied) != 1 || strings.Join(root.Denied[0].Path, ".") != "orders.user.email" ||
+		strings.Join(root.Denied[0].NullPath, ".") != "orders.user" {
+		t.Errorf("expected orders.user.email denied and orders.user nulled, got %+v", root.Denied)
+	}
+}
+
+func TestIntrospectionFilteredByRole(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", usersSDL),
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", ordersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(denyChecker{"User.email": true, "Order.": true})
+
+	plan, err := p.Plan(context.Background(), `query($t: String!) {
+		__typename
+		user: __type(name: "User") { name fields { name } }
+		order: __type(name: $t) { name }
+		schema: __schema { queryType { name } types { name } }
+		__type(name: "Query") { fields { name type { name kind ofType { name fields { name } } } } }
+	}`, map[string]any{"t": "Order"}, "partner")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if len(plan.Steps) != 0 || !plan.Introspects {
+		t.Fatalf("expected an introspection-only plan, got %d steps", len(plan.Steps))
+	}
+
+	data := plan.Introspection
+	if data["__typename"] != "Query" {
+		t.Errorf("__typename = %v", data["__typename"])
+	}
+	user := data["user"].(map[string]any)
+	var userFields []string
+	for _, f := range user["fields"].([]any) {
+		userFields = append(userFields, f.(map[string]any)["name"].(string))
+	}
+	if len(userFields) != 2 || userFields[0] != "id" || userFields[1] != "name" {
+		t.Errorf("expected User fields [id name], got %v", userFields)
+	}
+	if data["order"] != nil {
+		t.Errorf("expected the denied Order type to be invisible, got %v", data["order"])
+	}
+	for _, ty := range data["schema"].(map[string]any)["types"].([]any) {
+		if ty.(map[string]any)["name"] == "Order" {
+			t.Error("Order listed in __schema.types")
+		}
+	}
+	for _, f := range data["__type"].(map[string]any)["fields"].([]any) {
+		switch name := f.(map[string]any)["name"]; name {
+		case "orders", "order", "__schema", "__type":
+			t.Errorf("unexpected Query field %v", name)
+		}
+	}
+}
+
+func TestPlanChecksMutationRoot(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", inputsSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	mutation := `mutation { createOrder(input: [{total: 1}]) { id } }`
+
+	// Planning and introspection must agree on which root a rule names.
+	for _, tc := range []struct {
+		deny    string
+		allowed bool
+	}{
+		{"Mutation.createOrder", false},
+		{"Query.createOrder", true},
+	} {
+		p.SetChecker(denyChecker{tc.deny: true})
+		_, err := p.Plan(context.Background(), mutation, nil, "user")
+		if (err == nil) != tc.allowed {
+			t.Errorf("deny %s: Plan error = %v, want allowed=%v", tc.deny, err, tc.allowed)
+		}
+		schema, err := p.SchemaFor(context.Background(), "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		visible := schema.Mutation != nil && schema.Mutation.Fields.ForName("createOrder") != nil
+		if visible != tc.allowed {
+			t.Errorf("deny %s: createOrder visible = %v, want %v", tc.deny, visible, tc.allowed)
+		}
+	}
+}
+
+var taggedUsersSDL = `
+type Query {
+  user(id: ID!): User @tag(name: "public-api")
+  userStats: Int @tag(name: "internal")
+}
+type User @tag(name: "public-api") {
+  id: ID!
+  name: String!
+  email: String! @tag(name: "internal")
+}
+`
+
+func TestPlanValidatesAgainstContract(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+	if err := store.UpsertContract(&metadata.Contract{
+		Name:        "public-api",
+		IncludeTags: `["public-api"]`,
+		ExcludeTags: `["internal"]`,
+		Roles:       `["partner"]`,
+	}); err != nil {
+		t.Fatalf("UpsertContract: %v", err)
+	}
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("users-svc", "http://users/graphql", "stitching", taggedUsersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	bg := context.Background()
+	keyed := WithContract(bg, "public-api")
+	cases := []struct {
+		name  string
+		ctx   context.Context
+		role  string
+		query string
+		ok    bool
+	}{
+		{"bound role, tagged fields", bg, "partner", `{ user(id: "1") { id name } }`, true},
+		{"bound role, excluded field", bg, "partner", `{ user(id: "1") { email } }`, false},
+		{"bound role, untagged root", bg, "partner", `{ userStats }`, false},
+		{"unbound role", bg, "admin", `{ userStats user(id: "1") { email } }`, true},
+		{"router key contract", keyed, "admin", `{ user(id: "1") { email } }`, false},
+		{"unknown contract", WithContract(bg, "gone"), "admin", `{ user(id: "1") { id } }`, false},
+	}
+	for _, tc := range cases {
+		_, err := p.Plan(tc.ctx, tc.query, nil, tc.role)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: Plan error = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+
+	plan, err := p.Plan(keyed, `{ __type(name: "User") { fields { name } } }`, nil, "admin")
+	if err != nil {
+		t.Fatalf("Plan introspection: %v", err)
+	}
+	fields := plan.Introspection["__type"].(map[string]any)["fields"].([]any)
+	if len(fields) != 2 {
+		t.Errorf("expected contract User fields [id name], got %v", fields)
+	}
+}
+
+var userOrdersSDL = `
+type Query {
+  orders(userId: ID): [Order!]!
+  orderCount(userId: ID): Int!
+}
+type Order {
+  id: ID!
+  userId: ID!
+  status: String!
+}
+`
+
+// conditionChecker allows everything and attaches the given row conditions
+// to "Type.field" pairs.
+type conditionChecker map[string]map[string]any
+
+func (conditionChecker) CanAccess(context.Context, string, string, string, string) (bool, error) {
+	return true, nil
+}
+
+func (c conditionChecker) Condition(_ context.Context, _, _, typeName, fieldName string) (map[string]any, error) {
+	return c[typeName+"."+fieldName], nil
+}
+
+func TestPlanRowConditions(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", userOrdersSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(conditionChecker{"Query.orders": {
+		"userId": map[string]any{"_eq": "7"},
+		"status": map[string]any{"_neq": "draft"},
+	}})
+
+	plan, err := p.Plan(context.Background(), `{ mine: orders(userId: "8") { id } }`, nil, "user")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	step := plan.Steps[0]
+	for _, want := range []string{`orders(userId: "7")`, "kastql_cond_status: status", "kastql_cond_userId: userId"} {
+		if !strings.Contains(step.Query, want) {
+			t.Errorf("expected %q in step query:\n%s", want, step.Query)
+		}
+	}
+	if strings.Contains(step.Query, `"8"`) {
+		t.Errorf("client argument should be replaced:\n%s", step.Query)
+	}
+	if !plan.DependsOnClaims() || len(step.RowFilters) != 1 {
+		t.Fatalf("expected one row filter, got %+v", step.RowFilters)
+	}
+	f := step.RowFilters[0]
+	if len(f.Path) != 1 || f.Path[0] != "mine" {
+		t.Errorf("filter path = %v, want [mine]", f.Path)
+	}
+
+	for _, tc := range []struct {
+		obj  map[string]any
+		want bool
+	}{
+		{map[string]any{"kastql_cond_userId": "7", "kastql_cond_status": "paid"}, true},
+		{map[string]any{"kastql_cond_userId": float64(7), "kastql_cond_status": "paid"}, true},
+		{map[string]any{"kastql_cond_userId": "8", "kastql_cond_status": "paid"}, false},
+		{map[string]any{"kastql_cond_userId": "7", "kastql_cond_status": "draft"}, false},
+	} {
+		if got := MatchCondition(f.Condition, tc.obj); got != tc.want {
+			t.Errorf("MatchCondition(%v) = %v, want %v", tc.obj, got, tc.want)
+		}
+	}
+
+	// A condition that only becomes arguments still ties the response to
+	// the caller, so it must not be shared.
+	p.SetChecker(conditionChecker{"Query.orderCount": {"userId": map[string]any{"_eq": "7"}}})
+	plan, err = p.Plan(context.Background(), `{ orderCount(userId: "8") }`, nil, "user")
+	if err != nil {
+		t.Fatalf("Plan injected condition: %v", err)
+	}
+	if !strings.Contains(plan.Steps[0].Query, `orderCount(userId: "7")`) || len(plan.Steps[0].RowFilters) != 0 {
+		t.Errorf("expected the condition injected as an argument:\n%s", plan.Steps[0].Query)
+	}
+	if !plan.DependsOnClaims() {
+		t.Error("expected a plan with injected arguments to depend on claims")
+	}
+
+	// Scalars can't be filtered; the condition must not be dropped silently.
+	p.SetChecker(conditionChecker{"Order.status": {"_eq": "paid"}})
+	if _, err := p.Plan(context.Background(), `{ orders { status } }`, nil, "user"); err == nil {
+		t.Error("expected a condition on a scalar field to be refused")
+	}
+}
+
+var inputsSDL = `
+type Query {
+  orders(userId: ID, includeDeleted: Boolean): [Order!]!
+}
+type Mutation {
+  createOrder(input: [CreateOrderInput!]!): [Order!]!
+}
+input CreateOrderInput {
+  total: Float!
+  discount: Float
+}
+type Order {
+  id: ID!
+}
+`
+
+// inputChecker allows every output field and applies the given rules to
+// arguments and input fields, keyed "Type.field(arg)" or "Input.field".
+type inputChecker map[string]inputRule
+
+func (inputChecker) CanAccess(context.Context, string, string, string, string) (bool, error) {
+	return true, nil
+}
+
+func (c inputChecker) InputRule(_ context.Context, _, _, typeName, fieldName string) (bool, map[string]any, any, bool, error) {
+	r, ok := c[typeName+"."+fieldName]
+	return r.allow, r.condition, r.preset, ok, nil
+}
+
+func TestPlanInputPermissions(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", inputsSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	p.SetChecker(inputChecker{
+		"Query.orders(includeDeleted)": {allow: true, condition: map[string]any{"_neq": true}},
+		"Query.orders(userId)":         {allow: true, preset: "7"},
+		"CreateOrderInput.discount":    {allow: false},
+	})
+
+	cases := []struct {
+		query string
+		vars  map[string]any
+		ok    bool
+	}{
+		{`{ orders(includeDeleted: false) { id } }`, nil, true},
+		{`{ orders(includeDeleted: true) { id } }`, nil, false},
+		{`query($d: Boolean) { orders(includeDeleted: $d) { id } }`, map[string]any{"d": true}, false},
+		{`mutation { createOrder(input: [{total: 1}]) { id } }`, nil, true},
+		{`mutation { createOrder(input: [{total: 1}, {total: 2, discount: 1}]) { id } }`, nil, false},
+		{`mutation($in: [CreateOrderInput!]!) { createOrder(input: $in) { id } }`,
+			map[string]any{"in": []any{map[string]any{"total": 1.0, "discount": 5.0}}}, false},
+	}
+	for _, tc := range cases {
+		_, err := p.Plan(context.Background(), tc.query, tc.vars, "user")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: Plan error = %v, want ok=%v", tc.query, err, tc.ok)
+		}
+	}
+
+	plan, err := p.Plan(context.Background(), `{ orders(userId: "8") { id } }`, nil, "user")
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if q := plan.Steps[0].Query; !strings.Contains(q, `orders(userId: "7")`) {
+		t.Errorf("expected preset userId in step query:\n%s", q)
+	}
+	if !plan.DependsOnClaims() {
+		t.Error("expected a preset to make the plan depend on claims")
+	}
+
+	// The variable the preset replaced is no longer declared.
+	plan, err = p.Plan(context.Background(), `query($u: ID, $d: Boolean) { orders(userId: $u, includeDeleted: $d) { id } }`,
+		map[string]any{"u": "8", "d": false}, "user")
+	if err != nil {
+		t.Fatalf("Plan with variables: %v", err)
+	}
+	if q := plan.Steps[0].Query; strings.Contains(q, "$u") || !strings.Contains(q, "($d: Boolean)") {
+		t.Errorf("expected only $d declared:\n%s", q)
+	}
+}
+
+func TestPlanMutationArgumentPermissions(t *testing.T) {
+	store, _ := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("orders-svc", "http://orders/graphql", "stitching", inputsSDL),
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	mutation := `mutation { createOrder(input: [{total: 1}]) { id } }`
+
+	p.SetChecker(inputChecker{"Mutation.createOrder(input)": {allow: false}})
+	if _, err := p.Plan(context.Background(), mutation, nil, "user"); err == nil {
+		t.Error("expected a denied mutation argument to fail the plan")
+	}
+	// A rule on Query does not reach the Mutation field of the same name.
+	p.SetChecker(inputChecker{"Query.createOrder(input)": {allow: false}})
+	if _, err := p.Plan(context.Background(), mutation, nil, "user"); err != nil {
+		t.Errorf("Plan: %v", err)
+	}
+}
+
+// BenchmarkPlanWidePermissions plans a query selecting 500 fields for a
+// role whose access comes from the permission index.
+func BenchmarkPlanWidePermissions(b *testing.B) {
+	const n = 500
+	var sdl, sel strings.Builder
+	sdl.WriteString("type Query {\n  item: Item\n}\ntype Item {\n")
+	for i := range n {
+		fmt.Fprintf(&sdl, "  f%d: String\n", i)
+		fmt.Fprintf(&sel, " f%d", i)
+	}
+	sdl.WriteString("}\n")
+	query := "{ item {" + sel.String() + " } }"
+
+	store, _ := metadata.Open(b.TempDir()+"/meta.db", "metadata")
+	defer store.Close()
+	for _, perm := range []*metadata.Permission{
+		{Role: "user", TypeName: "Query", Allow: true, Condition: "{}"},
+		{Role: "user", TypeName: "Item", Allow: true, Condition: "{}"},
+		{Role: "user", TypeName: "Item", FieldName: "f499", Allow: false, Condition: "{}"},
+	} {
+		if err := store.UpsertPermission(perm); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	p := New(store, zap.NewNop())
+	if err := p.Update([]*registry.ServiceEntry{
+		makeEntry("items-svc", "http://items/graphql", "stitching", sdl.String()),
+	}); err != nil {
+		b.Fatal(err)
+	}
+	p.SetChecker(auth.NewChecker(store))
+	allowed := strings.Replace(query, " f499", "", 1)
+	if _, err := p.Plan(context.Background(), query, nil, "user"); err == nil {
+		b.Fatal("expected f499 to be denied")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		if _, err := p.Plan(context.Background(), allowed, nil, "user"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package planner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// ConditionChecker is optionally implemented by a PermissionChecker to
+// supply row-level conditions. Condition returns the boolean expression that
+// objects returned through typeName.fieldName, resolved by service, must
+// satisfy for role, with session variables already resolved, or nil for no
+// restriction.
+//
+// Expressions map object fields to operators, e.g.
+//
+//	{"userId": {"_eq": "42"}, "_or": [{"status": {"_in": ["open", "paid"]}}, ...]}
+//
+// with _and, _or and _not combining sub-expressions. Supported operators are
+// _eq, _neq, _in, _nin, _gt, _gte, _lt, _lte and _is_null.
+type ConditionChecker interface {
+	Condition(ctx context.Context, role, service, typeName, fieldName string) (map[string]any, error)
+}
+
+// RowFilter removes the objects at Path that fail Condition: list elements
+// are dropped and single objects become null. Fields holds the response keys
+// selected only to evaluate the condition; they are removed afterwards.
+type RowFilter struct {
+	Path      []string
+	Condition map[string]any
+	Fields    []string
+}
+
+// conditionAlias is the response key under which a field read by a row
+// condition is selected, keeping it apart from the client's selection.
+func conditionAlias(field string) string {
+	return "kastql_cond_" + field
+}
+
+var conditionOperators = map[string]bool{
+	"_eq": true, "_neq": true, "_in": true, "_nin": true,
+	"_gt": true, "_gte": true, "_lt": true, "_lte": true, "_is_null": true,
+}
+
+// condition returns the caller's row-level condition on typeName.fieldName.
+func (ps *planSession) condition(service, typeName, fieldName string) (map[string]any, error) {
+	cc, ok := ps.checker.(ConditionChecker)
+	if !ok {
+		return nil, nil
+	}
+	cond, err := cc.Condition(ps.ctx, ps.role, service, typeName, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("permission check error: %w", err)
+	}
+	if len(cond) == 0 {
+		return nil, nil
+	}
+	ps.usesClaims = true
+	return cond, nil
+}
+
+// injectConditionArgs turns equality tests on arguments of a root field into
+// argument values, replacing whatever the client sent. Tests on names that
+// are also fields of the returned type stay in the returned condition so the
+// objects are checked as well.
+func injectConditionArgs(field *ast.Field, cond map[string]any, returnDef *ast.Definition) (*ast.Field, map[string]any) {
+	var args ast.ArgumentList
+	rest := map[string]any{}
+	for key, test := range cond {
+		ops, _ := test.(map[string]any)
+		eq, isEq := ops["_eq"]
+		val := literalValue(eq)
+		if len(ops) != 1 || !isEq || val == nil || field.Definition.Arguments.ForName(key) == nil {
+			rest[key] = test
+			continue
+		}
+		args = append(args, &ast.Argument{Name: key, Value: val})
+		if returnDef != nil && returnDef.Fields.ForName(key) != nil {
+			rest[key] = test
+		}
+	}
+	if len(args) == 0 {
+		return field, cond
+	}
+
+	clone := *field
+	clone.Arguments = nil
+	for _, a := range field.Arguments {
+		if args.ForName(a.Name) == nil {
+			clone.Arguments = append(clone.Arguments, a)
+		}
+	}
+	clone.Arguments = append(clone.Arguments, args...)
+	slices.SortFunc(clone.Arguments, func(a, b *ast.Argument) int { return strings.Compare(a.Name, b.Name) })
+	if len(rest) == 0 {
+		rest = nil
+	}
+	return &clone, rest
+}
+
+// literalValue converts a resolved session value into a GraphQL literal, or
+// nil when it has no scalar form.
+func literalValue(v any) *ast.Value {
+	switch t := v.(type) {
+	case string:
+		return &ast.Value{Kind: ast.StringValue, Raw: t}
+	case bool:
+		return &ast.Value{Kind: ast.BooleanValue, Raw: fmt.Sprint(t)}
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return &ast.Value{Kind: ast.IntValue, Raw: fmt.Sprint(int64(t))}
+		}
+		return &ast.Value{Kind: ast.FloatValue, Raw: fmt.Sprint(t)}
+	case json.Number:
+		return &ast.Value{Kind: ast.FloatValue, Raw: t.String()}
+	}
+	return nil
+}
+
+// addRowFilter records cond as a post-filter on the objects field returns
+// at path and selects the fields it reads under their condition aliases.
+func (ps *planSession) addRowFilter(field *ast.Field, cond map[string]any, returnDef *ast.Definition, path []string) (*ast.Field, error) {
+	cols, err := conditionFields(cond)
+	if err != nil {
+		return nil, err
+	}
+	sel := field.SelectionSet
+	aliases := make([]string, 0, len(cols))
+	for _, col := range cols {
+		def := returnDef.Fields.ForName(col)
+		if def == nil {
+			return nil, fmt.Errorf("row condition references unknown field %s.%s", returnDef.Name, col)
+		}
+		alias := conditionAlias(col)
+		sel = append(sel, &ast.Field{Alias: alias, Name: col, Definition: def})
+		aliases = append(aliases, alias)
+	}
+	ps.rowFilters = append(ps.rowFilters, RowFilter{Path: path, Condition: cond, Fields: aliases})
+	return cloneFieldWithSel(field, sel), nil
+}
+
+// ValidateCondition checks that a row condition, or the value test of an
+// argument or input field rule, is well formed.
+func ValidateCondition(cond map[string]any) error {
+	valueTest := true
+	for op := range cond {
+		valueTest = valueTest && conditionOperators[op]
+	}
+	if valueTest {
+		return nil
+	}
+	_, err := conditionFields(cond)
+	return err
+}
+
+// conditionFields returns the object fields a condition reads, sorted, and
+// rejects malformed expressions.
+func conditionFields(cond map[string]any) ([]string, error) {
+	seen := map[string]bool{}
+	var walk func(map[string]any) error
+	walk = func(c map[string]any) error {
+		for key, v := range c {
+			switch key {
+			case "_and", "_or":
+				list, ok := v.([]any)
+				if !ok {
+					return fmt.Errorf("row condition %s must be a list", key)
+				}
+				for _, item := range list {
+					sub, ok := item.(map[string]any)
+					if !ok {
+						return fmt.Errorf("row condition %s must contain objects", key)
+					}
+					if err := walk(sub); err != nil {
+						return err
+					}
+				}
+			case "_not":
+				sub, ok := v.(map[string]any)
+				if !ok {
+					return fmt.Errorf("row condition _not must be an object")
+				}
+				if err := walk(sub); err != nil {
+					return err
+				}
+			default:
+				ops, ok := v.(map[string]any)
+				if !ok {
+					return fmt.Errorf("row condition on %q must be an object of operators", key)
+				}
+				for op := range ops {
+					if !conditionOperators[op] {
+						return fmt.Errorf("unsupported row condition operator %q", op)
+					}
+				}
+				seen[key] = true
+			}
+		}
+		return nil
+	}
+	if err := walk(cond); err != nil {
+		return nil, err
+	}
+	cols := make([]string, 0, len(seen))
+	for c := range seen {
+		cols = append(cols, c)
+	}
+	slices.Sort(cols)
+	return cols, nil
+}
+
+// MatchCondition reports whether obj satisfies a row condition. Field values
+// are read from their condition aliases.
+func MatchCondition(cond map[string]any, obj map[string]any) bool {
+	for key, v := range cond {
+		switch key {
+		case "_and":
+			for _, item := range v.([]any) {
+				if !MatchCondition(item.(map[string]any), obj) {
+					return false
+				}
+			}
+		case "_or":
+			list := v.([]any)
+			matched := len(list) == 0
+			for _, item := range list {
+				if MatchCondition(item.(map[string]any), obj) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "_not":
+			if MatchCondition(v.(map[string]any), obj) {
+				return false
+			}
+		default:
+			val := obj[conditionAlias(key)]
+			for op, arg := range v.(map[string]any) {
+				if !matchOperator(op, val, arg) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func matchOperator(op string, val, arg any) bool {
+	switch op {
+	case "_eq":
+		return val != nil && equalValues(val, arg)
+	case "_neq":
+		return val != nil && !equalValues(val, arg)
+	case "_in", "_nin":
+		list, _ := arg.([]any)
+		found := val != nil && slices.ContainsFunc(list, func(a any) bool { return equalValues(val, a) })
+		return found == (op == "_in")
+	case "_gt", "_gte", "_lt", "_lte":
+		c, ok := compareValues(val, arg)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "_gt":
+			return c > 0
+		case "_gte":
+			return c >= 0
+		case "_lt":
+			return c < 0
+		}
+		return c <= 0
+	case "_is_null":
+		want, _ := arg.(bool)
+		return (val == nil) == want
+	}
+	return false
+}
+
+// equalValues compares JSON values, treating numbers and their string forms
+// as equal so IDs match claims of either type.
+func equalValues(a, b any) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func compareValues(a, b any) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if !okA || !okB {
+		return 0, false
+	}
+	return strings.Compare(sa, sb), true
+}
+
+func toFloat(v any) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
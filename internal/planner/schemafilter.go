@@ -0,0 +1,208 @@
+package planner
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// SchemaFor returns the merged schema as the given role sees it: the
+// caller's contract, minus the fields the role may not access and the types
+// left with no fields. Without a contract or permission checker it is the
+// full merged schema.
+func (p *Planner) SchemaFor(ctx context.Context, role string) (*ast.Schema, error) {
+	p.mu.RLock()
+	merged := p.merged
+	p.mu.RUnlock()
+	if merged == nil || merged.Schema == nil {
+		return nil, nil
+	}
+	schema, err := p.callerSchema(ctx, merged, role)
+	if err != nil {
+		return nil, err
+	}
+	return roleSchema(ctx, merged, schema, p.checker, role)
+}
+
+func roleSchema(ctx context.Context, merged *MergedSchema, schema *ast.Schema, checker PermissionChecker, role string) (*ast.Schema, error) {
+	if checker == nil {
+		return schema, nil
+	}
+	var checkErr error
+	filtered := filterSchema(schema, func(typeName, fieldName string) bool {
+		if checkErr != nil {
+			return false
+		}
+		ok, err := checker.CanAccess(ctx, role, merged.FieldService(typeName, fieldName), typeName, fieldName)
+		if err != nil {
+			checkErr = err
+		}
+		return ok
+	})
+	if checkErr != nil {
+		return nil, checkErr
+	}
+	return filtered, nil
+}
+
+// filterSchema returns a copy of schema keeping only the object and
+// interface fields allow accepts. Types left without fields are dropped,
+// along with fields, union members and interfaces that refer to them,
+// until nothing else changes. Meta-fields (__schema, __type) and built-in
+// types are always kept. schema itself is not modified.
+func filterSchema(schema *ast.Schema, allow func(typeName, fieldName string) bool) *ast.Schema {
+	types := make(map[string]*ast.Definition, len(schema.Types))
+	for name, def := range schema.Types {
+		types[name] = def
+	}
+
+	isRoot := func(name string) bool {
+		return (schema.Query != nil && name == schema.Query.Name) ||
+			(schema.Mutation != nil && name == schema.Mutation.Name) ||
+			(schema.Subscription != nil && name == schema.Subscription.Name)
+	}
+
+	// Apply the permission predicate once per field.
+	for name, def := range schema.Types {
+		if def.BuiltIn || (def.Kind != ast.Object && def.Kind != ast.Interface) {
+			continue
+		}
+		fields := make(ast.FieldList, 0, len(def.Fields))
+		for _, f := range def.Fields {
+			if strings.HasPrefix(f.Name, "__") || allow(name, f.Name) {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) != len(def.Fields) {
+			cp := *def
+			cp.Fields = fields
+			types[name] = &cp
+		}
+	}
+
+	// Drop emptied types and whatever refers to them until stable.
+	for changed := true; changed; {
+		changed = false
+		for name, def := range types {
+			if def.BuiltIn || isRoot(name) {
+				continue
+			}
+			switch def.Kind {
+			case ast.Object, ast.Interface:
+				if len(visibleFields(def.Fields)) == 0 && len(schema.Types[name].Fields) > 0 {
+					delete(types, name)
+					changed = true
+				}
+			case ast.Union:
+				if len(def.Types) == 0 {
+					delete(types, name)
+					changed = true
+				}
+			}
+		}
+		for name, def := range types {
+			if def.BuiltIn {
+				continue
+			}
+			if cp, ok := pruneReferences(def, types); ok {
+				types[name] = cp
+				changed = true
+			}
+		}
+	}
+
+	out := &ast.Schema{
+		SchemaDirectives: schema.SchemaDirectives,
+		Types:            types,
+		Directives:       schema.Directives,
+		PossibleTypes:    map[string][]*ast.Definition{},
+		Implements:       map[string][]*ast.Definition{},
+		Description:      schema.Description,
+	}
+	if schema.Query != nil {
+		out.Query = types[schema.Query.Name]
+	}
+	if schema.Mutation != nil {
+		out.Mutation = types[schema.Mutation.Name]
+	}
+	if schema.Subscription != nil {
+		out.Subscription = types[schema.Subscription.Name]
+	}
+	for _, def := range types {
+		switch def.Kind {
+		case ast.Object:
+			out.AddPossibleType(def.Name, def)
+			for _, iface := range def.Interfaces {
+				if idef := types[iface]; idef != nil {
+					out.AddPossibleType(iface, def)
+					out.AddImplements(def.Name, idef)
+				}
+			}
+		case ast.Union:
+			for _, member := range def.Types {
+				if mdef := types[member]; mdef != nil {
+					out.AddPossibleType(def.Name, mdef)
+					out.AddImplements(member, def)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// pruneReferences removes the fields, union members and interfaces of def
+// that point at types no longer in types. It reports whether anything was
+// removed; def itself is never modified.
+func pruneReferences(def *ast.Definition, types map[string]*ast.Definition) (*ast.Definition, bool) {
+	cp := *def
+	changed := false
+
+	if def.Kind == ast.Object || def.Kind == ast.Interface {
+		fields := make(ast.FieldList, 0, len(def.Fields))
+		for _, f := range def.Fields {
+			if types[namedTypeName(f.Type)] != nil {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) != len(def.Fields) {
+			cp.Fields, changed = fields, true
+		}
+
+		var ifaces []string
+		for _, iface := range def.Interfaces {
+			if types[iface] != nil {
+				ifaces = append(ifaces, iface)
+			}
+		}
+		if len(ifaces) != len(def.Interfaces) {
+			cp.Interfaces, changed = ifaces, true
+		}
+	}
+	if def.Kind == ast.Union {
+		var members []string
+		for _, m := range def.Types {
+			if types[m] != nil {
+				members = append(members, m)
+			}
+		}
+		if len(members) != len(def.Types) {
+			cp.Types, changed = members, true
+		}
+	}
+	if !changed {
+		return def, false
+	}
+	return &cp, true
+}
+
+// visibleFields returns the fields that are not meta-fields.
+func visibleFields(fields ast.FieldList) ast.FieldList {
+	out := make(ast.FieldList, 0, len(fields))
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, "__") {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -1,6 +1,7 @@
 package planner
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -220,8 +221,9 @@ func valueToString(v *ast.Value) string {
 	case ast.IntValue, ast.FloatValue, ast.EnumValue:
 		return v.Raw
 	case ast.StringValue:
-		// Re-quote, escaping any embedded quotes.
-		return `"` + strings.ReplaceAll(v.Raw, `"`, `\"`) + `"`
+		// Re-quote; JSON string escapes are valid GraphQL string escapes.
+		b, _ := json.Marshal(v.Raw)
+		return string(b)
 	case ast.BlockValue:
 		return `"""` + v.Raw + `"""`
 	case ast.BooleanValue, ast.NullValue:
@@ -1,6 +1,14 @@
 package planner
 
-import "github.com/vektah/gqlparser/v2/ast"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
 
 // MergedSchema is the unified view of all registered services.
 type MergedSchema struct {
@@ -20,19 +28,98 @@ type MergedSchema struct {
 	// e.g. EntityKeys["User"]["users-svc"] = ["id"]
 	EntityKeys map[string]map[string][]string
 
+	// @tag names from service SDL, keyed by "Type" or "Type.field". The
+	// merged SDL drops @tag; contracts select schema subsets from these.
+	Tags map[string][]string
+
 	// Per-service metadata
 	ServiceURLs       map[string]string            // name → URL
 	ServiceTypes      map[string]string            // name → "federation"|"stitching"
 	ServiceHeaders    map[string]map[string]string // name → headers to send upstream
 	ServiceTimeoutMs  map[string]int               // name → timeout in ms (0 = global default)
+	ServiceMaxBodyKB  map[string]int               // name → upstream response body cap in KB (0 = default)
+	ServiceEncoding   map[string]string            // name → request body compression ("" = none)
 	ServiceRetryCount map[string]int               // name → retry count (0 = no retries)
+	ServiceRetry      map[string]RetryPolicy       // name → retry policy
+	ServiceDedupe     map[string]DedupePolicy      // name → in-flight deduplication policy
+	ServiceHeaderRule map[string]HeaderRules       // name → header propagation rules
+
+	// Warnings lists problems that did not stop the merge, such as a stored
+	// policy that could not be used and was replaced by the default.
+	Warnings []string
+}
+
+// FieldService returns the service that resolves typeName.fieldName: the
+// owner of the root field, else the owner of the type. It is "" when
+// neither is known.
+func (m *MergedSchema) FieldService(typeName, fieldName string) string {
+	if m.Schema != nil {
+		switch {
+		case m.Schema.Query != nil && typeName == m.Schema.Query.Name:
+			return m.QueryOwnership[fieldName]
+		case m.Schema.Mutation != nil && typeName == m.Schema.Mutation.Name:
+			return m.MutationOwnership[fieldName]
+		case m.Schema.Subscription != nil && typeName == m.Schema.Subscription.Name:
+			return m.SubscriptionOwnership[fieldName]
+		}
+	}
+	return m.TypeOwnership[typeName]
 }
 
 // QueryPlan describes how to execute a GraphQL operation across multiple services.
 type QueryPlan struct {
+	// Steps in plan order. For mutations each root step is followed by its
+	// dependents, and root steps appear in document field order.
 	Steps         []*Step
 	OperationType string // "query" | "mutation" | "subscription"
 	OperationName string // named operation, or "" for anonymous
+
+	Streams []StreamMeta // @stream fields, outermost first
+
+	// Introspection holds the answers to root meta-fields (__schema, __type,
+	// __typename) by response key, already filtered for the caller's role.
+	// The executor merges it into the response data.
+	Introspection map[string]any
+	Introspects   bool // __schema or __type was selected
+
+	// Denied lists the root fields stripped under partial denial; the
+	// executor returns them as null with a FORBIDDEN error.
+	Denied []DeniedField
+
+	// UsesClaims is set when a row condition or argument preset shaped the
+	// plan, even one that only became argument values.
+	UsesClaims bool
+}
+
+// DependsOnClaims reports whether the response depends on the caller's
+// claims rather than only their role, and so must not be shared between
+// callers. Besides row conditions and presets, that is any step whose
+// service is sent headers injected from claims, since it may answer
+// differently per caller.
+func (qp *QueryPlan) DependsOnClaims() bool {
+	if qp.UsesClaims {
+		return true
+	}
+	for _, s := range qp.Steps {
+		if len(s.RowFilters) > 0 || len(s.HeaderRules.FromClaims) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Incremental reports whether the plan has @defer or @stream parts that can
+// be delivered after the initial response.
+func (qp *QueryPlan) Incremental() bool {
+	if len(qp.Streams) > 0 {
+		return true
+	}
+	for _, s := range qp.Steps {
+		if s.Meta.Defer != nil {
+			return true
+		}
+	}
+	return false
 }
 
 // Step is one upstream call inside a QueryPlan.
@@ -43,12 +130,30 @@ type Step struct {
 	ServiceType string // "federation" | "stitching"
 
 	// Per-service retry and timeout config, copied from metadata at plan time.
-	RetryCount int // 0 = no retries
-	TimeoutMs  int // 0 = use executor global default
+	RetryCount  int // 0 = no retries
+	TimeoutMs   int // 0 = use executor global default
+	RetryPolicy RetryPolicy
+
+	MaxResponseKB int // upstream response size cap; 0 = executor default
+
+	// Compression applied to request bodies sent to this service; "" = none.
+	Encoding string
+
+	// Dedupe lets concurrent identical calls share one upstream request.
+	// nil = every call goes upstream (always nil for mutation operations).
+	Dedupe *DedupePolicy
+
+	// Headers sent to this service: static service headers plus the
+	// client headers shaped by HeaderRules.
+	StaticHeaders map[string]string
+	HeaderRules   HeaderRules
 
 	Query     string         // sub-query to send to this service
 	Variables map[string]any // variables for this step (may be subset of original)
 
+	// Files this step sends as a multipart request; empty = plain JSON.
+	Uploads []StepUpload
+
 	// Step IDs that must complete before this step can run.
 	DependsOn []string
 
@@ -57,6 +162,204 @@ type Step struct {
 	MergePath []string
 
 	Meta StepMeta
+
+	// Row-level permission conditions applied to this step's data before
+	// anything depending on it runs.
+	RowFilters []RowFilter
+
+	// Fields stripped from this step under partial denial, nulled in its
+	// data with a FORBIDDEN error each.
+	Denied []DeniedField
+}
+
+// RetryPolicy controls which failed upstream calls are retried and how.
+// The zero value retries network errors and any 5xx with full-jitter
+// exponential backoff (100ms base, 5s cap) and no retry budget.
+type RetryPolicy struct {
+	// RetryOn lists retryable conditions: "5xx", "4xx", "network", "timeout",
+	// or an exact HTTP status such as "429". Empty = ["5xx", "network"].
+	RetryOn []string `json:"retry_on,omitempty"`
+
+	BaseBackoffMs int  `json:"base_backoff_ms,omitempty"` // 0 = 100ms
+	MaxBackoffMs  int  `json:"max_backoff_ms,omitempty"`  // 0 = 5000ms
+	NoJitter      bool `json:"no_jitter,omitempty"`       // true = plain exponential backoff
+
+	// BudgetRatio caps retries to this fraction of recent requests to the
+	// service (e.g. 0.2 = at most one retry per five calls). 0 = unlimited.
+	BudgetRatio float64 `json:"budget_ratio,omitempty"`
+	// BudgetMinRetries is always allowed per budget window regardless of ratio.
+	BudgetMinRetries int `json:"budget_min_retries,omitempty"`
+
+	// AllowMutations permits retrying mutation root steps. Off by default
+	// because a retried mutation may be applied twice.
+	AllowMutations bool `json:"allow_mutations,omitempty"`
+}
+
+// Validate reports unknown retry_on conditions and negative values.
+func (rp RetryPolicy) Validate() error {
+	for _, cond := range rp.RetryOn {
+		switch cond {
+		case "5xx", "4xx", "network", "timeout":
+			continue
+		}
+		if code, err := strconv.Atoi(cond); err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("unknown retry_on condition %q", cond)
+		}
+	}
+	if rp.BaseBackoffMs < 0 || rp.MaxBackoffMs < 0 || rp.BudgetMinRetries < 0 {
+		return errors.New("retry policy values must not be negative")
+	}
+	if rp.BudgetRatio < 0 || rp.BudgetRatio > 1 {
+		return errors.New("budget_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// ParseRetryPolicy decodes and validates a retry policy stored as JSON.
+// An empty string or "{}" yields the zero policy.
+func ParseRetryPolicy(raw string) (RetryPolicy, error) {
+	var rp RetryPolicy
+	if raw == "" || raw == "{}" {
+		return rp, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &rp); err != nil {
+		return rp, fmt.Errorf("decode retry policy: %w", err)
+	}
+	return rp, rp.Validate()
+}
+
+// DedupePolicy controls in-flight deduplication of identical upstream calls.
+type DedupePolicy struct {
+	Enabled bool `json:"enabled"`
+	// KeyHeaders are the forwarded request headers that distinguish callers,
+	// e.g. ["Authorization", "X-Tenant-Id"]. Calls only share a response when
+	// these header values match. Empty = ["Authorization"]. Headers the
+	// service's header rules set or inject from claims always count too.
+	KeyHeaders []string `json:"key_headers,omitempty"`
+}
+
+// ParseDedupePolicy decodes a deduplication policy stored as JSON.
+// An empty string or "{}" yields a disabled policy.
+func ParseDedupePolicy(raw string) (DedupePolicy, error) {
+	var dp DedupePolicy
+	if raw == "" || raw == "{}" {
+		return dp, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &dp); err != nil {
+		return dp, fmt.Errorf("decode dedupe policy: %w", err)
+	}
+	return dp, nil
+}
+
+// HeaderRules controls which client headers reach a service and which
+// headers kastql injects. They are applied in field order: client headers are
+// filtered by Allow and Deny, then renamed; Static, FromClaims and FromRole
+// are injected last and override any client header of the same name.
+type HeaderRules struct {
+	Allow  []string          `json:"allow,omitempty"`  // forward only these client headers (empty = all)
+	Deny   []string          `json:"deny,omitempty"`   // never forward these client headers
+	Rename map[string]string `json:"rename,omitempty"` // client header → upstream header name
+
+	Static     map[string]string `json:"static,omitempty"`      // upstream header → fixed value
+	FromClaims map[string]string `json:"from_claims,omitempty"` // upstream header → JWT claim, e.g. {"X-User-Id": "sub"}
+	FromRole   string            `json:"from_role,omitempty"`   // upstream header that carries the resolved role
+
+	// Response lists the service's response headers passed back to the
+	// client. When several services return the same header, ResponseMerge
+	// picks how they combine (default: Set-Cookie appends, Cache-Control is
+	// most restrictive, anything else keeps the first in plan order).
+	Response      []string          `json:"response,omitempty"`
+	ResponseMerge map[string]string `json:"response_merge,omitempty"` // header → first | last | append | most_restrictive
+}
+
+// Response header merge policies.
+const (
+	MergeFirst           = "first"
+	MergeLast            = "last"
+	MergeAppend          = "append"
+	MergeMostRestrictive = "most_restrictive" // Cache-Control only
+)
+
+// ResponseMergePolicy returns the merge policy for a response header.
+func (hr HeaderRules) ResponseMergePolicy(name string) string {
+	for h, policy := range hr.ResponseMerge {
+		if strings.EqualFold(h, name) {
+			return policy
+		}
+	}
+	switch strings.ToLower(name) {
+	case "set-cookie":
+		return MergeAppend
+	case "cache-control":
+		return MergeMostRestrictive
+	}
+	return MergeFirst
+}
+
+// unforwardableResponseHeaders describe the upstream connection or body
+// framing. The router writes its own, and copying an upstream's corrupts the
+// response once it is re-encoded or compressed.
+var unforwardableResponseHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Content-Encoding", "Content-Type",
+}
+
+// Validate reports empty header names, unknown merge policies and response
+// headers that cannot be passed back to the client.
+func (hr HeaderRules) Validate() error {
+	names := append(append([]string{}, hr.Allow...), hr.Deny...)
+	for from, to := range hr.Rename {
+		names = append(names, from, to)
+	}
+	for name := range hr.Static {
+		names = append(names, name)
+	}
+	for name, claim := range hr.FromClaims {
+		if claim == "" {
+			return fmt.Errorf("from_claims: header %q has no claim", name)
+		}
+		names = append(names, name)
+	}
+	for _, name := range hr.Response {
+		for _, h := range unforwardableResponseHeaders {
+			if strings.EqualFold(strings.TrimSpace(name), h) {
+				return fmt.Errorf("response: %s is set by the router and cannot be passed through", h)
+			}
+		}
+	}
+	names = append(names, hr.Response...)
+	for name, policy := range hr.ResponseMerge {
+		switch policy {
+		case MergeFirst, MergeLast, MergeAppend:
+		case MergeMostRestrictive:
+			if !strings.EqualFold(name, "Cache-Control") {
+				return fmt.Errorf("response_merge: %s only applies to Cache-Control", policy)
+			}
+		default:
+			return fmt.Errorf("response_merge: unknown policy %q for %q", policy, name)
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("header names must not be empty")
+		}
+	}
+	return nil
+}
+
+// ParseHeaderRules decodes and validates header rules stored as JSON.
+// An empty string or "{}" yields rules that forward every client header.
+func ParseHeaderRules(raw string) (HeaderRules, error) {
+	var hr HeaderRules
+	if raw == "" || raw == "{}" {
+		return hr, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &hr); err != nil {
+		return hr, fmt.Errorf("decode header rules: %w", err)
+	}
+	return hr, hr.Validate()
 }
 
 // StepKind classifies a Step.
@@ -73,6 +376,21 @@ type StepMeta struct {
 	Kind   StepKind
 	Entity *EntityMeta // non-nil when Kind == StepKindEntity
 	Join   *JoinMeta   // non-nil when Kind == StepKindJoin
+	Defer  *DeferMeta  // non-nil when the step was planned from a @defer fragment
+}
+
+// DeferMeta marks a step whose data is delivered after the initial response
+// when the client accepts incremental delivery.
+type DeferMeta struct {
+	Label string // @defer(label:), echoed in the incremental payload
+}
+
+// StreamMeta describes a list field requested with @stream. Items past
+// InitialCount are delivered after the initial response.
+type StreamMeta struct {
+	Path         []string // response keys from the root to the list field
+	InitialCount int
+	Label        string
 }
 
 // EntityMeta describes a federation _entities resolution step.
@@ -82,6 +400,28 @@ type EntityMeta struct {
 	ParentStepID string   // step that provides the entity key values
 	ParentPath   []string // path in parent result where the parent objects live
 	Selection    string   // selection set to fetch, e.g. "{ name email }"
+
+	// Fields splits Selection into its top-level fields so the executor can
+	// reuse entity fields resolved earlier in the request and fetch only the
+	// rest. nil when the selection contains fragments and cannot be split.
+	Fields []EntityField
+}
+
+// EntityField is one top-level field of an entity step's selection.
+type EntityField struct {
+	ResponseKey string // alias or field name in the response
+	Selection   string // query text of the field, including arguments and sub-selection
+}
+
+// QueryFor builds the _entities query for a subset of the step's Fields.
+func (em *EntityMeta) QueryFor(fields []EntityField) string {
+	var b strings.Builder
+	b.WriteString("{\n")
+	for _, f := range fields {
+		b.WriteString(f.Selection)
+	}
+	b.WriteString("  }")
+	return buildEntitiesQuery(em.TypeName, em.KeyFields, b.String())
 }
 
 // JoinMeta describes a stitching in-memory join step.
@@ -0,0 +1,139 @@
+package planner
+
+import (
+	"mime/multipart"
+	"sort"
+	"strconv"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// Upload is a file from a GraphQL multipart request. The router puts it into
+// the request variables where the client's map pointed; the planner hands it
+// to the step whose selection uses that variable.
+type Upload struct {
+	File *multipart.FileHeader
+}
+
+// MarshalJSON encodes an upload as null, the placeholder the multipart
+// request spec uses for files in the operations JSON.
+func (*Upload) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// StepUpload is one file a step sends upstream. Path is its position in the
+// step's request, e.g. "variables.file" or "variables.files.1".
+type StepUpload struct {
+	Path   string
+	Upload *Upload
+}
+
+// uploadsFor returns the uploads held by variables that sel references, in
+// a stable order. Variables the selection doesn't use stay with whichever
+// other step does.
+func (ps *planSession) uploadsFor(sel ast.SelectionSet) []StepUpload {
+	if len(ps.variables) == 0 {
+		return nil
+	}
+	used := map[string]bool{}
+	ps.collectVariables(sel, used, map[string]bool{})
+
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []StepUpload
+	for _, name := range names {
+		out = appendUploads(out, "variables."+name, ps.variables[name])
+	}
+	return out
+}
+
+// usedVarDefs returns the definitions of the variables sel references. A
+// step only declares those: the rest belong to other steps, or to arguments
+// replaced by presets or row conditions, and an unused definition makes the
+// upstream reject the query.
+func (ps *planSession) usedVarDefs(defs ast.VariableDefinitionList, sel ast.SelectionSet) ast.VariableDefinitionList {
+	used := map[string]bool{}
+	ps.collectVariables(sel, used, map[string]bool{})
+	var out ast.VariableDefinitionList
+	for _, d := range defs {
+		if used[d.Variable] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// collectVariables records every variable referenced by arguments or
+// directives in sel, following fragment spreads once each.
+func (ps *planSession) collectVariables(sel ast.SelectionSet, used, seenFragments map[string]bool) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *ast.Field:
+			for _, arg := range s.Arguments {
+				valueVariables(arg.Value, used)
+			}
+			directiveVariables(s.Directives, used)
+			ps.collectVariables(s.SelectionSet, used, seenFragments)
+		case *ast.InlineFragment:
+			directiveVariables(s.Directives, used)
+			ps.collectVariables(s.SelectionSet, used, seenFragments)
+		case *ast.FragmentSpread:
+			directiveVariables(s.Directives, used)
+			if seenFragments[s.Name] {
+				continue
+			}
+			seenFragments[s.Name] = true
+			if def := ps.fragments.ForName(s.Name); def != nil {
+				ps.collectVariables(def.SelectionSet, used, seenFragments)
+			}
+		}
+	}
+}
+
+func directiveVariables(dirs ast.DirectiveList, used map[string]bool) {
+	for _, d := range dirs {
+		for _, arg := range d.Arguments {
+			valueVariables(arg.Value, used)
+		}
+	}
+}
+
+func valueVariables(v *ast.Value, used map[string]bool) {
+	if v == nil {
+		return
+	}
+	if v.Kind == ast.Variable {
+		used[v.Raw] = true
+		return
+	}
+	for _, child := range v.Children {
+		valueVariables(child.Value, used)
+	}
+}
+
+// appendUploads walks a variable value and appends every upload found,
+// with its dotted path.
+func appendUploads(out []StepUpload, path string, v any) []StepUpload {
+	switch v := v.(type) {
+	case *Upload:
+		out = append(out, StepUpload{Path: path, Upload: v})
+	case []any:
+		for i, item := range v {
+			out = appendUploads(out, path+"."+strconv.Itoa(i), item)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out = appendUploads(out, path+"."+k, v[k])
+		}
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deformal/kastql/internal/cache"
+	"github.com/deformal/kastql/internal/metadata"
+)
+
+// Bounds of the APQ cache. Queries clients register themselves are kept in
+// memory only; the persisted_queries table is the admin-managed allowlist.
+const (
+	apqMaxEntries = 10_000
+	apqTTL        = 24 * time.Hour
+)
+
+// NewAPQCache returns a cache for automatic persisted queries.
+func NewAPQCache() *cache.Cache {
+	return cache.New(apqMaxEntries, apqTTL)
+}
+
+// requestExtensions is the "extensions" member of a GraphQL request.
+type requestExtensions struct {
+	PersistedQuery *persistedQueryExtension `json:"persistedQuery,omitempty"`
+}
+
+// persistedQueryExtension is the Apollo automatic persisted query (APQ)
+// extension: the client sends the query's SHA-256 instead of its text, and
+// only sends the text after the server reports PersistedQueryNotFound.
+type persistedQueryExtension struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+// APQ error messages and codes, as expected by Apollo clients.
+const (
+	errPersistedQueryNotFound     = "PersistedQueryNotFound"
+	errPersistedQueryNotSupported = "PersistedQueryNotSupported"
+	errPersistedQueryHashMismatch = "provided sha does not match query"
+)
+
+// apqError is returned by resolvePersistedQuery with the response to send.
+type apqError struct {
+	message string
+	code    string
+	status  int
+}
+
+func (e *apqError) Error() string { return e.message }
+
+// queryHash returns the lowercase hex SHA-256 of a query, the APQ id format.
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// persistedQuery is what resolvePersistedQuery found out about a request.
+type persistedQuery struct {
+	hash        string // APQ hash the query was sent or looked up by; "" without APQ
+	allowlisted bool   // the query text is in the persisted_queries allowlist
+}
+
+// resolvePersistedQuery applies the APQ extension to req. With only a hash
+// it loads the query text from the persisted_queries allowlist or, failing
+// that, the APQ cache. With a hash and a query it verifies the hash; the
+// query is cached by registerPersistedQuery once it has planned, so a query
+// that does not validate is never stored.
+func (h *graphqlHandler) resolvePersistedQuery(req *graphqlRequest) (persistedQuery, error) {
+	if req.Extensions == nil || req.Extensions.PersistedQuery == nil {
+		return persistedQuery{}, nil
+	}
+	pq := req.Extensions.PersistedQuery
+	hash := strings.ToLower(pq.Sha256Hash)
+	if pq.Version != 1 || hash == "" || (h.store == nil && h.apq == nil) {
+		return persistedQuery{}, &apqError{message: errPersistedQueryNotSupported, code: "PERSISTED_QUERY_NOT_SUPPORTED", status: http.StatusOK}
+	}
+	if req.Query != "" && queryHash(req.Query) != hash {
+		return persistedQuery{}, &apqError{message: errPersistedQueryHashMismatch, code: "BAD_REQUEST", status: http.StatusBadRequest}
+	}
+
+	out := persistedQuery{hash: hash}
+	if h.store != nil {
+		stored, err := h.store.GetPersistedQuery(hash)
+		switch {
+		case err == nil:
+			out.allowlisted = req.Query == "" || stored.Query == req.Query
+			if req.Query == "" {
+				req.Query = stored.Query
+			}
+			return out, nil
+		case !errors.Is(err, metadata.ErrPersistedQueryNotFound):
+			return persistedQuery{}, err
+		}
+	}
+	if req.Query == "" {
+		query, ok := []byte(nil), false
+		if h.apq != nil {
+			query, ok = h.apq.Get(hash)
+		}
+		if !ok {
+			return persistedQuery{}, &apqError{message: errPersistedQueryNotFound, code: "PERSISTED_QUERY_NOT_FOUND", status: http.StatusOK}
+		}
+		req.Query = string(query)
+	}
+	return out, nil
+}
+
+// registerPersistedQuery stores a query sent with its APQ hash in the APQ
+// cache so later requests can send the hash alone.
+func (h *graphqlHandler) registerPersistedQuery(pq persistedQuery, query string) {
+	if h.apq != nil && pq.hash != "" && !pq.allowlisted {
+		h.apq.Set(pq.hash, []byte(query))
+	}
+}
+
+// writeGQLErrorCode writes a single GraphQL error with extensions.code set.
+func writeGQLErrorCode(w http.ResponseWriter, msg, code string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]any{{"message": msg, "extensions": map[string]any{"code": code}}},
+	})
+}
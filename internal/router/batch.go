@@ -0,0 +1,108 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/deformal/kastql/internal/security"
+)
+
+// defaultBatchConcurrency bounds how many operations of one batch run at
+// once when the batch_concurrency setting is unset.
+const defaultBatchConcurrency = 8
+
+// serveBatch executes every operation of a batched request and writes their
+// results as a JSON array in request order. Each operation goes through the
+// same guards, cache and metrics as a single request; a failing operation
+// only fills its own slot with an errors object.
+func (h *graphqlHandler) serveBatch(w http.ResponseWriter, r *http.Request, batch []graphqlRequest, cfg *security.Config) {
+	ip := security.ClientIP(r)
+	if cfg.BatchMaxSize > 0 && len(batch) > cfg.BatchMaxSize {
+		h.secMgr.LogBlocked("batch_too_large", ip, r.URL.Path)
+		writeGQLError(w, fmt.Sprintf("batch exceeds maximum of %d operations", cfg.BatchMaxSize), http.StatusBadRequest)
+		return
+	}
+	// RateLimitMiddleware already counted the request itself; charge the
+	// remaining operations so a batch can't multiply the allowed rate.
+	if cfg.RateLimitEnabled && !h.secMgr.RateLimiter().AllowRequests(ip, len(batch)-1) {
+		h.secMgr.LogBlocked("rate_limit", ip, r.URL.Path)
+		writeGQLError(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	concurrency := cfg.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBatchConcurrency
+	}
+	recs := make([]*operationRecorder, len(batch))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			recs[i] = &operationRecorder{header: http.Header{}}
+			h.serveOperation(recs[i], r, batch[i], cfg, true)
+		}()
+	}
+	wg.Wait()
+
+	results := make([]json.RawMessage, len(batch))
+	for i, rec := range recs {
+		results[i] = rec.result()
+		mergeBatchHeaders(w.Header(), rec.header)
+	}
+
+	var rw http.ResponseWriter = w
+	if cfg.MaxResponseBodyKB > 0 {
+		rw = security.NewCappedWriter(w, cfg.MaxResponseBodyKB)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(results)
+}
+
+// mergeBatchHeaders copies the response headers of one batched operation
+// into the batch response. Every Set-Cookie is kept; for other headers the
+// first operation in request order that sets one wins. Headers describing
+// the operation's own body, and Cache-Control, which can't hold for the
+// combined result, are left out.
+func mergeBatchHeaders(dst, src http.Header) {
+	for name, values := range src {
+		switch name {
+		case "Content-Type", "X-Cache", "Cache-Control":
+		case "Set-Cookie":
+			dst[name] = append(dst[name], values...)
+		default:
+			if _, ok := dst[name]; !ok {
+				dst[name] = values
+			}
+		}
+	}
+}
+
+// operationRecorder buffers the response of one batched operation. Status
+// codes are dropped: the batch as a whole is answered with 200. Headers are
+// merged into the batch response by mergeBatchHeaders.
+type operationRecorder struct {
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (o *operationRecorder) Header() http.Header         { return o.header }
+func (o *operationRecorder) Write(p []byte) (int, error) { return o.buf.Write(p) }
+func (o *operationRecorder) WriteHeader(int)             {}
+
+func (o *operationRecorder) result() json.RawMessage {
+	body := bytes.TrimSpace(o.buf.Bytes())
+	if len(body) == 0 {
+		return json.RawMessage("null")
+	}
+	return body
+}
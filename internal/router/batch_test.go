@@ -0,0 +1,30 @@
+package router
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMergeBatchHeaders(t *testing.T) {
+	dst := http.Header{}
+	mergeBatchHeaders(dst, http.Header{
+		"Set-Cookie":    {"a=1"},
+		"X-Trace":       {"first"},
+		"Content-Type":  {"application/json"},
+		"Cache-Control": {"public, max-age=60"},
+	})
+	mergeBatchHeaders(dst, http.Header{
+		"Set-Cookie": {"b=2", "c=3"},
+		"X-Trace":    {"second"},
+		"X-Cache":    {"HIT"},
+	})
+
+	want := http.Header{
+		"Set-Cookie": {"a=1", "b=2", "c=3"},
+		"X-Trace":    {"first"},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %v, want %v", dst, want)
+	}
+}
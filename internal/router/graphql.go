@@ -3,21 +3,27 @@ package router
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"mime/multipart"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/vektah/gqlparser/v2/gqlerror"
 	"go.uber.org/zap"
 
 	"github.com/deformal/kastql/internal/auth"
 	"github.com/deformal/kastql/internal/cache"
 	"github.com/deformal/kastql/internal/executor"
+	"github.com/deformal/kastql/internal/metadata"
 	"github.com/deformal/kastql/internal/metrics"
 	"github.com/deformal/kastql/internal/planner"
 	"github.com/deformal/kastql/internal/security"
 )
 
 type graphqlHandler struct {
+	store                *metadata.Store // persisted query allowlist
+	apq                  *cache.Cache    // queries registered by APQ clients; nil = registration disabled
 	planner              *planner.Planner
 	executor             *executor.Executor
 	metrics              *metrics.Store
@@ -28,16 +34,21 @@ type graphqlHandler struct {
 }
 
 type graphqlRequest struct {
-	Query         string         `json:"query"`
-	Variables     map[string]any `json:"variables"`
-	OperationName string         `json:"operationName"`
+	Query         string             `json:"query"`
+	Variables     map[string]any     `json:"variables"`
+	OperationName string             `json:"operationName"`
+	Extensions    *requestExtensions `json:"extensions,omitempty"`
 }
 
 func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, POST")
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if wantsGraphQLResponse(r) {
+		w = &mediaTypeWriter{ResponseWriter: w, contentType: mediaGraphQLResponse}
+	}
 
 	// ── Security: persisted query / batch guard ───────────────────────────────
 	var cfg *security.Config
@@ -45,54 +56,112 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		cfg = h.secMgr.Config()
 	}
 
-	var req graphqlRequest
-
-	if cfg != nil && h.secMgr != nil {
-		// Decode raw body to detect batch arrays and handle persisted queries.
-		var raw json.RawMessage
-		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
-			writeGQLError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+	// GET carries a single operation in URL parameters; serveOperation
+	// rejects anything but queries once the operation type is known.
+	if r.Method == http.MethodGet {
+		req, err := requestFromURL(r.URL.Query())
+		if err != nil {
+			writeGQLError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		w.Header().Add("Vary", "Accept")
+		h.serveOperation(w, r, req, cfg, false)
+		return
+	}
 
-		// Batch query detection — reject if batching disabled.
-		if len(raw) > 0 && raw[0] == '[' {
-			if !cfg.BatchQueriesEnabled {
-				ip := security.ClientIP(r)
-				h.secMgr.LogBlocked("batch_not_allowed", ip, r.URL.Path)
-				writeGQLError(w, "batch queries are disabled", http.StatusBadRequest)
-				return
-			}
-			// Batch is enabled: decode all and process first (simple forward for now).
-			var batch []graphqlRequest
-			if err := json.Unmarshal(raw, &batch); err != nil {
-				writeGQLError(w, "invalid batch body: "+err.Error(), http.StatusBadRequest)
-				return
-			}
-			if len(batch) == 0 {
-				writeGQLError(w, "empty batch", http.StatusBadRequest)
-				return
+	// Multipart requests (file uploads) carry the body in the "operations"
+	// field; the files are attached to variables once it is decoded.
+	var (
+		raw  json.RawMessage
+		form *multipart.Form
+	)
+	if isMultipartRequest(r) {
+		if !hasPreflightHeader(r) {
+			if h.secMgr != nil {
+				h.secMgr.LogBlocked("csrf", security.ClientIP(r), r.URL.Path)
 			}
-			req = batch[0]
-		} else {
-			if err := json.Unmarshal(raw, &req); err != nil {
-				writeGQLError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
-				return
+			writeGQLError(w, "multipart requests must set the Apollo-Require-Preflight header", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if raw, form, err = parseUploadForm(r); err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+				if h.secMgr != nil {
+					h.secMgr.LogBlocked("request_too_large", security.ClientIP(r), r.URL.Path)
+				}
 			}
+			writeGQLError(w, err.Error(), status)
+			return
 		}
+		defer form.RemoveAll()
+	} else if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeGQLError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Persisted-query enforcement.
-		if cfg.PersistedOnly && req.Query != "" {
+	// Batch query detection — reject if batching disabled.
+	if cfg != nil && h.secMgr != nil && len(raw) > 0 && raw[0] == '[' {
+		if !cfg.BatchQueriesEnabled {
 			ip := security.ClientIP(r)
-			h.secMgr.LogBlocked("non_persisted_query", ip, r.URL.Path)
-			writeGQLError(w, "only persisted queries are accepted", http.StatusForbidden)
+			h.secMgr.LogBlocked("batch_not_allowed", ip, r.URL.Path)
+			writeGQLError(w, "batch queries are disabled", http.StatusBadRequest)
 			return
 		}
-	} else {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeGQLError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		var batch []graphqlRequest
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			writeGQLError(w, "invalid batch body: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		if len(batch) == 0 {
+			writeGQLError(w, "empty batch", http.StatusBadRequest)
+			return
+		}
+		if err := attachUploads(form, batch, true); err != nil {
+			writeGQLError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.serveBatch(w, r, batch, cfg)
+		return
+	}
+
+	var req graphqlRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		writeGQLError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := attachUploads(form, []graphqlRequest{req}, false); err != nil {
+		writeGQLError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.serveOperation(w, r, req, cfg, false)
+}
+
+// serveOperation runs one GraphQL operation through the guards, cache,
+// planner and executor and writes its response to w. Batched operations are
+// never streamed incrementally and leave the response size cap to the batch.
+func (h *graphqlHandler) serveOperation(w http.ResponseWriter, r *http.Request, req graphqlRequest, cfg *security.Config, batched bool) {
+	// ── Automatic persisted queries ───────────────────────────────────────────
+	// New queries are only registered when persisted_only is off; with it on,
+	// the query text must be in the allowlist.
+	persistedOnly := cfg != nil && cfg.PersistedOnly
+	pq, err := h.resolvePersistedQuery(&req)
+	if err != nil {
+		var ae *apqError
+		if errors.As(err, &ae) {
+			writeGQLErrorCode(w, ae.message, ae.code, ae.status)
+			return
+		}
+		writeGQLError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if persistedOnly && req.Query != "" && !pq.allowlisted {
+		ip := security.ClientIP(r)
+		h.secMgr.LogBlocked("non_persisted_query", ip, r.URL.Path)
+		writeGQLError(w, "only persisted queries are accepted", http.StatusForbidden)
+		return
 	}
 
 	if req.Query == "" {
@@ -139,16 +208,6 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// ── Introspection check ───────────────────────────────────────────────────
-	if isIntrospectionQuery(req.Query) {
-		if h.introspectionEnabled != nil && !h.introspectionEnabled() {
-			writeGQLError(w, "GraphQL introspection is disabled.", http.StatusOK)
-			return
-		}
-		h.serveIntrospection(w, r)
-		return
-	}
-
 	// ── Query timeout ─────────────────────────────────────────────────────────
 	ctx := r.Context()
 	if cfg != nil && cfg.QueryTimeoutMs > 0 {
@@ -159,16 +218,29 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	start := time.Now()
 	role := auth.GetRole(ctx)
+	contract := auth.GetContract(ctx)
+	ctx = planner.WithContract(ctx, contract)
+	ctx = planner.WithOperationName(ctx, req.OperationName)
 
 	// ── Response cache (queries only, skip mutations/introspection) ───────────
 	var cacheKey string
 	if h.cache != nil && !strings.Contains(strings.ToLower(req.Query), "mutation") {
-		cacheKey = cache.QueryKey(req.Query, req.OperationName, role, req.Variables)
-		if cached, ok := h.cache.Get(cacheKey); ok {
+		// Callers pinned to a contract must not share entries with full-schema callers.
+		cacheKey = cache.QueryKey(req.Query, req.OperationName, role+"\x00"+contract, req.Variables)
+		if raw, ok := h.cache.Get(cacheKey); ok {
+			if !persistedOnly {
+				h.registerPersistedQuery(pq, req.Query) // it planned when cached
+			}
+			var cached cachedResponse
+			json.Unmarshal(raw, &cached)
+			writeUpstreamHeaders(w, cached.Header)
 			w.Header().Set("Content-Type", "application/json")
 			w.Header().Set("X-Cache", "HIT")
+			if pq.hash != "" {
+				setPersistedCacheControl(w, r, cfg)
+			}
 			w.WriteHeader(http.StatusOK)
-			w.Write(cached)
+			w.Write(cached.Body)
 			return
 		}
 	}
@@ -183,16 +255,47 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	plan, err := h.planner.Plan(ctx, req.Query, req.Variables, role)
 	if err != nil {
 		h.recordMetric(plan, time.Since(start), false, err.Error())
-		writeGQLError(w, err.Error(), http.StatusOK)
+		// Parse and validation failures are client errors under
+		// application/graphql-response+json.
+		status := http.StatusOK
+		var gqlErrs gqlerror.List
+		if wantsGraphQLResponse(r) && errors.As(err, &gqlErrs) {
+			status = http.StatusBadRequest
+		}
+		writeGQLError(w, err.Error(), status)
+		return
+	}
+	if !persistedOnly {
+		h.registerPersistedQuery(pq, req.Query)
+	}
+
+	// GET must never change state. The plan covers only the operation that
+	// operationName selects, so this is the type of what would run.
+	if r.Method == http.MethodGet && plan.OperationType != "query" {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGQLError(w, plan.OperationType+" operations must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// ── Introspection check ───────────────────────────────────────────────────
+	// The planner answers __schema / __type from the role's view of the
+	// schema; this only decides whether introspection is allowed at all.
+	if plan.Introspects && h.introspectionEnabled != nil && !h.introspectionEnabled() {
+		writeGQLError(w, "GraphQL introspection is disabled.", http.StatusOK)
 		return
 	}
 
 	// ── Response size cap ─────────────────────────────────────────────────────
 	var rw http.ResponseWriter = w
-	if cfg != nil && cfg.MaxResponseBodyKB > 0 {
+	if !batched && cfg != nil && cfg.MaxResponseBodyKB > 0 {
 		rw = security.NewCappedWriter(w, cfg.MaxResponseBodyKB)
 	}
 
+	if !batched && plan.Incremental() && acceptsIncremental(r) {
+		h.serveIncremental(ctx, rw, plan, headers, start)
+		return
+	}
+
 	result, err := h.executor.Execute(ctx, plan, headers)
 	elapsed := time.Since(start)
 
@@ -209,7 +312,18 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	h.recordMetric(plan, elapsed, success, errMsg)
 
+	if cacheKey != "" && (plan.DependsOnClaims() || plan.Introspects || !sharedCacheable(result.Headers)) {
+		// Row conditions, presets and claim headers depend on the caller's
+		// claims, not just the role. Introspection is never cached, so a hit
+		// cannot outlive introspection being turned off.
+		cacheKey = ""
+	}
+
+	writeUpstreamHeaders(rw, result.Headers)
 	rw.Header().Set("Content-Type", "application/json")
+	if pq.hash != "" && success {
+		setPersistedCacheControl(rw, r, cfg)
+	}
 	if cacheKey != "" {
 		rw.Header().Set("X-Cache", "MISS")
 	}
@@ -218,13 +332,21 @@ func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if cacheKey != "" && success {
 		// Encode into a buffer so we can cache and write in one pass.
 		buf, _ := json.Marshal(result)
-		h.cache.Set(cacheKey, buf)
+		entry, _ := json.Marshal(cachedResponse{Header: result.Headers, Body: buf})
+		h.cache.Set(cacheKey, entry)
 		rw.Write(buf)
 	} else {
 		json.NewEncoder(rw).Encode(result)
 	}
 }
 
+// cachedResponse is a response cache entry: the body and the upstream
+// headers passed back with it, so a HIT answers like the MISS that stored it.
+type cachedResponse struct {
+	Header http.Header     `json:"header,omitempty"`
+	Body   json.RawMessage `json:"body"`
+}
+
 func (h *graphqlHandler) recordMetric(plan *planner.QueryPlan, d time.Duration, success bool, errMsg string) {
 	if h.metrics == nil {
 		return
@@ -284,6 +406,25 @@ func forwardHeaders(r *http.Request) map[string]string {
 	return forward
 }
 
+// writeUpstreamHeaders copies the merged upstream response headers onto the
+// client response. Call before WriteHeader.
+func writeUpstreamHeaders(w http.ResponseWriter, h http.Header) {
+	for name, values := range h {
+		w.Header()[name] = values
+	}
+}
+
+// sharedCacheable reports whether a response carrying these upstream headers
+// may be stored in the response cache: per-user cookies and private or
+// no-store responses are never shared.
+func sharedCacheable(h http.Header) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
 func headerKeys(h map[string]string) []string {
 	keys := make([]string, 0, len(h))
 	for k := range h {
@@ -299,24 +440,3 @@ func writeGQLError(w http.ResponseWriter, msg string, status int) {
 		"errors": []map[string]any{{"message": msg}},
 	})
 }
-
-// isIntrospectionQuery returns true when the query contains meta-fields.
-func isIntrospectionQuery(query string) bool {
-	q := strings.TrimSpace(query)
-	return strings.Contains(q, "__schema") || strings.Contains(q, "__type")
-}
-
-// serveIntrospection builds the introspection response from kastql's merged schema.
-func (h *graphqlHandler) serveIntrospection(w http.ResponseWriter, _ *http.Request) {
-	schema := h.planner.Schema()
-	if schema == nil {
-		writeGQLError(w, "no schema loaded — register at least one service", http.StatusOK)
-		return
-	}
-
-	data := planner.BuildIntrospectionResponse(schema)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]any{"data": data})
-}
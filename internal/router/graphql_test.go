@@ -0,0 +1,221 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/auth"
+	"github.com/deformal/kastql/internal/cache"
+	"github.com/deformal/kastql/internal/executor"
+	"github.com/deformal/kastql/internal/metadata"
+	"github.com/deformal/kastql/internal/planner"
+	"github.com/deformal/kastql/internal/registry"
+)
+
+const ordersSDL = `
+type Query {
+  order(id: ID!): Order
+  orders(ownerId: ID): [Order!]!
+}
+type Mutation {
+  createOrder(total: Float!): Order
+}
+type Order {
+  id: ID!
+  total: Float!
+}
+`
+
+// upstreamLog records the queries an upstream service received.
+type upstreamLog struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (l *upstreamLog) all() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.queries...)
+}
+
+// newTestHandler returns a handler planning against one stitched orders
+// service, and the log of what that service was asked.
+func newTestHandler(t *testing.T) (*graphqlHandler, *upstreamLog) {
+	t.Helper()
+	log := &upstreamLog{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query string `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		log.mu.Lock()
+		log.queries = append(log.queries, req.Query)
+		log.mu.Unlock()
+		w.Write([]byte(`{"data":{"order":{"id":"1","total":1},"orders":[],"createOrder":{"id":"2","total":1}}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	store, err := metadata.Open(t.TempDir()+"/meta.db", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	p := planner.New(store, zap.NewNop())
+	err = p.Update([]*registry.ServiceEntry{{
+		Service: metadata.Service{Name: "orders-svc", URL: upstream.URL, Type: metadata.ServiceTypeStitching, Enabled: true},
+		SDL:     ordersSDL,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &graphqlHandler{
+		store:    store,
+		apq:      NewAPQCache(),
+		planner:  p,
+		executor: executor.New(zap.NewNop()),
+		log:      zap.NewNop(),
+	}, log
+}
+
+func getGraphQL(h http.Handler, params url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/graphql?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetRejectsMutations(t *testing.T) {
+	h, upstream := newTestHandler(t)
+	doc := `query A { order(id: "1") { id } } mutation B { createOrder(total: 1) { id } }`
+
+	if rec := getGraphQL(h, url.Values{"query": {`mutation { createOrder(total: 1) { id } }`}}); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("mutation over GET: got %d, want 405", rec.Code)
+	}
+	// A mutation must not ride along behind a query in the same document.
+	if rec := getGraphQL(h, url.Values{"query": {doc}, "operationName": {"B"}}); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("named mutation over GET: got %d, want 405", rec.Code)
+	}
+	if rec := getGraphQL(h, url.Values{"query": {doc}}); !strings.Contains(rec.Body.String(), "operationName is required") {
+		t.Errorf("unnamed multi-operation document: got %d %s", rec.Code, rec.Body.String())
+	}
+	for _, q := range upstream.all() {
+		if strings.Contains(q, "createOrder") {
+			t.Fatalf("expected no mutation to reach the upstream, got %q", q)
+		}
+	}
+
+	rec := getGraphQL(h, url.Values{"query": {doc}, "operationName": {"A"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"order"`) {
+		t.Fatalf("named query over GET: got %d %s", rec.Code, rec.Body.String())
+	}
+	sent := upstream.all()
+	if len(sent) != 1 || strings.Contains(sent[0], "createOrder") {
+		t.Errorf("expected only query A to be sent upstream, got %q", sent)
+	}
+}
+
+func apqParams(query, hash string) url.Values {
+	params := url.Values{"extensions": {`{"persistedQuery":{"version":1,"sha256Hash":"` + hash + `"}}`}}
+	if query != "" {
+		params.Set("query", query)
+	}
+	return params
+}
+
+func TestAutomaticPersistedQueries(t *testing.T) {
+	h, _ := newTestHandler(t)
+	query := `{ order(id: "1") { id } }`
+	hash := queryHash(query)
+
+	rec := getGraphQL(h, apqParams("", hash))
+	if !strings.Contains(rec.Body.String(), "PERSISTED_QUERY_NOT_FOUND") {
+		t.Fatalf("unknown hash: got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A query that does not plan is not registered.
+	bad := `{ nope }`
+	getGraphQL(h, apqParams(bad, queryHash(bad)))
+	if rec := getGraphQL(h, apqParams("", queryHash(bad))); !strings.Contains(rec.Body.String(), "PERSISTED_QUERY_NOT_FOUND") {
+		t.Errorf("invalid query was registered: got %s", rec.Body.String())
+	}
+
+	if rec := getGraphQL(h, apqParams(query, hash)); rec.Code != http.StatusOK {
+		t.Fatalf("register: got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = getGraphQL(h, apqParams("", hash))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"order"`) {
+		t.Fatalf("by hash: got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Client registrations never reach the admin allowlist.
+	allowlist, err := h.store.ListPersistedQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowlist) != 0 {
+		t.Errorf("expected an empty allowlist, got %d entries", len(allowlist))
+	}
+}
+
+func TestResponseCacheSkipsClaimHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":{"order":{"id":%q}}}`, r.Header.Get("X-User-Id"))
+	}))
+	defer upstream.Close()
+
+	h, _ := newTestHandler(t)
+	h.cache = cache.New(100, time.Minute)
+	err := h.planner.Update([]*registry.ServiceEntry{{
+		Service: metadata.Service{
+			Name: "orders-svc", URL: upstream.URL, Type: metadata.ServiceTypeStitching, Enabled: true,
+			HeaderRules: `{"from_claims":{"X-User-Id":"sub"}}`,
+		},
+		SDL: ordersSDL,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two users of one role: the service answers each by the injected ID,
+	// so neither may be served the other's cached response.
+	for _, sub := range []string{"alice", "bob"} {
+		req := httptest.NewRequest(http.MethodGet, "/graphql?"+url.Values{"query": {`{ order(id: "1") { id } }`}}.Encode(), nil)
+		ctx := auth.SetRole(req.Context(), "user")
+		req = req.WithContext(auth.SetClaims(ctx, map[string]any{"sub": sub}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), `"id":"`+sub+`"`) || rec.Header().Get("X-Cache") != "" {
+			t.Errorf("%s: got %s (X-Cache %q)", sub, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+}
+
+func TestIntrospectionNotCached(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.cache = cache.New(100, time.Minute)
+	var enabled atomic.Bool
+	enabled.Store(true)
+	h.introspectionEnabled = enabled.Load
+
+	query := url.Values{"query": {`{ __schema { queryType { name } } }`}}
+	if rec := getGraphQL(h, query); !strings.Contains(rec.Body.String(), `"Query"`) || rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("enabled: got %s (X-Cache %q)", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	// Turning introspection off takes effect at once, not when a cached
+	// answer expires.
+	enabled.Store(false)
+	if rec := getGraphQL(h, query); !strings.Contains(rec.Body.String(), "introspection is disabled") {
+		t.Errorf("disabled: got %s", rec.Body.String())
+	}
+}
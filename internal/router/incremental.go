@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deformal/kastql/internal/executor"
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// acceptsIncremental reports whether the client accepts @defer / @stream
+// responses as multipart/mixed. Clients that don't get the full result in a
+// single JSON body instead.
+func acceptsIncremental(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "multipart/mixed")
+}
+
+// serveIncremental executes an incremental plan and writes each payload as
+// its own multipart/mixed part, flushing after every part so the client sees
+// fast data before slower deferred steps complete.
+func (h *graphqlHandler) serveIncremental(
+	ctx context.Context,
+	w http.ResponseWriter,
+	plan *planner.QueryPlan,
+	headers map[string]string,
+	start time.Time,
+) {
+	rc := http.NewResponseController(w)
+	var errMsg string
+
+	err := h.executor.ExecuteIncremental(ctx, plan, headers, func(p *executor.Payload) error {
+		if p.Result != nil {
+			writeUpstreamHeaders(w, p.Headers)
+			w.Header().Set("Content-Type", `multipart/mixed; boundary="-"; deferSpec=20220824`)
+			w.WriteHeader(http.StatusOK)
+		}
+		if errMsg == "" {
+			errMsg = firstErrorMessage(p)
+		}
+
+		body, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "\r\n---\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%s", body); err != nil {
+			return err
+		}
+		if !p.HasNext {
+			if _, err := io.WriteString(w, "\r\n-----\r\n"); err != nil {
+				return err
+			}
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent; all that is left is to stop.
+		h.log.Debug("incremental response aborted", zap.Error(err))
+		errMsg = err.Error()
+	}
+	h.recordMetric(plan, time.Since(start), errMsg == "", errMsg)
+}
+
+func firstErrorMessage(p *executor.Payload) string {
+	if p.Result != nil && len(p.Errors) > 0 {
+		return p.Errors[0].Message
+	}
+	for _, inc := range p.Incremental {
+		if len(inc.Errors) > 0 {
+			return inc.Errors[0].Message
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/deformal/kastql/internal/auth"
+	"github.com/deformal/kastql/internal/security"
+)
+
+const (
+	mediaJSON            = "application/json"
+	mediaGraphQLResponse = "application/graphql-response+json"
+)
+
+// wantsGraphQLResponse reports whether the client accepts the
+// application/graphql-response+json media type of the GraphQL-over-HTTP spec.
+// Those clients get 4xx statuses for documents that fail to parse or
+// validate; legacy application/json clients keep getting 200.
+func wantsGraphQLResponse(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), mediaGraphQLResponse)
+}
+
+// mediaTypeWriter swaps the application/json Content-Type set by the
+// handlers for the negotiated media type. Other types, such as
+// multipart/mixed, pass through untouched.
+type mediaTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (m *mediaTypeWriter) WriteHeader(status int) {
+	if !m.wroteHeader {
+		m.wroteHeader = true
+		if m.Header().Get("Content-Type") == mediaJSON {
+			m.Header().Set("Content-Type", m.contentType)
+		}
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *mediaTypeWriter) Write(p []byte) (int, error) {
+	if !m.wroteHeader {
+		m.WriteHeader(http.StatusOK)
+	}
+	return m.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (m *mediaTypeWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// requestFromURL builds a request from the query, variables, operationName
+// and extensions URL parameters of a GET request. variables and extensions
+// are JSON-encoded.
+func requestFromURL(q url.Values) (graphqlRequest, error) {
+	req := graphqlRequest{
+		Query:         q.Get("query"),
+		OperationName: q.Get("operationName"),
+	}
+	if v := q.Get("variables"); v != "" {
+		if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+			return req, errors.New("invalid variables parameter: " + err.Error())
+		}
+	}
+	if v := q.Get("extensions"); v != "" {
+		if err := json.Unmarshal([]byte(v), &req.Extensions); err != nil {
+			return req, errors.New("invalid extensions parameter: " + err.Error())
+		}
+	}
+	return req, nil
+}
+
+// setPersistedCacheControl makes a successful persisted GET response
+// cacheable for cfg.PersistedMaxAge seconds so CDNs can serve it, unless an
+// upstream already chose a Cache-Control or sets cookies. Callers with
+// credentials get a private directive so shared caches never hand one
+// caller's data to another.
+func setPersistedCacheControl(w http.ResponseWriter, r *http.Request, cfg *security.Config) {
+	if r.Method != http.MethodGet || cfg == nil || cfg.PersistedMaxAge <= 0 {
+		return
+	}
+	if w.Header().Get("Cache-Control") != "" || len(w.Header().Values("Set-Cookie")) > 0 {
+		return
+	}
+	scope := "public"
+	if hasCredentials(r) {
+		scope = "private"
+	}
+	w.Header().Set("Cache-Control", scope+", max-age="+strconv.Itoa(cfg.PersistedMaxAge))
+}
+
+// hasCredentials reports whether the response may depend on who is asking.
+func hasCredentials(r *http.Request) bool {
+	if auth.GetClaims(r.Context()) != nil {
+		return true
+	}
+	for _, name := range []string{"Authorization", "Cookie", "X-Router-Key", "X-Kastql-Role"} {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -48,7 +48,8 @@ func ServeREST(store *metadata.Store, p *planner.Planner, exec *executor.Executo
 		vars := buildVars(matched, pathParams, r)
 
 		role := auth.GetRole(r.Context())
-		plan, err := p.Plan(r.Context(), matched.GraphQLQuery, vars, role)
+		ctx := planner.WithContract(r.Context(), auth.GetContract(r.Context()))
+		plan, err := p.Plan(ctx, matched.GraphQLQuery, vars, role)
 		if err != nil {
 			writeGQLError(w, err.Error(), http.StatusOK)
 			return
@@ -60,6 +61,7 @@ func ServeREST(store *metadata.Store, p *planner.Planner, exec *executor.Executo
 			return
 		}
 
+		writeUpstreamHeaders(w, result.Headers)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(result)
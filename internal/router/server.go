@@ -14,6 +14,7 @@ import (
 	"github.com/deformal/kastql/internal/adminapi"
 	"github.com/deformal/kastql/internal/auth"
 	"github.com/deformal/kastql/internal/cache"
+	"github.com/deformal/kastql/internal/compress"
 	"github.com/deformal/kastql/internal/executor"
 	"github.com/deformal/kastql/internal/metaapi"
 	"github.com/deformal/kastql/internal/metadata"
@@ -77,6 +78,16 @@ func New(
 	return s
 }
 
+// compressionOptions reads the response compression settings; without a
+// security manager the defaults apply.
+func (s *Server) compressionOptions() compress.Options {
+	if s.secMgr == nil {
+		return compress.Options{Enabled: true, MinBytes: compress.DefaultMinBytes}
+	}
+	cfg := s.secMgr.Config()
+	return compress.Options{Enabled: cfg.CompressionEnabled, MinBytes: cfg.CompressionMinBytes}
+}
+
 func (s *Server) registerRoutes(jwtMW func(http.Handler) http.Handler, adminH *adminapi.Handler, session *auth.SessionManager) {
 	assets := playground.Handler()
 
@@ -103,6 +114,7 @@ func (s *Server) registerRoutes(jwtMW func(http.Handler) http.Handler, adminH *a
 
 	// ── Admin-protected ───────────────────────────────────────────────────────
 	s.router.Group(func(r chi.Router) {
+		r.Use(compress.Middleware(s.compressionOptions))
 		r.Use(auth.AdminGuard(session))
 
 		r.Post("/v1/metadata", s.meta.ServeHTTP)
@@ -163,6 +175,7 @@ func (s *Server) registerRoutes(jwtMW func(http.Handler) http.Handler, adminH *a
 
 	// ── API routes (CORS + IP filter + rate limit + router key + JWT) ─────────
 	s.router.Group(func(r chi.Router) {
+		r.Use(compress.Middleware(s.compressionOptions))
 		if s.secMgr != nil {
 			r.Use(security.CORSMiddleware(s.secMgr))
 			r.Use(security.IPFilterMiddleware(s.secMgr))
@@ -173,12 +186,14 @@ func (s *Server) registerRoutes(jwtMW func(http.Handler) http.Handler, adminH *a
 		r.Use(jwtMW)
 
 		gql := &graphqlHandler{
+			store:    s.store,
 			planner:  s.planner,
 			executor: s.executor,
 			metrics:  s.metrics,
 			log:      s.log,
 			secMgr:   s.secMgr,
 			cache:    s.gqlCache,
+			apq:      NewAPQCache(),
 			introspectionEnabled: func() bool {
 				val, _, err := s.store.GetSetting("introspection_enabled")
 				if err != nil {
@@ -200,7 +215,7 @@ func (s *Server) registerRoutes(jwtMW func(http.Handler) http.Handler, adminH *a
 				ws.ServeHTTP(w, r)
 				return
 			}
-			writeGQLError(w, "use POST for queries/mutations or WebSocket for subscriptions", http.StatusMethodNotAllowed)
+			gql.ServeHTTP(w, r)
 		})
 
 		restFn := ServeREST(s.store, s.planner, s.executor, s.log)
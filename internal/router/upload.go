@@ -0,0 +1,135 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+// uploadMemoryBytes is how much of a multipart request is kept in memory;
+// larger files are spooled to temporary files until the request ends.
+const uploadMemoryBytes = 8 << 20
+
+// isMultipartRequest reports whether r is a GraphQL multipart request
+// (https://github.com/jaydenseric/graphql-multipart-request-spec).
+func isMultipartRequest(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "multipart/form-data"
+}
+
+// hasPreflightHeader reports whether a multipart request carries a header
+// that a browser would only send after a CORS preflight. multipart/form-data
+// is a "simple" content type, so without such a header a cross-site form
+// could run mutations with the victim's cookies. The header names follow
+// Apollo's CSRF prevention rule.
+func hasPreflightHeader(r *http.Request) bool {
+	return r.Header.Get("Apollo-Require-Preflight") != "" || r.Header.Get("X-Apollo-Operation-Name") != ""
+}
+
+// parseUploadForm reads a multipart request and returns its operations JSON
+// together with the parsed form holding the map and files. The caller must
+// RemoveAll the form once the request is done.
+func parseUploadForm(r *http.Request) (json.RawMessage, *multipart.Form, error) {
+	if err := r.ParseMultipartForm(uploadMemoryBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, fmt.Errorf("request body too large: %w", err)
+		}
+		return nil, nil, fmt.Errorf("invalid multipart body: %w", err)
+	}
+	form := r.MultipartForm
+	ops := form.Value["operations"]
+	if len(ops) == 0 || ops[0] == "" {
+		form.RemoveAll()
+		return nil, nil, errors.New(`multipart request is missing the "operations" field`)
+	}
+	return json.RawMessage(ops[0]), form, nil
+}
+
+// attachUploads places the files of form into the request variables at the
+// paths named by its "map" field, e.g. "variables.file", or
+// "0.variables.file" for a batch. Each path must point at the null
+// placeholder the client left for the file. A nil form is a no-op.
+func attachUploads(form *multipart.Form, reqs []graphqlRequest, batched bool) error {
+	if form == nil {
+		return nil
+	}
+	var fileMap map[string][]string
+	if m := form.Value["map"]; len(m) > 0 && m[0] != "" {
+		if err := json.Unmarshal([]byte(m[0]), &fileMap); err != nil {
+			return fmt.Errorf(`invalid multipart "map" field: %w`, err)
+		}
+	}
+
+	for field, paths := range fileMap {
+		files := form.File[field]
+		if len(files) == 0 {
+			return fmt.Errorf("multipart file %q is missing", field)
+		}
+		upload := &planner.Upload{File: files[0]}
+		for _, path := range paths {
+			if err := setUpload(reqs, batched, path, upload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setUpload(reqs []graphqlRequest, batched bool, path string, upload *planner.Upload) error {
+	parts := strings.Split(path, ".")
+	idx := 0
+	if batched {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 0 || n >= len(reqs) {
+			return fmt.Errorf("invalid upload path %q: unknown operation", path)
+		}
+		idx, parts = n, parts[1:]
+	}
+	if len(parts) < 2 || parts[0] != "variables" {
+		return fmt.Errorf("invalid upload path %q: must point into variables", path)
+	}
+
+	var container any = reqs[idx].Variables
+	for i, key := range parts[1:] {
+		last := i == len(parts)-2
+		switch c := container.(type) {
+		case map[string]any:
+			v, ok := c[key]
+			if !ok {
+				return fmt.Errorf("invalid upload path %q: %q not found", path, key)
+			}
+			if last {
+				if v != nil {
+					return fmt.Errorf("invalid upload path %q: not a null placeholder", path)
+				}
+				c[key] = upload
+				return nil
+			}
+			container = v
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(c) {
+				return fmt.Errorf("invalid upload path %q: bad index %q", path, key)
+			}
+			if last {
+				if c[n] != nil {
+					return fmt.Errorf("invalid upload path %q: not a null placeholder", path)
+				}
+				c[n] = upload
+				return nil
+			}
+			container = c[n]
+		default:
+			return fmt.Errorf("invalid upload path %q: %q not found", path, key)
+		}
+	}
+	return nil
+}
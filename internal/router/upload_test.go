@@ -0,0 +1,55 @@
+package router
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/deformal/kastql/internal/planner"
+)
+
+func TestMultipartRequiresPreflightHeader(t *testing.T) {
+	h, upstream := newTestHandler(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("operations", `{"query":"mutation { createOrder(total: 1) { id } }"}`)
+	mw.WriteField("map", `{}`)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/graphql", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Apollo-Require-Preflight") {
+		t.Errorf("got %d %s, want 400", rec.Code, rec.Body.String())
+	}
+	if sent := upstream.all(); len(sent) != 0 {
+		t.Errorf("expected nothing sent upstream, got %q", sent)
+	}
+}
+
+func TestSetUploadRequiresNullPlaceholder(t *testing.T) {
+	reqs := []graphqlRequest{{Variables: map[string]any{
+		"file":  nil,
+		"name":  "report.pdf",
+		"files": []any{nil, "x"},
+	}}}
+	upload := &planner.Upload{}
+
+	if err := setUpload(reqs, false, "variables.file", upload); err != nil {
+		t.Errorf("null placeholder: %v", err)
+	}
+	if err := setUpload(reqs, false, "variables.files.0", upload); err != nil {
+		t.Errorf("null list placeholder: %v", err)
+	}
+	for _, path := range []string{"variables.name", "variables.files.1", "variables.file"} {
+		if err := setUpload(reqs, false, path, upload); err == nil {
+			t.Errorf("%s: expected an error for a non-null value", path)
+		}
+	}
+}
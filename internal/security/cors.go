@@ -38,7 +38,7 @@ func CORSMiddleware(mgr *Manager) func(http.Handler) http.Handler {
 			if r.Method == http.MethodOptions {
 				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 				w.Header().Set("Access-Control-Allow-Headers",
-					"Content-Type, Authorization, X-Router-Key, X-Request-ID")
+					"Content-Type, Authorization, X-Router-Key, X-Request-ID, Apollo-Require-Preflight, X-Apollo-Operation-Name")
 				w.Header().Set("Access-Control-Max-Age", "86400")
 				w.WriteHeader(http.StatusNoContent)
 				return
@@ -40,13 +40,20 @@ type Config struct {
 	MaxResponseBodyKB  int
 
 	// Persisted queries
-	PersistedOnly bool
+	PersistedOnly   bool
+	PersistedMaxAge int // Cache-Control max-age (seconds) for persisted GET queries; 0 = none
 
 	// WebSocket
 	WSMaxConnections int
 
+	// Response compression
+	CompressionEnabled  bool
+	CompressionMinBytes int
+
 	// Other
 	BatchQueriesEnabled bool
+	BatchMaxSize        int // max operations per batch; 0 = unlimited, 10 recommended
+	BatchConcurrency    int // operations of one batch run at once; 0 = router default
 	AuditLogEnabled     bool
 
 	// version counter — incremented every reload so middlewares can detect staleness
@@ -234,8 +241,13 @@ func (m *Manager) loadFromDB() *Config {
 		MaxRequestBodyKB:    intSetting(settings, "max_request_body_kb"),
 		MaxResponseBodyKB:   intSetting(settings, "max_response_body_kb"),
 		PersistedOnly:       boolSetting(settings, "persisted_only"),
+		PersistedMaxAge:     intSetting(settings, "persisted_max_age"),
 		WSMaxConnections:    intSetting(settings, "ws_max_connections"),
+		CompressionEnabled:  boolSettingDefault(settings, "compression_enabled", true),
+		CompressionMinBytes: intSetting(settings, "compression_min_bytes"),
 		BatchQueriesEnabled: boolSettingDefault(settings, "batch_queries_enabled", true),
+		BatchMaxSize:        intSetting(settings, "batch_max_size"),
+		BatchConcurrency:    intSetting(settings, "batch_concurrency"),
 		AuditLogEnabled:     boolSettingDefault(settings, "audit_log_enabled", true),
 	}
 	return cfg
@@ -28,14 +28,24 @@ func newRateLimitState(globalRPM, perIPRPM, mutationRPM int) *rateLimitState {
 
 // AllowRequest returns true if the request is within global + per-IP limits.
 func (s *rateLimitState) AllowRequest(ip string) bool {
-	if s.globalBucket != nil && !s.globalBucket.take() {
+	return s.AllowRequests(ip, 1)
+}
+
+// AllowRequests is AllowRequest for n requests at once, e.g. the extra
+// operations of a batch. Tokens are only spent when both the global and the
+// per-IP bucket have room for all n.
+func (s *rateLimitState) AllowRequests(ip string, n int) bool {
+	if n <= 0 {
+		return true
+	}
+	if s.globalBucket != nil && !s.globalBucket.takeN(n) {
 		return false
 	}
-	if s.perIPRPM > 0 {
-		bucket := s.bucketFor(ip)
-		if !bucket.take() {
-			return false
+	if s.perIPRPM > 0 && !s.bucketFor(ip).takeN(n) {
+		if s.globalBucket != nil {
+			s.globalBucket.refund(n) // the per-IP limit refused; don't charge everyone for it
 		}
+		return false
 	}
 	return true
 }
@@ -78,6 +88,10 @@ func newTokenBucket(rpm int) *tokenBucket {
 }
 
 func (b *tokenBucket) take() bool {
+	return b.takeN(1)
+}
+
+func (b *tokenBucket) takeN(n int) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -90,13 +104,20 @@ func (b *tokenBucket) take() bool {
 		b.tokens = b.max
 	}
 
-	if b.tokens < 1 {
+	if b.tokens < float64(n) {
 		return false
 	}
-	b.tokens--
+	b.tokens -= float64(n)
 	return true
 }
 
+// refund returns n tokens taken by takeN.
+func (b *tokenBucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+float64(n), b.max)
+}
+
 // ── HTTP middleware ───────────────────────────────────────────────────────────
 
 // RateLimitMiddleware enforces global and per-IP request rate limits.
@@ -0,0 +1,33 @@
+package security
+
+import "testing"
+
+func TestAllowRequestsRefundsGlobal(t *testing.T) {
+	s := newRateLimitState(10, 2, 0)
+
+	if !s.AllowRequests("a", 2) {
+		t.Fatal("expected the first two requests from a to pass")
+	}
+	// a is over its per-IP limit; the global tokens must not be spent on it.
+	for range 5 {
+		if s.AllowRequest("a") {
+			t.Fatal("expected a to be refused by the per-IP limit")
+		}
+	}
+	if !s.AllowRequests("b", 2) || !s.AllowRequests("c", 2) || !s.AllowRequests("d", 2) || !s.AllowRequests("e", 2) {
+		t.Fatal("expected the global bucket to still hold 8 tokens")
+	}
+	if s.AllowRequest("f") {
+		t.Error("expected the global limit to refuse the 11th request")
+	}
+}
+
+func TestAllowRequestsAllOrNothing(t *testing.T) {
+	s := newRateLimitState(0, 3, 0)
+	if s.AllowRequests("a", 4) {
+		t.Fatal("expected a batch larger than the bucket to be refused")
+	}
+	if !s.AllowRequests("a", 3) {
+		t.Error("expected a refused batch to leave the bucket untouched")
+	}
+}
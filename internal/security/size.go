@@ -3,12 +3,15 @@ package security
 import (
 	"bytes"
 	"io"
+	"mime"
 	"net/http"
 )
 
 // RequestSizeLimitMiddleware rejects request bodies larger than MaxRequestBodyKB.
 // It also reads the body into a buffer so graphqlHandler can read it twice
-// (once for batch detection, once for decode).
+// (once for batch detection, once for decode). Multipart uploads are not
+// buffered; their body is limited as it is read instead, so large files can
+// spool to disk.
 func RequestSizeLimitMiddleware(mgr *Manager) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -19,6 +22,11 @@ func RequestSizeLimitMiddleware(mgr *Manager) func(http.Handler) http.Handler {
 			}
 
 			maxBytes := int64(cfg.MaxRequestBodyKB) * 1024
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+				next.ServeHTTP(w, r)
+				return
+			}
 			limited := io.LimitReader(r.Body, maxBytes+1)
 			body, err := io.ReadAll(limited)
 			if err != nil {
@@ -65,3 +73,9 @@ func (c *CappedResponseWriter) Write(p []byte) (int, error) {
 	c.Written += n
 	return n, err
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush incremental responses.
+func (c *CappedResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -656,6 +656,7 @@ function PersistedQueriesSection() {
             label="Persisted Queries Only"
             description="When enabled, only pre-registered queries are accepted. Ad-hoc query strings are rejected."
           />
+          <NumericSetting settingKey="persisted_max_age" label="Persisted GET Max Age" description="Cache-Control max-age for persisted queries sent via GET, so CDNs can cache them. 0 = no header." suffix="s" />
         </div>
       </div>
       <div style={{ display: 'flex', justifyContent: 'space-between', alignItems: 'center', marginBottom: '0.75rem', marginTop: '1rem' }}>
@@ -735,6 +736,7 @@ function OtherSection() {
           label="Batch Queries"
           description="Allow sending multiple operations as a JSON array in a single request."
         />
+        <NumericSetting settingKey="batch_max_size" label="Max Batch Size" description="Maximum operations per batched request. Each operation counts against rate limits. 0 = unlimited." />
         <div style={{ borderTop: '1px solid #1e293b', marginTop: '1rem', paddingTop: '1rem' }}>
           <SettingToggle
             settingKey="audit_log_enabled"
@@ -742,7 +744,15 @@ function OtherSection() {
             description="Record admin mutations (settings changes, key rotations) to the audit log."
           />
         </div>
+        <div style={{ borderTop: '1px solid #1e293b', marginTop: '1rem', paddingTop: '1rem' }}>
+          <SettingToggle
+            settingKey="compression_enabled"
+            label="Response Compression"
+            description="Compress /graphql, /api and admin responses with brotli or gzip when the client accepts it."
+          />
+        </div>
       </div>
+      <NumericSetting settingKey="compression_min_bytes" label="Compression Threshold" description="Responses smaller than this are sent uncompressed. Size limits always apply to the uncompressed body." suffix="bytes" />
       <NumericSetting settingKey="ws_max_connections" label="Max WebSocket Connections" description="Maximum concurrent WebSocket subscription connections. 0 = unlimited." />
     </Card>
   )